@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/dennyaris/html-rotate/util"
+)
+
+type invalidateRequest struct {
+	PageID string `json:"page_id"`
+	Url    string `json:"url"`
+}
+
+// InvalidateCache drops the cached entries of one page, by page id and/or
+// url, instead of flushing the whole cache. It deletes them from the shared
+// cache and the L1 of this instance only: with the tiered backend the other
+// instances keep serving their L1 copy until it expires, at most
+// cache.l1_ttl later.
+func (h *Handler) InvalidateCache(w http.ResponseWriter, r *http.Request) {
+	var req invalidateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.PageID = strings.TrimSpace(req.PageID)
+	req.Url = strings.TrimSpace(req.Url)
+	if req.PageID == "" && req.Url == "" {
+		util.ResponseError(w, "page_id or url is required", http.StatusBadRequest)
+		return
+	}
+
+	var keys []string
+	if req.Url != "" {
+		key := util.PageCacheKey(req.Url)
+		if err := h.deleteCacheKeys([]string{key}); err != nil {
+			util.ResponseError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	if req.PageID != "" {
+		data, err := h.Pages.Get(req.PageID)
+		if err != nil {
+			util.ResponseError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		deleted, err := h.invalidatePage(req.PageID, hex.EncodeToString([]byte(data.UrlKey)))
+		keys = append(keys, deleted...)
+		if err != nil {
+			util.ResponseError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	util.ResponseSuccess(w, map[string][]string{"keys": keys}, "success invalidate cache")
+}
+
+// invalidatePage deletes the page lookup entries of the given url keys and
+// the stats, strategy and weights of every experiment running on the page,
+// it returns the deleted cache keys
+func (h *Handler) invalidatePage(pageID string, urlKeyHexes ...string) ([]string, error) {
+	keys, err := h.pageCacheKeys(pageID, urlKeyHexes...)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, h.deleteCacheKeys(keys)
+}
+
+// pageCacheKeys returns the cache keys holding data of the page
+func (h *Handler) pageCacheKeys(pageID string, urlKeyHexes ...string) ([]string, error) {
+	var keys []string
+	for _, urlKeyHex := range urlKeyHexes {
+		if urlKeyHex != "" {
+			keys = append(keys, util.PageCacheKeyHashed(urlKeyHex))
+		}
+	}
+
+	experimentKeys, err := h.Experiments.KeysByPageID(pageID)
+	if err != nil {
+		return nil, err
+	}
+	for _, experimentKey := range experimentKeys {
+		keys = append(keys, util.ExperimentCacheKey(experimentKey), util.StrategyCacheKey(experimentKey), util.WeightsCacheKey(experimentKey))
+	}
+
+	return keys, nil
+}
+
+func (h *Handler) deleteCacheKeys(keys []string) error {
+	for _, key := range keys {
+		if h.Stale != nil {
+			if err := h.Stale.Delete(key); err != nil {
+				return err
+			}
+		}
+		if err := h.Cache.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,45 +1,50 @@
 package api
 
 import (
-	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/dennyaris/html-rotate/adapter/models"
+	"github.com/dennyaris/html-rotate/adapter/repository"
 	"github.com/dennyaris/html-rotate/util"
 	"github.com/go-playground/validator"
 	"github.com/gorilla/mux"
 )
 
 type Handler struct {
-	DB *sql.DB
-}
+	repository.Repositories
+	Cache util.Cache
 
-var validate *validator.Validate
-var pageModel models.Page
+	// Stale is the fallback cache of the rotate handler, the entries of a
+	// changed page are dropped from it too so an outage doesn't serve them
+	Stale util.Cache
+}
 
 func (h *Handler) CreatePage(w http.ResponseWriter, r *http.Request) {
-	err := json.NewDecoder(r.Body).Decode(&pageModel)
+	// decoded per request, fields of an earlier request mustn't leak in
+	var page models.Page
+	err := json.NewDecoder(r.Body).Decode(&page)
 	if err != nil {
 		util.ResponseError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	validate = validator.New()
-	if err := validate.Struct(pageModel); err != nil {
+	if err := validator.New().Struct(page); err != nil {
 		util.ResponseError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := pageModel.Create(h.DB); err != nil {
+	if err := h.Pages.Create(&page); err != nil {
 		util.ResponseError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	pageModel.Created = time.Now().Format("2006-01-02 15:04:05")
+	page.Created = time.Now().Format("2006-01-02 15:04:05")
 
-	util.ResponseSuccess(w, pageModel, "Success created")
+	util.ResponseSuccess(w, page, "Success created")
 }
 
 func (h *Handler) GetPage(w http.ResponseWriter, r *http.Request) {
@@ -51,7 +56,7 @@ func (h *Handler) GetPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := pageModel.Show(h.DB, pageID)
+	data, err := h.Pages.Get(pageID)
 	if err != nil {
 		util.ResponseError(w, err.Error(), http.StatusNotFound)
 		return
@@ -69,12 +74,14 @@ func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := pageModel.Show(h.DB, pageID)
+	data, err := h.Pages.Get(pageID)
 	if err != nil {
 		util.ResponseError(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
+	oldUrlKey := hex.EncodeToString([]byte(data.UrlKey))
+
 	var page models.Page
 	err = json.NewDecoder(r.Body).Decode(&page)
 	if err != nil {
@@ -101,11 +108,15 @@ func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
 		data.SiteID = page.SiteID
 	}
 
-	if err := pageModel.Update(h.DB, pageID, *data); err != nil {
+	if err := h.Pages.Update(pageID, *data); err != nil {
 		util.ResponseError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if _, err := h.invalidatePage(pageID, oldUrlKey, util.EncodeString(data.UrlKey)); err != nil {
+		log.Printf("error invalidating page cache : %v", err)
+	}
+
 	util.ResponseSuccess(w, nil, "Success update")
 }
 
@@ -118,16 +129,26 @@ func (h *Handler) DeletePage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := pageModel.Show(h.DB, pageID)
+	data, err := h.Pages.Get(pageID)
 	if err != nil {
 		util.ResponseError(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	if err = pageModel.Delete(h.DB, pageID); err != nil {
+	// look up the experiments before the page row is gone
+	keys, err := h.pageCacheKeys(pageID, hex.EncodeToString([]byte(data.UrlKey)))
+	if err != nil {
+		log.Printf("error invalidating page cache : %v", err)
+	}
+
+	if err = h.Pages.Delete(pageID); err != nil {
 		util.ResponseError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if err := h.deleteCacheKeys(keys); err != nil {
+		log.Printf("error invalidating page cache : %v", err)
+	}
+
 	util.ResponseSuccess(w, nil, "success deleted")
 }
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/util"
+	"github.com/gorilla/mux"
+)
+
+func newHandler() *Handler {
+	return &Handler{Repositories: repository.NewMemory().Repositories(), Cache: util.NewLRU(64), Stale: util.NewLRU(64)}
+}
+
+// serve runs a handler with the {id} route variable set like the router does
+func serve(handler http.HandlerFunc, method, target, body, pageID string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if pageID != "" {
+		r = mux.SetURLVars(r, map[string]string{"id": pageID})
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func createPage(t *testing.T, h *Handler, page models.Page) {
+	t.Helper()
+
+	body, err := json.Marshal(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h.CreatePage, http.MethodPost, "/api/page/create", string(body), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCreateAndGetPage(t *testing.T) {
+	h := newHandler()
+	createPage(t, h, models.Page{PageID: "p_1", PageKey: "p_1", UrlKey: "https://example.com/a", Url: "https://example.com/a", IsRotator: 2, UserID: 4, SiteID: 7})
+
+	w := serve(h.GetPage, http.MethodGet, "/api/page/p_1", "", "p_1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("get answered %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data models.Page `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.PageID != "p_1" || resp.Data.Url != "https://example.com/a" || resp.Data.UserID != 4 || resp.Data.SiteID != 7 {
+		t.Errorf("got %+v", resp.Data)
+	}
+}
+
+func TestCreatePageValidates(t *testing.T) {
+	h := newHandler()
+
+	w := serve(h.CreatePage, http.MethodPost, "/api/page/create", `{"page_id":"p_1"}`, "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a page without url answered %d", w.Code)
+	}
+	w = serve(h.CreatePage, http.MethodPost, "/api/page/create", `{`, "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a malformed body answered %d", w.Code)
+	}
+}
+
+func TestGetUnknownPage(t *testing.T) {
+	h := newHandler()
+
+	if w := serve(h.GetPage, http.MethodGet, "/api/page/p_9", "", "p_9"); w.Code != http.StatusNotFound {
+		t.Errorf("answered %d", w.Code)
+	}
+	if w := serve(h.GetPage, http.MethodGet, "/api/page/", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("a missing id answered %d", w.Code)
+	}
+}
+
+func TestUpdatePageInvalidatesCache(t *testing.T) {
+	h := newHandler()
+	createPage(t, h, models.Page{PageID: "p_1", PageKey: "p_1", UrlKey: "https://example.com/a", Url: "https://example.com/a", IsRotator: 2, UserID: 1, SiteID: 1})
+
+	oldKey := util.PageCacheKey("https://example.com/a")
+	if err := h.Cache.Set(oldKey, []byte(`{"pageID":"p_1","pageType":"page"}`), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Stale.Set(oldKey, []byte(`{"pageID":"p_1","pageType":"page"}`), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(h.Update, http.MethodPatch, "/api/page/update/p_1", `{"url_key":"https://example.com/b","url":"https://example.com/b","is_rotator":2}`, "p_1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("update answered %d: %s", w.Code, w.Body)
+	}
+
+	if _, err := h.Cache.Get(oldKey); err == nil {
+		t.Error("the old url is still cached")
+	}
+	if _, err := h.Stale.Get(oldKey); err == nil {
+		t.Error("an outage would still serve the old url")
+	}
+	page, err := h.Pages.FindByUrlKey(util.EncodeString("https://example.com/b"))
+	if err != nil || page.PageID != "p_1" || page.Url != "https://example.com/b" {
+		t.Errorf("the page isn't found by its new url: %+v %v", page, err)
+	}
+
+	if w := serve(h.Update, http.MethodPatch, "/api/page/update/p_9", `{}`, "p_9"); w.Code != http.StatusNotFound {
+		t.Errorf("updating an unknown page answered %d", w.Code)
+	}
+}
+
+func TestDeletePageInvalidatesCache(t *testing.T) {
+	h := newHandler()
+	createPage(t, h, models.Page{PageID: "p_1", PageKey: "p_1", UrlKey: "https://example.com/a", Url: "https://example.com/a", IsRotator: 2, UserID: 1, SiteID: 1})
+
+	key := util.PageCacheKey("https://example.com/a")
+	if err := h.Cache.Set(key, []byte(`{"pageID":"p_1","pageType":"page"}`), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Stale.Set(key, []byte(`{"pageID":"p_1","pageType":"page"}`), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serve(h.DeletePage, http.MethodDelete, "/api/page/delete/p_1", "", "p_1"); w.Code != http.StatusOK {
+		t.Fatalf("delete answered %d: %s", w.Code, w.Body)
+	}
+	if _, err := h.Cache.Get(key); err == nil {
+		t.Error("the deleted page is still cached")
+	}
+	if _, err := h.Stale.Get(key); err == nil {
+		t.Error("an outage would still serve the deleted page")
+	}
+	if w := serve(h.GetPage, http.MethodGet, "/api/page/p_1", "", "p_1"); w.Code != http.StatusNotFound {
+		t.Errorf("the deleted page answered %d", w.Code)
+	}
+	if w := serve(h.DeletePage, http.MethodDelete, "/api/page/delete/p_1", "", "p_1"); w.Code != http.StatusNotFound {
+		t.Errorf("deleting it again answered %d", w.Code)
+	}
+}
+
+func TestInvalidateCacheByUrl(t *testing.T) {
+	h := newHandler()
+
+	key := util.PageCacheKey("https://example.com/a")
+	if err := h.Cache.Set(key, []byte("x"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serve(h.InvalidateCache, http.MethodPost, "/api/cache/invalidate", `{}`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("an empty request answered %d", w.Code)
+	}
+	if w := serve(h.InvalidateCache, http.MethodPost, "/api/cache/invalidate", `{"url":"https://example.com/a"}`, ""); w.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", w.Code, w.Body)
+	}
+	if _, err := h.Cache.Get(key); err == nil {
+		t.Error("the url is still cached")
+	}
+}
@@ -0,0 +1,125 @@
+package bandit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+func init() {
+	Register("epsilon-greedy", func(params json.RawMessage) (Strategy, error) {
+		return newEpsilonGreedyFromParams(params)
+	})
+}
+
+// Epsilon schedules
+const (
+	ScheduleConstant    = "constant"
+	ScheduleInverse     = "inverse"
+	ScheduleExponential = "exponential"
+	ScheduleTime        = "time"
+)
+
+// EpsilonParams are the per experiment settings of the epsilon-greedy
+// strategy.
+//
+//   - constant:    epsilon
+//   - inverse:     epsilon / (1 + decay*t)
+//   - exponential: epsilon * exp(-decay*t)
+//   - time:        epsilon * 0.5^(elapsed/half_life) since start
+//
+// where t is the total impressions of the experiment. The result never drops
+// below min_epsilon.
+type EpsilonParams struct {
+	Epsilon    float64 `json:"epsilon"`
+	MinEpsilon float64 `json:"min_epsilon"`
+	Schedule   string  `json:"schedule"`
+	Decay      float64 `json:"decay"`
+	Start      string  `json:"start"`
+	HalfLife   string  `json:"half_life"`
+	Seed       int64   `json:"seed"`
+}
+
+// EpsilonGreedy explores a uniformly random variant with probability
+// epsilon and serves the best converting variant otherwise
+type EpsilonGreedy struct {
+	Schedule func(t int, now time.Time) float64
+	Sampler  *Sampler
+	Now      func() time.Time
+}
+
+func newEpsilonGreedyFromParams(raw json.RawMessage) (*EpsilonGreedy, error) {
+	params := EpsilonParams{Epsilon: 0.1, Schedule: ScheduleConstant, Decay: 1}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, fmt.Errorf("invalid epsilon-greedy params: %v", err)
+		}
+	}
+	if params.Epsilon < 0 || params.Epsilon > 1 {
+		return nil, errors.New("epsilon must be between 0 and 1")
+	}
+	if params.MinEpsilon < 0 || params.MinEpsilon > params.Epsilon {
+		return nil, errors.New("min_epsilon must be between 0 and epsilon")
+	}
+	if params.Decay < 0 {
+		return nil, errors.New("epsilon decay must not be negative")
+	}
+
+	eps, minEps, decay := params.Epsilon, params.MinEpsilon, params.Decay
+	floor := func(e float64) float64 { return math.Max(minEps, e) }
+
+	var schedule func(t int, now time.Time) float64
+	switch params.Schedule {
+	case ScheduleConstant, "":
+		schedule = func(int, time.Time) float64 { return eps }
+	case ScheduleInverse:
+		schedule = func(t int, _ time.Time) float64 { return floor(eps / (1 + decay*float64(t))) }
+	case ScheduleExponential:
+		schedule = func(t int, _ time.Time) float64 { return floor(eps * math.Exp(-decay*float64(t))) }
+	case ScheduleTime:
+		start, err := time.Parse(time.RFC3339, params.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid epsilon start: %v", err)
+		}
+		halfLife, err := time.ParseDuration(params.HalfLife)
+		if err != nil || halfLife <= 0 {
+			return nil, fmt.Errorf("invalid epsilon half_life: %q", params.HalfLife)
+		}
+		schedule = func(_ int, now time.Time) float64 {
+			elapsed := now.Sub(start)
+			if elapsed < 0 {
+				return eps
+			}
+			return floor(eps * math.Pow(0.5, float64(elapsed)/float64(halfLife)))
+		}
+	default:
+		return nil, fmt.Errorf("unknown epsilon schedule: %s", params.Schedule)
+	}
+
+	return &EpsilonGreedy{
+		Schedule: schedule,
+		Sampler:  NewSeededSampler(params.Seed),
+		Now:      time.Now,
+	}, nil
+}
+
+func (e *EpsilonGreedy) Select(variants []VariantStats) string {
+	if len(variants) == 0 {
+		return ""
+	}
+
+	total := 0
+	for _, v := range variants {
+		total += v.Impression
+	}
+
+	if e.Sampler.Float64() >= e.Schedule(total, e.Now()) {
+		if best := mabExploit(variants); best != "" {
+			return best
+		}
+	}
+
+	return variants[e.Sampler.Intn(len(variants))].VariantID
+}
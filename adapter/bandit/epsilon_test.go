@@ -0,0 +1,84 @@
+package bandit
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEpsilonSchedules(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		params string
+		t      int
+		now    time.Time
+		want   float64
+	}{
+		{params: ``, t: 0, want: 0.1},
+		{params: `{"epsilon":0.3}`, t: 1000000, want: 0.3},
+		{params: `{"epsilon":0.5,"schedule":"inverse","decay":0.1}`, t: 0, want: 0.5},
+		{params: `{"epsilon":0.5,"schedule":"inverse","decay":0.1}`, t: 10, want: 0.25},
+		{params: `{"epsilon":0.5,"schedule":"inverse","decay":0.1}`, t: 90, want: 0.05},
+		{params: `{"epsilon":0.5,"min_epsilon":0.1,"schedule":"inverse","decay":0.1}`, t: 90, want: 0.1},
+		{params: `{"epsilon":0.4,"schedule":"exponential","decay":0.01}`, t: 0, want: 0.4},
+		{params: `{"epsilon":0.4,"schedule":"exponential","decay":0.01}`, t: 100, want: 0.4 * math.Exp(-1)},
+		{params: `{"epsilon":0.4,"schedule":"exponential","decay":0.01}`, t: 1000, want: 0.4 * math.Exp(-10)},
+		{params: `{"epsilon":0.4,"min_epsilon":0.05,"schedule":"exponential","decay":0.01}`, t: 1000, want: 0.05},
+		// before start the schedule hasn't begun decaying
+		{params: `{"epsilon":0.4,"schedule":"time","start":"2024-01-01T00:00:00Z","half_life":"24h"}`, now: start.Add(-time.Hour), want: 0.4},
+		{params: `{"epsilon":0.4,"schedule":"time","start":"2024-01-01T00:00:00Z","half_life":"24h"}`, now: start.Add(24 * time.Hour), want: 0.2},
+		{params: `{"epsilon":0.4,"schedule":"time","start":"2024-01-01T00:00:00Z","half_life":"24h"}`, now: start.Add(72 * time.Hour), want: 0.05},
+		{params: `{"epsilon":0.4,"min_epsilon":0.1,"schedule":"time","start":"2024-01-01T00:00:00Z","half_life":"24h"}`, now: start.Add(72 * time.Hour), want: 0.1},
+	}
+
+	for _, c := range cases {
+		strategy, err := newEpsilonGreedyFromParams(json.RawMessage(c.params))
+		if err != nil {
+			t.Errorf("%s: %v", c.params, err)
+			continue
+		}
+		if got := strategy.Schedule(c.t, c.now); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%s at t=%d: epsilon %v, want %v", c.params, c.t, got, c.want)
+		}
+	}
+}
+
+func TestEpsilonFloorHolds(t *testing.T) {
+	for _, params := range []string{
+		`{"epsilon":0.5,"min_epsilon":0.02,"schedule":"inverse","decay":1}`,
+		`{"epsilon":0.5,"min_epsilon":0.02,"schedule":"exponential","decay":1}`,
+		`{"epsilon":0.5,"min_epsilon":0.02,"schedule":"time","start":"2024-01-01T00:00:00Z","half_life":"1h"}`,
+	} {
+		strategy, err := newEpsilonGreedyFromParams(json.RawMessage(params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for t0 := 0; t0 <= 1e6; t0 = t0*10 + 1 {
+			now = now.Add(time.Duration(t0) * time.Hour)
+			if eps := strategy.Schedule(t0, now); eps < 0.02 {
+				t.Errorf("%s at t=%d: epsilon %v below min_epsilon", params, t0, eps)
+			}
+		}
+	}
+}
+
+func TestEpsilonParamsRejected(t *testing.T) {
+	for _, params := range []string{
+		`{"schedule":"linear"}`,
+		`{"schedule":"Inverse"}`,
+		`{"epsilon":1.5}`,
+		`{"epsilon":-0.1}`,
+		`{"epsilon":0.1,"min_epsilon":0.2}`,
+		`{"decay":-1}`,
+		`{"schedule":"time","half_life":"24h"}`,
+		`{"schedule":"time","start":"2024-01-01T00:00:00Z","half_life":"0s"}`,
+		`{"epsilon":"0.1"}`,
+	} {
+		if _, err := New("epsilon-greedy", json.RawMessage(params)); err == nil {
+			t.Errorf("%s: expected an error", params)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package bandit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+func init() {
+	Register("mab", func(params json.RawMessage) (Strategy, error) {
+		thompson, err := newThompsonFromParams(params)
+		if err != nil {
+			return nil, err
+		}
+		return MAB{Thompson: thompson}, nil
+	})
+	Register("greedy", func(json.RawMessage) (Strategy, error) { return Greedy{}, nil })
+	Register("thompson", func(params json.RawMessage) (Strategy, error) {
+		return newThompsonFromParams(params)
+	})
+}
+
+// ThompsonParams are the per experiment settings of the Thompson sampler.
+// Alpha0 and Beta0 are the Beta prior of every variant and Seed, when not
+// zero, makes the draws reproducible.
+type ThompsonParams struct {
+	Alpha0 float64 `json:"alpha0"`
+	Beta0  float64 `json:"beta0"`
+	Seed   int64   `json:"seed"`
+}
+
+func newThompsonFromParams(raw json.RawMessage) (*Thompson, error) {
+	params := ThompsonParams{Alpha0: 1, Beta0: 1}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, fmt.Errorf("invalid thompson params: %v", err)
+		}
+	}
+	if params.Alpha0 <= 0 || params.Beta0 <= 0 {
+		return nil, errors.New("thompson priors alpha0 and beta0 must be positive")
+	}
+
+	return NewThompson(params.Alpha0, params.Beta0, NewSeededSampler(params.Seed)), nil
+}
+
+// MAB exploits the best converting variant once its confidence threshold is
+// tight enough and falls back to Thompson sampling otherwise
+type MAB struct {
+	Thompson *Thompson
+}
+
+func (m MAB) Select(variants []VariantStats) string {
+	threshold := calculateThreshold(variants, 0.95)
+	variantID := mabExploit(variants)
+
+	// without any success there is nothing to exploit yet
+	if variantID != "" && threshold[variantID] <= 0.01 {
+		useMAB := m.Thompson.Sampler.Float64() < 0.9
+		if !useMAB {
+			variantID = m.Thompson.Select(variants)
+		}
+	} else {
+		variantID = m.Thompson.Select(variants)
+	}
+
+	return variantID
+}
+
+// Greedy always serves the variant with the best success rate, until a
+// variant succeeds it serves the least played one
+type Greedy struct{}
+
+func (Greedy) Select(variants []VariantStats) string {
+	if best := mabExploit(variants); best != "" {
+		return best
+	}
+
+	var selectedVariant string
+	minImpression := -1
+	for _, v := range variants {
+		if minImpression < 0 || v.Impression < minImpression {
+			minImpression = v.Impression
+			selectedVariant = v.VariantID
+		}
+	}
+
+	return selectedVariant
+}
+
+// Thompson performs Bernoulli Thompson sampling: every variant draws from
+// Beta(Alpha0+success, Beta0+fail) and the highest draw is served
+type Thompson struct {
+	Alpha0  float64
+	Beta0   float64
+	Sampler *Sampler
+}
+
+func NewThompson(alpha0, beta0 float64, sampler *Sampler) *Thompson {
+	return &Thompson{Alpha0: alpha0, Beta0: beta0, Sampler: sampler}
+}
+
+func (t *Thompson) Select(variants []VariantStats) string {
+	var selectedVariant string
+	maxSampledValue := -1.0
+	for _, v := range variants {
+		fail := v.Impression - v.Success
+		if fail < 0 {
+			fail = 0
+		}
+
+		value := t.Sampler.Beta(t.Alpha0+float64(v.Success), t.Beta0+float64(fail))
+		if value > maxSampledValue {
+			maxSampledValue = value
+			selectedVariant = v.VariantID
+		}
+	}
+
+	return selectedVariant
+}
+
+// Best returns the variant with the best success rate, or an empty string
+// while no variant has a success
+func Best(variants []VariantStats) string {
+	return mabExploit(variants)
+}
+
+// Function to exploit the Multi-Armed Bandit (MAB) algorithm, it returns an
+// empty string while no played variant has a success
+func mabExploit(variants []VariantStats) string {
+	var maxValue float64
+	var selectedVariant string
+
+	for _, v := range variants {
+		if v.Impression <= 0 {
+			// an unplayed variant has no rate to compare
+			continue
+		}
+		rate := float64(v.Success) / float64(v.Impression)
+		if rate > maxValue {
+			maxValue = rate
+			selectedVariant = v.VariantID
+		}
+	}
+
+	return selectedVariant
+}
+
+// Function to calculate the threshold for each arm
+func calculateThreshold(variants []VariantStats, confidenceLevel float64) map[string]float64 {
+	thresholds := make(map[string]float64)
+
+	for _, v := range variants {
+		meanReward := float64(v.Success) / float64(v.Impression)
+		standardError := math.Sqrt(meanReward * (1 - meanReward) / float64(v.Impression))
+		zScore := math.Abs(statsInv(1 - (confidenceLevel / 2)))
+		marginOfError := zScore * standardError
+		thresholds[v.VariantID] = 2 * marginOfError
+	}
+
+	return thresholds
+}
+
+// Function to calculate the inverse of the standard normal cumulative distribution function
+func statsInv(p float64) float64 {
+	q := p - 0.5
+	var r float64
+
+	if math.Abs(q) <= 0.425 {
+		r = 0.180625 - q*q
+		return q * (((((((2.5090809287301226727e3*r+3.3430575583588128105e4)*r+6.7265770927008700853e4)*r+4.5921953931549871457e4)*r+1.3731693765509461125e4)*r+1.9715909503065514427e3)*r+1.3314166789178437745e2)*r + 3.3871328727963666080e0) / (((((((5.2264952788528545610e3*r+2.8729085735721942674e4)*r+3.9307895800092710610e4)*r+2.1213794301586595867e4)*r+5.3941960214247511077e3)*r+6.8718700749205790830e2)*r+4.2313330701600911252e1)*r + 1.0)
+	}
+
+	r = math.Log(-math.Log(p))
+	r = 1.570796288 + r*(0.305532033+r*(0.0000000383+r*(-0.000003298)))
+	if q < 0 {
+		return -r
+	}
+	return r
+}
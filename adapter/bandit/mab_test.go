@@ -0,0 +1,95 @@
+package bandit
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestThompsonPriors(t *testing.T) {
+	cases := []struct {
+		params        string
+		alpha0, beta0 float64
+		fails         bool
+	}{
+		{params: "", alpha0: 1, beta0: 1},
+		{params: `{"seed":3}`, alpha0: 1, beta0: 1},
+		{params: `{"alpha0":2,"beta0":5}`, alpha0: 2, beta0: 5},
+		{params: `{"alpha0":0.5}`, alpha0: 0.5, beta0: 1},
+		{params: `{"alpha0":0}`, fails: true},
+		{params: `{"beta0":-1}`, fails: true},
+		{params: `{"alpha0":"1"}`, fails: true},
+	}
+
+	for _, c := range cases {
+		thompson, err := newThompsonFromParams(json.RawMessage(c.params))
+		if c.fails {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.params, err)
+			continue
+		}
+		if thompson.Alpha0 != c.alpha0 || thompson.Beta0 != c.beta0 {
+			t.Errorf("%q: prior Beta(%v, %v), want Beta(%v, %v)", c.params, thompson.Alpha0, thompson.Beta0, c.alpha0, c.beta0)
+		}
+	}
+}
+
+// shareOfBest is how often Thompson serves the clearly better variant
+func shareOfBest(alpha0, beta0 float64) float64 {
+	thompson := NewThompson(alpha0, beta0, NewSeededSampler(17))
+	variants := []VariantStats{
+		{VariantID: "best", Impression: 20, Success: 12},
+		{VariantID: "worst", Impression: 20, Success: 4},
+	}
+
+	best := 0
+	for i := 0; i < 2000; i++ {
+		if thompson.Select(variants) == "best" {
+			best++
+		}
+	}
+	return float64(best) / 2000
+}
+
+func TestThompsonPriorWeight(t *testing.T) {
+	// with a flat prior the data decides, a prior worth thousands of trials
+	// keeps both variants close to even
+	if share := shareOfBest(1, 1); share < 0.95 {
+		t.Errorf("flat prior served the best variant %.2f of the time", share)
+	}
+	if share := shareOfBest(5000, 5000); share > 0.7 {
+		t.Errorf("strong prior served the best variant %.2f of the time", share)
+	}
+}
+
+func TestZeroSuccessVariants(t *testing.T) {
+	variants := []VariantStats{
+		{VariantID: "a", Impression: 30},
+		{VariantID: "b", Impression: 10},
+		{VariantID: "c"},
+	}
+
+	if best := Best(variants); best != "" {
+		t.Errorf("Best picked %s without any success", best)
+	}
+	if v := (Greedy{}).Select(variants); v != "c" {
+		t.Errorf("Greedy served %s, want the unplayed variant", v)
+	}
+	if v := (Greedy{}).Select(variants[:2]); v != "b" {
+		t.Errorf("Greedy served %s, want the least played variant", v)
+	}
+
+	// every variant keeps being served while none converts
+	mab := MAB{Thompson: NewThompson(1, 1, NewSeededSampler(3))}
+	served := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		served[mab.Select(variants)]++
+	}
+	if len(served) != 3 || served[""] > 0 {
+		t.Errorf("mab served %v", served)
+	}
+}
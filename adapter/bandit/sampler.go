@@ -0,0 +1,114 @@
+package bandit
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// Sampler draws random values for the strategies. A Sampler built from a
+// fixed seed always yields the same sequence, which makes a strategy
+// reproducible when debugging an experiment.
+type Sampler struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewSampler returns a Sampler reading from src, or from the auto-seeded
+// global source when src is nil
+func NewSampler(src rand.Source) *Sampler {
+	if src == nil {
+		return &Sampler{}
+	}
+
+	return &Sampler{rng: rand.New(src)}
+}
+
+// NewSeededSampler returns a Sampler seeded with seed, a zero seed means the
+// global source is used
+func NewSeededSampler(seed int64) *Sampler {
+	if seed == 0 {
+		return NewSampler(nil)
+	}
+
+	return NewSampler(rand.NewSource(seed))
+}
+
+// Float64 returns a uniform value in [0.0, 1.0)
+func (s *Sampler) Float64() float64 {
+	if s.rng == nil {
+		return rand.Float64()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rng.Float64()
+}
+
+// Intn returns a uniform value in [0, n)
+func (s *Sampler) Intn(n int) int {
+	if s.rng == nil {
+		return rand.Intn(n)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rng.Intn(n)
+}
+
+func (s *Sampler) normFloat64() float64 {
+	if s.rng == nil {
+		return rand.NormFloat64()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rng.NormFloat64()
+}
+
+// Gamma draws from a Gamma(shape, 1) distribution using the Marsaglia and
+// Tsang method
+func (s *Sampler) Gamma(shape float64) float64 {
+	if shape <= 0 {
+		return 0
+	}
+
+	// Gamma(a) = Gamma(a+1) * U^(1/a) for shapes below one
+	if shape < 1 {
+		return s.Gamma(shape+1) * math.Pow(s.Float64(), 1/shape)
+	}
+
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := s.normFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+
+		u := s.Float64()
+		if u < 1-0.0331*x*x*x*x {
+			return d * v
+		}
+		if math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
+
+// Beta draws from a Beta(alpha, beta) distribution as the ratio of two
+// Gamma draws
+func (s *Sampler) Beta(alpha, beta float64) float64 {
+	x := s.Gamma(alpha)
+	y := s.Gamma(beta)
+	if x+y == 0 {
+		return 0
+	}
+
+	return x / (x + y)
+}
@@ -0,0 +1,68 @@
+package bandit
+
+import (
+	"math"
+	"testing"
+)
+
+const draws = 200000
+
+// moments returns the mean and the variance of n draws
+func moments(n int, draw func() float64) (float64, float64) {
+	var sum, sumSq float64
+	for i := 0; i < n; i++ {
+		x := draw()
+		sum += x
+		sumSq += x * x
+	}
+	mean := sum / float64(n)
+	return mean, sumSq/float64(n) - mean*mean
+}
+
+func within(t *testing.T, name string, got, want, tolerance float64) {
+	t.Helper()
+	if math.Abs(got-want) > tolerance*want {
+		t.Errorf("%s = %.5f, want %.5f", name, got, want)
+	}
+}
+
+func TestGammaMoments(t *testing.T) {
+	// Gamma(k, 1) has mean k and variance k, shapes below one take the
+	// boosted path
+	for _, shape := range []float64{0.3, 1, 2.5, 40} {
+		sampler := NewSeededSampler(11)
+		mean, variance := moments(draws, func() float64 { return sampler.Gamma(shape) })
+		within(t, "gamma mean", mean, shape, 0.02)
+		within(t, "gamma variance", variance, shape, 0.05)
+	}
+}
+
+func TestBetaMoments(t *testing.T) {
+	for _, p := range []struct{ alpha, beta float64 }{{1, 1}, {0.5, 0.5}, {2, 8}, {30, 70}} {
+		sampler := NewSeededSampler(13)
+		mean, variance := moments(draws, func() float64 { return sampler.Beta(p.alpha, p.beta) })
+
+		sum := p.alpha + p.beta
+		within(t, "beta mean", mean, p.alpha/sum, 0.02)
+		within(t, "beta variance", variance, p.alpha*p.beta/(sum*sum*(sum+1)), 0.05)
+	}
+}
+
+func TestSeededSamplerRepeats(t *testing.T) {
+	first, second := NewSeededSampler(5), NewSeededSampler(5)
+	for i := 0; i < 100; i++ {
+		if a, b := first.Beta(2, 3), second.Beta(2, 3); a != b {
+			t.Fatalf("draw %d: %v != %v with the same seed", i, a, b)
+		}
+	}
+}
+
+func TestGammaInvalidShape(t *testing.T) {
+	sampler := NewSeededSampler(1)
+	if x := sampler.Gamma(0); x != 0 {
+		t.Errorf("Gamma(0) = %v, want 0", x)
+	}
+	if x := sampler.Gamma(-1); x != 0 {
+		t.Errorf("Gamma(-1) = %v, want 0", x)
+	}
+}
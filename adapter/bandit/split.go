@@ -0,0 +1,119 @@
+package bandit
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+func init() {
+	Register("weighted", func(params json.RawMessage) (Strategy, error) {
+		var p struct {
+			Seed int64 `json:"seed"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, fmt.Errorf("invalid weighted params: %v", err)
+			}
+		}
+
+		return &WeightedSplit{Sampler: NewSeededSampler(p.Seed)}, nil
+	})
+	Register("hash-bucket", func(json.RawMessage) (Strategy, error) {
+		return &HashBucketSplit{Fallback: &WeightedSplit{Sampler: NewSampler(nil)}}, nil
+	})
+}
+
+// TotalWeight is the sum the weights of a split must add up to
+const TotalWeight = 100
+
+// SplitStrategy is implemented by the fixed-weight strategies. They ignore
+// the conversion stats and serve every variant according to its Weight.
+type SplitStrategy interface {
+	Strategy
+	Validate(variants []VariantStats) error
+}
+
+// KeyedStrategy is implemented by strategies that can pick a variant
+// deterministically from a key such as a visitor ID
+type KeyedStrategy interface {
+	SelectKey(key string, variants []VariantStats) string
+}
+
+// ValidateWeights checks that every weight is positive or zero and that the
+// weights sum to TotalWeight
+func ValidateWeights(variants []VariantStats) error {
+	sum := 0
+	for _, v := range variants {
+		if v.Weight < 0 {
+			return fmt.Errorf("variant %s has a negative weight", v.VariantID)
+		}
+		sum += v.Weight
+	}
+	if sum != TotalWeight {
+		return fmt.Errorf("variant weights sum to %d instead of %d", sum, TotalWeight)
+	}
+
+	return nil
+}
+
+// WeightedSplit serves a random variant with a probability proportional to
+// its weight
+type WeightedSplit struct {
+	Sampler *Sampler
+}
+
+func (s *WeightedSplit) Validate(variants []VariantStats) error {
+	return ValidateWeights(variants)
+}
+
+func (s *WeightedSplit) Select(variants []VariantStats) string {
+	return pickBucket(variants, s.Sampler.Intn(TotalWeight))
+}
+
+// HashBucketSplit assigns a key to a fixed bucket so the same key always
+// gets the same variant while the weights don't change. Without a key it
+// behaves like Fallback.
+type HashBucketSplit struct {
+	Fallback Strategy
+}
+
+func (s *HashBucketSplit) Validate(variants []VariantStats) error {
+	return ValidateWeights(variants)
+}
+
+func (s *HashBucketSplit) Select(variants []VariantStats) string {
+	return s.Fallback.Select(variants)
+}
+
+func (s *HashBucketSplit) SelectKey(key string, variants []VariantStats) string {
+	if key == "" {
+		return s.Select(variants)
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	bucket := binary.BigEndian.Uint64(hash[:8]) % TotalWeight
+
+	return pickBucket(variants, int(bucket))
+}
+
+// pickBucket returns the variant whose cumulative weight range holds bucket.
+// The ranges follow the variant IDs, not the order the variants were read
+// in, so a bucket keeps its variant however the storage returns them.
+func pickBucket(variants []VariantStats, bucket int) string {
+	sorted := make([]VariantStats, len(variants))
+	copy(sorted, variants)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].VariantID < sorted[j].VariantID })
+
+	cumulative := 0
+	for _, v := range sorted {
+		cumulative += v.Weight
+		if bucket < cumulative {
+			return v.VariantID
+		}
+	}
+
+	return ""
+}
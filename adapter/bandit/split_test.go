@@ -0,0 +1,91 @@
+package bandit
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestValidateWeights(t *testing.T) {
+	cases := []struct {
+		name    string
+		weights []int
+		fails   bool
+	}{
+		{name: "even", weights: []int{50, 50}},
+		{name: "single", weights: []int{100}},
+		{name: "zero weight", weights: []int{70, 30, 0}},
+		{name: "short", weights: []int{50, 40}, fails: true},
+		{name: "over", weights: []int{60, 50}, fails: true},
+		{name: "negative", weights: []int{110, -10}, fails: true},
+		{name: "empty", fails: true},
+	}
+
+	for _, c := range cases {
+		var variants []VariantStats
+		for i, weight := range c.weights {
+			variants = append(variants, VariantStats{VariantID: fmt.Sprintf("v_%d", i), Weight: weight})
+		}
+		if err := ValidateWeights(variants); (err != nil) != c.fails {
+			t.Errorf("%s: error %v", c.name, err)
+		}
+	}
+}
+
+func TestWeightedSplitProportions(t *testing.T) {
+	variants := []VariantStats{
+		{VariantID: "c", Weight: 10},
+		{VariantID: "a", Weight: 60},
+		{VariantID: "b", Weight: 30},
+	}
+
+	for _, seed := range []int64{1, 7, 42} {
+		split := &WeightedSplit{Sampler: NewSeededSampler(seed)}
+		served := make(map[string]int)
+		for i := 0; i < 20000; i++ {
+			served[split.Select(variants)]++
+		}
+
+		for _, v := range variants {
+			share := float64(served[v.VariantID]) / 20000 * TotalWeight
+			if share < float64(v.Weight)-2 || share > float64(v.Weight)+2 {
+				t.Errorf("seed %d: %s served %.1f%%, weight %d", seed, v.VariantID, share, v.Weight)
+			}
+		}
+	}
+}
+
+func TestHashBucketStability(t *testing.T) {
+	split := &HashBucketSplit{Fallback: &WeightedSplit{Sampler: NewSeededSampler(1)}}
+	variants := []VariantStats{
+		{VariantID: "a", Weight: 50},
+		{VariantID: "b", Weight: 50},
+	}
+	reordered := []VariantStats{variants[1], variants[0]}
+	// c takes its share from b, the variant before it keeps its buckets
+	added := []VariantStats{
+		{VariantID: "c", Weight: 20},
+		{VariantID: "b", Weight: 30},
+		{VariantID: "a", Weight: 50},
+	}
+
+	served := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		visitor := fmt.Sprintf("visitor-%d", i)
+		v := split.SelectKey(visitor, variants)
+		served[v]++
+
+		if again := split.SelectKey(visitor, variants); again != v {
+			t.Fatalf("%s got %s then %s", visitor, v, again)
+		}
+		if other := split.SelectKey(visitor, reordered); other != v {
+			t.Fatalf("%s got %s, and %s with the variants reordered", visitor, v, other)
+		}
+		if other := split.SelectKey(visitor, added); v == "a" && other != "a" {
+			t.Fatalf("%s moved from a to %s when c was added", visitor, other)
+		}
+	}
+
+	if served["a"] < 800 || served["b"] < 800 {
+		t.Errorf("buckets split the visitors %v", served)
+	}
+}
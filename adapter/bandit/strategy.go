@@ -0,0 +1,75 @@
+package bandit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// VariantStats is the aggregated outcome of a single variant used by a
+// Strategy to choose the next variant to serve
+type VariantStats struct {
+	VariantID  string
+	Impression int
+	Success    int
+	// Weight is the share of traffic out of TotalWeight, only used by the
+	// fixed split strategies
+	Weight int
+}
+
+// Strategy chooses the variant to serve from the current variant stats
+type Strategy interface {
+	Select(variants []VariantStats) string
+}
+
+// Factory builds a Strategy from the raw params stored on the experiment
+type Factory func(params json.RawMessage) (Strategy, error)
+
+// DefaultStrategy is used when an experiment doesn't name an algorithm
+const DefaultStrategy = "mab"
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a strategy available by name. Registering the same name
+// twice replaces the previous factory.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry[name] = factory
+}
+
+// New returns the strategy registered under name, or the default strategy
+// when name is empty
+func New(name string, params json.RawMessage) (Strategy, error) {
+	if name == "" {
+		name = DefaultStrategy
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown bandit strategy: %s", name)
+	}
+
+	return factory(params)
+}
+
+// Names returns the registered strategy names in sorted order
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,114 @@
+package bandit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+func init() {
+	Register("ucb1", func(json.RawMessage) (Strategy, error) { return UCB{Index: ucb1Index}, nil })
+	Register("ucb-tuned", func(json.RawMessage) (Strategy, error) { return UCB{Index: ucbTunedIndex}, nil })
+	Register("kl-ucb", func(params json.RawMessage) (Strategy, error) {
+		var p struct {
+			C float64 `json:"c"`
+		}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, fmt.Errorf("invalid kl-ucb params: %v", err)
+			}
+		}
+		if p.C < 0 {
+			return nil, errors.New("kl-ucb param c must not be negative")
+		}
+
+		return UCB{Index: klUCBIndex(p.C)}, nil
+	})
+}
+
+// UCB serves the variant with the highest upper confidence bound. It never
+// draws random numbers so the same stats always yield the same variant,
+// ties go to the variant listed first.
+type UCB struct {
+	// Index returns the upper bound of a variant with the given mean reward
+	// and impressions, after total impressions over all variants
+	Index func(mean float64, impression, total int) float64
+}
+
+func (u UCB) Select(variants []VariantStats) string {
+	total := 0
+	for _, v := range variants {
+		// play every variant once before trusting the bounds
+		if v.Impression <= 0 {
+			return v.VariantID
+		}
+		total += v.Impression
+	}
+
+	var selectedVariant string
+	maxIndex := math.Inf(-1)
+	for _, v := range variants {
+		index := u.Index(meanReward(v), v.Impression, total)
+		if index > maxIndex {
+			maxIndex = index
+			selectedVariant = v.VariantID
+		}
+	}
+
+	return selectedVariant
+}
+
+func meanReward(v VariantStats) float64 {
+	mean := float64(v.Success) / float64(v.Impression)
+	return math.Max(0, math.Min(1, mean))
+}
+
+func ucb1Index(mean float64, impression, total int) float64 {
+	return mean + math.Sqrt(2*math.Log(float64(total))/float64(impression))
+}
+
+// ucbTunedIndex bounds the exploration term with the variance of the
+// Bernoulli reward, which is tighter than UCB1 for low conversion rates
+func ucbTunedIndex(mean float64, impression, total int) float64 {
+	logTotal := math.Log(float64(total))
+	n := float64(impression)
+	variance := mean*(1-mean) + math.Sqrt(2*logTotal/n)
+
+	return mean + math.Sqrt(logTotal/n*math.Min(0.25, variance))
+}
+
+// klUCBIndex returns the largest q in [mean, 1] with
+// n * KL(mean, q) <= log(t) + c*log(log(t)), found by bisection
+func klUCBIndex(c float64) func(mean float64, impression, total int) float64 {
+	return func(mean float64, impression, total int) float64 {
+		logTotal := math.Log(float64(total))
+		bound := logTotal
+		if c > 0 && logTotal > 1 {
+			bound += c * math.Log(logTotal)
+		}
+		bound /= float64(impression)
+
+		low, high := mean, 1.0
+		for i := 0; i < 32; i++ {
+			q := (low + high) / 2
+			if bernoulliKL(mean, q) > bound {
+				high = q
+			} else {
+				low = q
+			}
+		}
+
+		return low
+	}
+}
+
+// bernoulliKL is the Kullback-Leibler divergence between Bernoulli(p) and
+// Bernoulli(q)
+func bernoulliKL(p, q float64) float64 {
+	const eps = 1e-15
+	p = math.Min(math.Max(p, eps), 1-eps)
+	q = math.Min(math.Max(q, eps), 1-eps)
+
+	return p*math.Log(p/q) + (1-p)*math.Log((1-p)/(1-q))
+}
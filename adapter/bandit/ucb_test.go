@@ -0,0 +1,119 @@
+package bandit
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func ucbStrategies(t *testing.T) map[string]Strategy {
+	t.Helper()
+
+	strategies := make(map[string]Strategy)
+	for _, name := range []string{"ucb1", "ucb-tuned", "kl-ucb"} {
+		strategy, err := New(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		strategies[name] = strategy
+	}
+	return strategies
+}
+
+func TestUCBPlaysUnplayedFirst(t *testing.T) {
+	variants := []VariantStats{
+		{VariantID: "a", Impression: 100, Success: 90},
+		{VariantID: "b"},
+		{VariantID: "c"},
+	}
+
+	for name, strategy := range ucbStrategies(t) {
+		if v := strategy.Select(variants); v != "b" {
+			t.Errorf("%s served %s, want the first unplayed variant", name, v)
+		}
+	}
+}
+
+func TestUCBTiesGoToFirstVariant(t *testing.T) {
+	variants := []VariantStats{
+		{VariantID: "b", Impression: 50, Success: 5},
+		{VariantID: "a", Impression: 50, Success: 5},
+		{VariantID: "c", Impression: 50, Success: 5},
+	}
+
+	for name, strategy := range ucbStrategies(t) {
+		if v := strategy.Select(variants); v != "b" {
+			t.Errorf("%s served %s, want the first listed variant", name, v)
+		}
+	}
+}
+
+func TestUCBExploresUnderPlayedVariant(t *testing.T) {
+	// b converts slightly worse but has barely been tried
+	variants := []VariantStats{
+		{VariantID: "a", Impression: 5000, Success: 500},
+		{VariantID: "b", Impression: 10, Success: 0},
+	}
+
+	for name, strategy := range ucbStrategies(t) {
+		if v := strategy.Select(variants); v != "b" {
+			t.Errorf("%s served %s, want the under played variant", name, v)
+		}
+	}
+}
+
+func TestUCBIndexValues(t *testing.T) {
+	cases := []struct {
+		name              string
+		index             func(mean float64, impression, total int) float64
+		mean              float64
+		impression, total int
+		want              float64
+	}{
+		{"ucb1", ucb1Index, 0.1, 10, 100, 1.0597051824376162},
+		// the variance term is capped at 1/4 for few impressions
+		{"ucb-tuned capped", ucbTunedIndex, 0.1, 10, 100, 0.4393070212207556},
+		{"ucb-tuned", ucbTunedIndex, 0.05, 1000, 10000, 0.0910797325951213},
+		// with a zero mean n*KL(0, q) = -n*log(1-q) has a closed form
+		{"kl-ucb", klUCBIndex(0), 0, 10, 100, 1 - math.Exp(-math.Log(100)/10)},
+		{"kl-ucb c=3", klUCBIndex(3), 0, 10, 100, 1 - math.Exp(-(math.Log(100)+3*math.Log(math.Log(100)))/10)},
+		{"kl-ucb certain", klUCBIndex(0), 1, 10, 100, 1},
+	}
+
+	for _, c := range cases {
+		if got := c.index(c.mean, c.impression, c.total); math.Abs(got-c.want) > 1e-6 {
+			t.Errorf("%s: index %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestKLUCBBisectionBounds(t *testing.T) {
+	for _, mean := range []float64{0, 0.01, 0.2, 0.5, 0.9, 0.999} {
+		for _, impression := range []int{1, 10, 1000} {
+			total := impression * 20
+			q := klUCBIndex(0)(mean, impression, total)
+			if q < mean || q > 1 {
+				t.Errorf("mean %v n %d: index %v outside [mean, 1]", mean, impression, q)
+				continue
+			}
+
+			// the bisection keeps the largest q within the bound
+			bound := math.Log(float64(total)) / float64(impression)
+			if kl := bernoulliKL(mean, q); kl > bound+1e-9 {
+				t.Errorf("mean %v n %d: KL %v above the bound %v", mean, impression, kl, bound)
+			}
+			if q < 1-1e-6 && bernoulliKL(mean, q+1e-6) <= bound {
+				t.Errorf("mean %v n %d: index %v is not the largest q within the bound", mean, impression, q)
+			}
+		}
+	}
+}
+
+func TestKLUCBParams(t *testing.T) {
+	for params, fails := range map[string]bool{"": false, `{"c":3}`: false, `{"c":-1}`: true, `{"c":"3"}`: true} {
+		_, err := New("kl-ucb", json.RawMessage(params))
+		if (err != nil) != fails {
+			t.Errorf("%q: error %v", params, err)
+		}
+	}
+}
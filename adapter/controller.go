@@ -2,30 +2,24 @@ package adapter
 
 import (
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"log"
-	"math"
-	"math/rand"
 	"net/http"
 	"reflect"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dennyaris/html-rotate/adapter/bandit"
+	"github.com/dennyaris/html-rotate/adapter/repository"
 	BuilderQuery "github.com/dennyaris/html-rotate/package"
 	"github.com/dennyaris/html-rotate/util"
 )
 
-type PageData struct {
-	PageID  string `json:"pageID"`
-	AdsName string `json:"adsName"`
-}
-
 type DataSampling struct {
 	VariantID  string
 	Success    int
@@ -39,18 +33,72 @@ type AlphaBeta struct {
 }
 
 type ReturnGetObjective struct {
-	SelectedVariant string
-	Objective       string
+	Objective string
 }
 
 type rotatorData struct {
 	SelectedVariant string `json:"selectedVariant"`
 	PageID          string `json:"pageID"`
+	// Fallback is set when the variant was picked by a fallback policy, such
+	// a response counts no impression and stores no assignment. Its events
+	// must carry the flag too so they aren't counted.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// Handler serves the rotation and tracking endpoints
+type Handler struct {
+	repository.Repositories
+	Cache util.Cache
+
+	// Impressions batches the impression writes, when nil every impression
+	// is written right away
+	Impressions *ImpressionBuffer
+
+	// Stale keeps the last page and variant history loaded for every url and
+	// experiment without expiring them, the fallback policies read it when
+	// the DB is unavailable. When nil only the control policy can be served.
+	// The page API drops the entries of the pages it changes.
+	Stale util.Cache
+
+	// loads coalesces DB queries filling the same cache entry
+	loads util.Coalescer
+
+	// noncesPurged is the unix nano time of the last postback nonce purge
+	noncesPurged atomic.Int64
+}
+
+// cache TTLs
+var (
+	PageCacheTTL       = 60 * time.Second
+	ExperimentCacheTTL = 10 * time.Second
+)
+
+// DefaultStrategy and DefaultStrategyParams are used by experiments that
+// don't name a bandit strategy
+var (
+	DefaultStrategy       = bandit.DefaultStrategy
+	DefaultStrategyParams json.RawMessage
+)
+
+// pageCacheEntry is the cached result of getPageFromDB for one url
+type pageCacheEntry struct {
+	PageID   string `json:"pageID"`
+	PageType string `json:"pageType"`
+}
+
+// experimentCacheEntry is the cached variant history aggregate of one
+// experiment
+type experimentCacheEntry struct {
+	History []BuilderQuery.VariantHistory `json:"history"`
 }
 
-var newDat PageData
+// strategyCacheEntry is the cached strategy config of one experiment
+type strategyCacheEntry struct {
+	Strategy       string `json:"strategy"`
+	StrategyParams string `json:"strategyParams"`
+}
 
-func RotateHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
+func (h *Handler) RotateHandler(w http.ResponseWriter, r *http.Request) error {
 	url := strings.TrimSpace(r.URL.Query().Get("url"))
 	adsName := strings.TrimSpace(r.URL.Query().Get("ads"))
 
@@ -63,173 +111,185 @@ func RotateHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
 		return nil
 	}
 
-	value, err := util.GetMemcachedValue("page_db_stat")
-	if err != nil {
-		log.Printf("error getting memcached : %v\n", err)
-	}
+	visitor, newVisitor := visitorID(w, r)
 
-	pageType, pageID, err := getPageFromDB(db, url)
+	pageType, pageID, err := h.cachedPage(url)
 	if err != nil {
-		log.Printf("error getting page : %v", err)
-		return err
-	}
-
-	if value == nil {
-		newVal := PageData{
-			PageID:  pageID,
-			AdsName: adsName,
-		}
-
-		jsonData, err := json.Marshal(newVal)
-		if err != nil {
-			log.Printf("error json : %v", err)
+		var ok bool
+		if pageType, pageID, ok = h.stalePage(url, err); !ok {
 			return err
 		}
-		if err = util.SetMemcachedValue("page_db_stat", jsonData, 60); err != nil {
-			log.Printf("error set memcached : %v", err)
-			return err
-		}
-	} else {
-		err := json.Unmarshal(value, &newDat)
-		if err != nil {
-			log.Printf("error unmarshal : %v", err)
-			return err
-		}
-
-		log.Printf("value from memcache : %v", string(value))
-		pageID = newDat.PageID
-		adsName = newDat.AdsName
 	}
 
 	if pageType == "rotator" {
-		selectedVariant, err := rotatorGetPage(db, pageID, adsName)
+		data := rotatorData{PageID: pageID}
+		data.SelectedVariant, err = h.rotatorGetPage(pageID, adsName, visitor, newVisitor)
 		if err != nil {
-			log.Printf("Error getting rotator page : %v", err)
-			return err
+			policy, variantID, ok := h.fallbackVariant(pageID, adsName, err)
+			if !ok {
+				return err
+			}
+
+			log.Printf("serving %s fallback for %s : %v", policy, pageID, err)
+			w.Header().Set(FallbackHeader, policy)
+			data.SelectedVariant, data.Fallback = variantID, true
 		}
 
-		util.ResponseSuccess(w, rotatorData{
-			SelectedVariant: selectedVariant,
-			PageID:          pageID,
-		}, "")
+		util.ResponseSuccess(w, data, "")
 	}
 
 	return nil
 }
 
-func getPageFromDB(db *sql.DB, url string) (string, string, error) {
-	var pageType, pageID string
-	var isRotator int
-
-	pageQuery := "SELECT page_id, is_rotator FROM page WHERE url_key = UNHEX(?) LIMIT 1"
-	rows, err := db.Query(pageQuery, fmt.Sprintf("%x", sha256.Sum256([]byte(url))))
+// cachedPage returns the page type and id of url, the cache is keyed by the
+// hashed url so different urls never share an entry. Concurrent misses of
+// the same url share one DB query.
+func (h *Handler) cachedPage(url string) (string, string, error) {
+	value, err := h.loads.GetOrLoad(h.Cache, util.PageCacheKey(url), PageCacheTTL, func() ([]byte, error) {
+		pageType, pageID, err := findPage(h.Pages, url)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(pageCacheEntry{PageID: pageID, PageType: pageType})
+	})
 	if err != nil {
 		return "", "", err
 	}
-	defer rows.Close()
 
-	if !rows.Next() {
-		return "", "", errors.New("no page found for the given url")
+	var entry pageCacheEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		log.Printf("error unmarshal : %v", err)
+		h.Cache.Delete(util.PageCacheKey(url))
+		return findPage(h.Pages, url)
+	}
+
+	h.keepStale(util.PageCacheKey(url), value)
+	return entry.PageType, entry.PageID, nil
+}
+
+// cachedVariantHistory returns the variant history aggregate of an
+// experiment, the cache is keyed by the experiment key. Concurrent misses of
+// the same experiment share one aggregate query.
+func (h *Handler) cachedVariantHistory(experimentKeyHex string) ([]BuilderQuery.VariantHistory, error) {
+	value, err := h.loads.GetOrLoad(h.Cache, util.ExperimentCacheKey(experimentKeyHex), ExperimentCacheTTL, func() ([]byte, error) {
+		vh, err := h.History.Stats(experimentKeyHex)
+		if err != nil || vh == nil {
+			// don't cache a missing experiment, it is created on the next call
+			return nil, err
+		}
+		return json.Marshal(experimentCacheEntry{History: vh})
+	})
+	if err != nil || value == nil {
+		return nil, err
 	}
 
-	err = rows.Scan(&pageID, &isRotator)
+	var entry experimentCacheEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		log.Printf("error unmarshal : %v", err)
+		h.Cache.Delete(util.ExperimentCacheKey(experimentKeyHex))
+		return h.History.Stats(experimentKeyHex)
+	}
+
+	h.keepStale(util.ExperimentCacheKey(experimentKeyHex), value)
+	return entry.History, nil
+}
+
+// findPage returns the page type and id of url
+func findPage(pages repository.PageRepository, url string) (string, string, error) {
+	page, err := pages.FindByUrlKey(fmt.Sprintf("%x", sha256.Sum256([]byte(url))))
+	if errors.Is(err, repository.ErrNotFound) {
+		return "", "", ErrPageNotFound
+	}
 	if err != nil {
-		return "", "", err
+		return "", "", storageError(err)
 	}
 
-	if isRotator == 1 {
+	pageType := "page"
+	if page.IsRotator == 1 {
 		pageType = "rotator"
-	} else {
-		pageType = "page"
 	}
 
-	return pageType, pageID, nil
+	return pageType, page.PageID, nil
 }
 
-func rotatorGetPage(db *sql.DB, rotatorID, adsName string) (string, error) {
-	experimentID := strings.ReplaceAll(rotatorID, "r_", "e_") + "_" + adsName
-
-	crc := crc32.ChecksumIEEE([]byte(experimentID))
-	tableID := strconv.FormatUint(uint64(crc), 10)[:2]
-	println(tableID)
+// rotatorGetPage serves a variant of the rotator's experiment for the ads,
+// a visitor issued its id by this request has no assignment to look up
+func (h *Handler) rotatorGetPage(rotatorID, adsName, visitor string, newVisitor bool) (string, error) {
+	experimentID := experimentIDFor(rotatorID, adsName)
 
 	variantId := ""
-	tableName := "z_rotator_variant_history_" + tableID
 
 	hash := sha256.Sum256([]byte(experimentID))
 	hashedString := hex.EncodeToString(hash[:])
 
-	vh, err := BuilderQuery.GetVariantHistoryByExperimentKey(db, tableName, hashedString)
+	tableName, err := h.historyTable(experimentID, hashedString)
+	if err != nil {
+		return "", storageError(err)
+	}
+
+	vh, err := h.cachedVariantHistory(hashedString)
 	if err != nil {
-		log.Fatal(err)
+		return "", storageError(err)
 	}
 
 	if vh == nil {
-		addExperiment(db, rotatorID, adsName)
-		vh, err = BuilderQuery.GetVariantHistoryByExperimentKey(db, tableName, hashedString)
+		if _, err := addExperiment(h.Repositories, tableName, rotatorID, adsName); err != nil {
+			return "", storageError(err)
+		}
+		vh, err = h.cachedVariantHistory(hashedString)
 		if err != nil {
-			log.Fatal(err)
+			return "", storageError(err)
 		}
 	}
+	if len(vh) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrNoVariants, experimentID)
+	}
 
-	objective := getObjective(vh)
-	if objective.SelectedVariant != "" {
-		variantId = objective.SelectedVariant
-	} else {
-		data := make(map[string]map[string]int)
-		total_reward := make(map[string]int)
-		arm_count := make(map[string]int)
-		for _, history := range vh {
-
-			v := reflect.ValueOf(history)
-
-			success_value := v.FieldByName(objective.Objective)
-			success_value_int := int(success_value.Uint())
-
-			data[history.VariantID] = map[string]int{
-				"success":    int(success_value.Uint()), // Assuming Purchase field represents success
-				"fail":       int(history.Impression) - success_value_int,
-				"impression": int(history.Impression),
+	if !newVisitor {
+		variantId, err = h.stickyVariant(hashedString, visitor)
+		if err != nil {
+			return "", storageError(err)
+		}
+		if variantId != "" && !hasVariant(vh, variantId) {
+			// the assigned variant was removed from the rotator
+			if err := h.clearStickyVariant(hashedString, visitor); err != nil {
+				return "", storageError(err)
 			}
-
-			total_reward[history.VariantID] = success_value_int
-			arm_count[history.VariantID] = int(history.Impression)
+			variantId = ""
 		}
+	}
 
-		threshold := calculateThreshold(total_reward, arm_count, 0.95)
-		variantId = mabExploit(data)
+	if variantId == "" {
+		variantId, err = h.selectVariant(vh, hashedString, experimentID, visitor)
+		if err != nil {
+			return "", err
+		}
+		if variantId == "" {
+			return "", fmt.Errorf("%w: %s", ErrNoVariants, experimentID)
+		}
 
-		if threshold[variantId] <= 0.01 {
-			useMAB := randomBoolWithWeight(0.9)
-			if !useMAB {
-				variantId = bernoulliThompsonSampling(data)
-			}
-		} else {
-			variantId = bernoulliThompsonSampling(data)
+		variantId, err = h.saveStickyVariant(hashedString, visitor, variantId)
+		if err != nil {
+			return "", storageError(err)
 		}
 	}
 
 	// Get the current date in "Y-m-d" format
 	tanggal := time.Now().Format("2006-01-02")
 
-	// Prepare the SQL statement
-	query := "INSERT INTO " + tableName + " (tanggal, experiment_id, experiment_key, variant_id, variant_key, impression) VALUES (?, ?, UNHEX(?), ?, UNHEX(?), ?) ON DUPLICATE KEY UPDATE impression = impression + 1"
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		panic(err.Error())
-	}
-	defer stmt.Close()
-
-	exp_hash := sha256.Sum256([]byte(experimentID))
-	exp_hashedString := hex.EncodeToString(exp_hash[:])
-
-	variant_hash := sha256.Sum256([]byte(variantId))
-	variant_hashedString := hex.EncodeToString(variant_hash[:])
+	if h.Impressions != nil {
+		h.Impressions.Add(tableName, tanggal, experimentID, variantId)
+	} else {
+		exp_hash := sha256.Sum256([]byte(experimentID))
+		variant_hash := sha256.Sum256([]byte(variantId))
 
-	// Execute the SQL statement
-	_, err = stmt.Exec(tanggal, experimentID, exp_hashedString, variantId, variant_hashedString, 1)
-	if err != nil {
-		panic(err.Error())
+		err = h.History.Increment(tableName, "impression", tanggal,
+			experimentID, hex.EncodeToString(exp_hash[:]), variantId, hex.EncodeToString(variant_hash[:]), 1)
+		if err != nil {
+			// the visitor is assigned this variant, a fallback would serve
+			// another one on this visit only
+			log.Printf("error counting impression of %s : %v", variantId, err)
+		}
 	}
 
 	// for _, result := range results {
@@ -245,97 +305,88 @@ func rotatorGetPage(db *sql.DB, rotatorID, adsName string) (string, error) {
 	return variantId, nil
 }
 
-func randomBoolWithWeight(weightTrue float64) bool {
-	r := rand.Float64()
-	return r < weightTrue
+// experimentIDFor returns the id of the experiment of a rotator for one ads
+func experimentIDFor(rotatorID, adsName string) string {
+	return strings.ReplaceAll(rotatorID, "r_", "e_") + "_" + adsName
 }
 
-// Function to exploit the Multi-Armed Bandit (MAB) algorithm
-func mabExploit(data map[string]map[string]int) string {
-	rate := make(map[string]float64)
-
-	for key, value := range data {
-		rate[key] = float64(value["success"]) / float64(value["impression"])
-	}
-
-	var maxValue float64
-	var selectedVariant string
-
-	for key, value := range rate {
-		if value > maxValue {
-			maxValue = value
-			selectedVariant = key
-		}
-	}
+// variantIDFor returns the id of the variant serving pageID in an experiment
+func variantIDFor(experimentID, pageID string) string {
+	pageIDParts := strings.Split(pageID, "_")
+	pageID = pageIDParts[len(pageIDParts)-1]
 
-	return selectedVariant
+	return strings.ReplaceAll(experimentID, "e_", "v_") + "_" + strings.ReplaceAll(pageID, "p_", "")
 }
 
-func addExperiment(db *sql.DB, rotatorID, adsName string) (string, error) {
-	experimentID := strings.ReplaceAll(rotatorID, "r_", "e_") + "_" + adsName
+func addExperiment(repos repository.Repositories, tableName, rotatorID, adsName string) (string, error) {
+	experimentID := experimentIDFor(rotatorID, adsName)
 
 	exp_hash := sha256.Sum256([]byte(experimentID))
 	exp_hashedString := hex.EncodeToString(exp_hash[:])
-	rotator_hash := sha256.Sum256([]byte(experimentID))
+	rotator_hash := sha256.Sum256([]byte(rotatorID))
 	rotator_hashedString := hex.EncodeToString(rotator_hash[:])
 
-	// Data to be inserted
-	dataExperiment := map[string]string{
-		"experiment_id":  experimentID,
-		"experiment_key": exp_hashedString,
-		"rotator_id":     rotatorID,
-		"rotator_key":    rotator_hashedString,
-		"ads_name":       adsName,
-	}
-
-	successful, err := BuilderQuery.InsertIntoTable(db, "z_rotator_experiment", dataExperiment)
+	successful, err := repos.Experiments.Create(BuilderQuery.Experiment{
+		ExperimentID:  experimentID,
+		ExperimentKey: exp_hashedString,
+		RotatorID:     rotatorID,
+		RotatorKey:    rotator_hashedString,
+		AdsName:       adsName,
+	})
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	if !successful {
+	if successful {
 		///////////////////////// get all pages attach to this rotator add to variant and variant history ///////////
-		rotator, err := BuilderQuery.GetPagesByRotatorKey(db, rotator_hashedString)
+		rotator, err := repos.Experiments.RotatorPages(rotator_hashedString)
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 
 		for _, page := range rotator {
-			AddVariant(db, experimentID, page.PageID)
-			AddVariantHistory(db, experimentID, page.PageID, "")
+			if _, err := AddVariant(repos, experimentID, page.PageID); err != nil {
+				return "", err
+			}
+			if _, err := AddVariantHistory(repos.History, tableName, experimentID, page.PageID, ""); err != nil {
+				return "", err
+			}
 		}
 	} else {
-		row, err := BuilderQuery.SelectFromZRotatorExperiment(db, exp_hashedString)
+		// another request created it first and adds the variants
+		row, err := repos.Experiments.Get(exp_hashedString)
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
-
-		AddVariant(db, experimentID, rotatorID)
-		AddVariantHistory(db, experimentID, rotatorID, "")
 		experimentID = row.ExperimentID
 	}
 
-	return experimentID, err
+	return experimentID, nil
 }
 
-func AddVariant(db *sql.DB, experimentID, pageID string) (string, error) {
+func AddVariant(repos repository.Repositories, experimentID, pageID string) (string, error) {
 	pageIDParts := strings.Split(pageID, "_")
 	pageID = pageIDParts[len(pageIDParts)-1]
 
-	variantID := strings.ReplaceAll(experimentID, "e_", "v_") + "_" + strings.ReplaceAll(pageID, "p_", "")
+	variantID := variantIDFor(experimentID, pageID)
 
-	query := "INSERT IGNORE INTO z_rotator_variant (variant_id, variant_key, experiment_id, experiment_key, page_id, page_key) VALUES (?, UNHEX(?), ?, UNHEX(?), ?, UNHEX(?))"
 	variantKey := fmt.Sprintf("%x", sha256.Sum256([]byte(variantID)))
 
-	_, err := db.Exec(query, variantID, variantKey, experimentID, fmt.Sprintf("%x", sha256.Sum256([]byte(experimentID))), pageID, fmt.Sprintf("%x", sha256.Sum256([]byte(pageID))))
+	experimentKey := fmt.Sprintf("%x", sha256.Sum256([]byte(experimentID)))
+
+	err := repos.Variants.Create(variantID, variantKey, experimentID, experimentKey, pageID, fmt.Sprintf("%x", sha256.Sum256([]byte(pageID))))
 	if err != nil {
 		return "", err
 	}
 
+	if err := repos.History.CreateStats(experimentID, experimentKey, variantID, variantKey); err != nil {
+		return "", err
+	}
+
 	return variantID, nil
 }
 
-func AddVariantHistory(db *sql.DB, experimentID, pageID string, tanggal string) (string, error) {
+func AddVariantHistory(history repository.HistoryRepository, tableName, experimentID, pageID string, tanggal string) (string, error) {
 	var tanggalStr string
 	if len(tanggal) == 0 {
 		tanggalStr = time.Now().Format("2006-01-02")
@@ -346,16 +397,11 @@ func AddVariantHistory(db *sql.DB, experimentID, pageID string, tanggal string)
 	pageIDParts := strings.Split(pageID, "_")
 	pageID = pageIDParts[len(pageIDParts)-1]
 
-	variantID := strings.ReplaceAll(experimentID, "e_", "v_") + "_" + strings.ReplaceAll(pageID, "p_", "")
-
-	crc := crc32.ChecksumIEEE([]byte(experimentID))
-	tableID := strconv.FormatUint(uint64(crc), 10)[:2]
-
-	query := "INSERT IGNORE INTO z_rotator_variant_history_" + tableID + " (variant_id, variant_key, experiment_id, experiment_key, tanggal) VALUES (?, UNHEX(?), ?, UNHEX(?), ?)"
+	variantID := variantIDFor(experimentID, pageID)
 
 	variantKey := fmt.Sprintf("%x", sha256.Sum256([]byte(variantID)))
 
-	_, err := db.Exec(query, variantID, variantKey, experimentID, fmt.Sprintf("%x", sha256.Sum256([]byte(experimentID))), tanggalStr)
+	err := history.Create(tableName, tanggalStr, experimentID, fmt.Sprintf("%x", sha256.Sum256([]byte(experimentID))), variantID, variantKey)
 	if err != nil {
 		return "", err
 	}
@@ -363,6 +409,172 @@ func AddVariantHistory(db *sql.DB, experimentID, pageID string, tanggal string)
 	return variantID, nil
 }
 
+// experimentStrategy returns the bandit strategy configured on the experiment,
+// falling back to the default strategy for experiments without one
+func (h *Handler) experimentStrategy(experimentKeyHex string) (bandit.Strategy, error) {
+	config, err := h.cachedStrategyConfig(experimentKeyHex)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	name, params := DefaultStrategy, DefaultStrategyParams
+	if config.Strategy != "" {
+		name, params = config.Strategy, nil
+		if config.StrategyParams != "" {
+			params = json.RawMessage(config.StrategyParams)
+		}
+	}
+
+	key := strategyKey{ExperimentKey: strings.ToLower(experimentKeyHex), Name: name, Params: string(params)}
+	if strategy, ok := strategies.Load(key); ok {
+		return strategy.(bandit.Strategy), nil
+	}
+
+	strategy, err := bandit.New(name, params)
+	if err != nil {
+		return nil, configError(err)
+	}
+
+	actual, _ := strategies.LoadOrStore(key, strategy)
+	return actual.(bandit.Strategy), nil
+}
+
+// cachedStrategyConfig returns the strategy columns of an experiment, the
+// cache is keyed by the experiment key. A missing experiment has the default
+// strategy and isn't cached.
+func (h *Handler) cachedStrategyConfig(experimentKeyHex string) (strategyCacheEntry, error) {
+	var entry strategyCacheEntry
+	value, err := h.loads.GetOrLoad(h.Cache, util.StrategyCacheKey(experimentKeyHex), ExperimentCacheTTL, func() ([]byte, error) {
+		experiment, err := h.Experiments.Get(experimentKeyHex)
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(strategyCacheEntry{Strategy: experiment.Strategy, StrategyParams: experiment.StrategyParams})
+	})
+	if err != nil || value == nil {
+		return entry, err
+	}
+
+	if err := json.Unmarshal(value, &entry); err != nil {
+		log.Printf("error unmarshal : %v", err)
+		h.Cache.Delete(util.StrategyCacheKey(experimentKeyHex))
+		return strategyCacheEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// strategies keeps the strategy built for every experiment and config, a
+// seeded sampler then keeps advancing its sequence across requests instead
+// of making the same draws on every request
+var strategies sync.Map
+
+type strategyKey struct {
+	ExperimentKey string
+	Name          string
+	Params        string
+}
+
+// selectVariant picks a new variant for the visitor with the experiment's
+// strategy
+func (h *Handler) selectVariant(vh []BuilderQuery.VariantHistory, experimentKeyHex, experimentID, visitor string) (string, error) {
+	strategy, err := h.experimentStrategy(experimentKeyHex)
+	if err != nil {
+		return "", err
+	}
+
+	if split, ok := strategy.(bandit.SplitStrategy); ok {
+		return h.splitSelect(split, vh, experimentKeyHex, experimentID, visitor)
+	}
+
+	// variants without a success are left to the strategy, Thompson samples
+	// them from the prior and UCB plays the unplayed ones first
+	objective := getObjective(vh)
+	return strategy.Select(objectiveStats(vh, objective.Objective)), nil
+}
+
+// objectiveStats returns the bandit stats of every variant, counting the
+// objective column as the success
+func objectiveStats(vh []BuilderQuery.VariantHistory, objective string) []bandit.VariantStats {
+	variants := make([]bandit.VariantStats, 0, len(vh))
+	for _, history := range vh {
+		v := reflect.ValueOf(history)
+		success_value := v.FieldByName(objective)
+
+		variants = append(variants, bandit.VariantStats{
+			VariantID:  history.VariantID,
+			Impression: int(history.Impression),
+			Success:    int(success_value.Uint()),
+		})
+	}
+
+	return variants
+}
+
+func hasVariant(vh []BuilderQuery.VariantHistory, variantID string) bool {
+	for _, history := range vh {
+		if history.VariantID == variantID {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSelect picks a variant with a fixed-weight split, the weights are read
+// from z_rotator_variant. Keyed splits bucket known visitors per experiment.
+func (h *Handler) splitSelect(split bandit.SplitStrategy, vh []BuilderQuery.VariantHistory, experimentKeyHex, experimentID, visitor string) (string, error) {
+	weights, err := h.cachedWeights(experimentKeyHex)
+	if err != nil {
+		return "", storageError(err)
+	}
+
+	variants := make([]bandit.VariantStats, 0, len(vh))
+	for _, history := range vh {
+		variants = append(variants, bandit.VariantStats{
+			VariantID:  history.VariantID,
+			Impression: int(history.Impression),
+			Weight:     weights[history.VariantID],
+		})
+	}
+
+	if err := split.Validate(variants); err != nil {
+		return "", configError(fmt.Errorf("invalid split for experiment %s: %v", experimentKeyHex, err))
+	}
+
+	if keyed, ok := split.(bandit.KeyedStrategy); ok && visitor != "" {
+		return keyed.SelectKey(experimentID+":"+visitor, variants), nil
+	}
+
+	return split.Select(variants), nil
+}
+
+// cachedWeights returns the traffic weight of every variant of an
+// experiment, the cache is keyed by the experiment key
+func (h *Handler) cachedWeights(experimentKeyHex string) (map[string]int, error) {
+	value, err := h.loads.GetOrLoad(h.Cache, util.WeightsCacheKey(experimentKeyHex), ExperimentCacheTTL, func() ([]byte, error) {
+		weights, err := h.Variants.Weights(experimentKeyHex)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(weights)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var weights map[string]int
+	if err := json.Unmarshal(value, &weights); err != nil {
+		log.Printf("error unmarshal : %v", err)
+		h.Cache.Delete(util.WeightsCacheKey(experimentKeyHex))
+		return h.Variants.Weights(experimentKeyHex)
+	}
+
+	return weights, nil
+}
+
 func getObjective(data []BuilderQuery.VariantHistory) ReturnGetObjective {
 	objective := "CTA"
 	isLead := true
@@ -370,12 +582,7 @@ func getObjective(data []BuilderQuery.VariantHistory) ReturnGetObjective {
 	isProspek := true
 	isPurchase := true
 
-	selectedVariant := ""
-
 	for _, value := range data {
-		if value.CTA < 1 {
-			selectedVariant = value.VariantID
-		}
 		if value.Lead < 1 {
 			isLead = false
 		}
@@ -400,78 +607,5 @@ func getObjective(data []BuilderQuery.VariantHistory) ReturnGetObjective {
 		objective = "Lead"
 	}
 
-	return ReturnGetObjective{SelectedVariant: selectedVariant, Objective: objective}
-}
-
-// Function to perform Bernoulli Thompson Sampling
-func bernoulliThompsonSampling(data map[string]map[string]int) string {
-	alpha := make(map[string]float64)
-	beta := make(map[string]float64)
-
-	// Calculate alpha and beta values for each variant
-	for variantID, row := range data {
-		successSum := float64(row["Success"])                  // Convert to float64
-		failSum := float64(row["Impression"] - row["Success"]) // Convert to float64
-
-		// Update alpha and beta maps for the variant
-		alpha[variantID] += successSum
-		beta[variantID] += failSum
-	}
-
-	// Calculate sampled values using beta distribution
-	sampledValues := make(map[string]float64)
-	for variantID := range alpha {
-		// Convert alpha and beta values to int before passing to betaDistribution
-		sampledValues[variantID] = betaDistribution(int(alpha[variantID]), int(beta[variantID]))
-	}
-
-	// Find the selected variant with the maximum sampled value
-	var selectedVariant string
-	maxSampledValue := 0.0
-	for variantID, value := range sampledValues {
-		if value > maxSampledValue {
-			maxSampledValue = value
-			selectedVariant = variantID
-		}
-	}
-
-	return selectedVariant
-}
-
-// betaDistribution calculates the beta distribution value for given alpha and beta
-func betaDistribution(alpha, beta int) float64 {
-	return float64(rand.Intn(beta+1)) / float64(rand.Intn(alpha+beta+1))
-}
-
-// Function to calculate the threshold for each arm
-func calculateThreshold(totalRewards map[string]int, armCounts map[string]int, confidenceLevel float64) map[string]float64 {
-	thresholds := make(map[string]float64)
-
-	for arm, reward := range totalRewards {
-		meanReward := float64(reward) / float64(armCounts[arm])
-		standardError := math.Sqrt(meanReward * (1 - meanReward) / float64(armCounts[arm]))
-		zScore := math.Abs(statsInv(1 - (confidenceLevel / 2)))
-		marginOfError := zScore * standardError
-		thresholds[arm] = 2 * marginOfError
-	}
-
-	return thresholds
-}
-
-// Function to calculate the inverse of the standard normal cumulative distribution function
-func statsInv(p float64) float64 {
-	q := p - 0.5
-	var r float64
-
-	if math.Abs(q) <= 0.425 {
-		r = 0.180625 - q*q
-		return q * (((((((2.5090809287301226727e3*r+3.3430575583588128105e4)*r+6.7265770927008700853e4)*r+4.5921953931549871457e4)*r+1.3731693765509461125e4)*r+1.9715909503065514427e3)*r+1.3314166789178437745e2)*r + 3.3871328727963666080e0) / (((((((5.2264952788528545610e3*r+2.8729085735721942674e4)*r+3.9307895800092710610e4)*r+2.1213794301586595867e4)*r+5.3941960214247511077e3)*r+6.8718700749205790830e2)*r+4.2313330701600911252e1)*r + 1.0)
-	}
-
-	r = math.Log(-math.Log(p))
-	r = 1.570796288 + r*(0.305532033+r*(0.0000000383+r*(-0.000003298)))
-	if q < 0 {
-		return -r
-	}
-	return r
+	return ReturnGetObjective{Objective: objective}
 }
@@ -0,0 +1,214 @@
+package adapter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// seedExperiment stores an experiment with the strategy and one variant per
+// page id, weighted equally when weights is nil
+func seedExperiment(t *testing.T, memory *repository.Memory, experimentID, strategy, params string, pageIDs []string, weights []int) []BuilderQuery.VariantHistory {
+	t.Helper()
+
+	repos := memory.Repositories()
+	experimentKey := util.EncodeString(experimentID)
+	_, err := repos.Experiments.Create(BuilderQuery.Experiment{
+		ExperimentID:   experimentID,
+		ExperimentKey:  experimentKey,
+		RotatorID:      "r_test",
+		RotatorKey:     util.EncodeString("r_test"),
+		AdsName:        "ads",
+		Strategy:       strategy,
+		StrategyParams: params,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, pageID := range pageIDs {
+		variantID, err := AddVariant(repos, experimentID, pageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if weights != nil {
+			memory.SetVariantWeight(experimentKey, variantID, weights[i])
+		}
+	}
+
+	vh, err := repos.History.Stats(experimentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vh
+}
+
+func TestSeededStrategyKeepsAdvancing(t *testing.T) {
+	memory := repository.NewMemory()
+	experimentID := "e_seeded_ads"
+	vh := seedExperiment(t, memory, experimentID, "weighted", `{"seed":7}`, []string{"p_1", "p_2", "p_3"}, []int{40, 40, 20})
+	h := &Handler{Repositories: memory.Repositories(), Cache: util.NewLRU(64)}
+
+	served := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		variantID, err := h.selectVariant(vh, util.EncodeString(experimentID), experimentID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served[variantID]++
+	}
+
+	if len(served) < 2 {
+		t.Fatalf("a seeded split served only %v over 30 requests", served)
+	}
+}
+
+func TestSeededStrategyIsReproducible(t *testing.T) {
+	draws := func(experimentID string) []string {
+		memory := repository.NewMemory()
+		vh := seedExperiment(t, memory, experimentID, "weighted", `{"seed":7}`, []string{"p_1", "p_2", "p_3"}, []int{40, 40, 20})
+		h := &Handler{Repositories: memory.Repositories(), Cache: util.NewLRU(64)}
+
+		var variants []string
+		for i := 0; i < 10; i++ {
+			variantID, err := h.selectVariant(vh, util.EncodeString(experimentID), experimentID, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// variant ids embed the experiment id, compare the page part
+			variants = append(variants, variantID[len(variantID)-1:])
+		}
+		return variants
+	}
+
+	first, second := draws("e_repro1_ads"), draws("e_repro2_ads")
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("the same seed drew %v and %v", first, second)
+		}
+	}
+}
+
+func TestCachedPageIsKeyedByUrl(t *testing.T) {
+	memory := repository.NewMemory()
+	pages := []models.Page{
+		{PageID: "r_home", PageKey: "r_home", UrlKey: "https://example.com/a", Url: "https://example.com/a", IsRotator: 1, UserID: 1, SiteID: 1},
+		{PageID: "p_about", PageKey: "p_about", UrlKey: "https://example.com/b", Url: "https://example.com/b", IsRotator: 0, UserID: 1, SiteID: 1},
+	}
+	for i := range pages {
+		if err := memory.Repositories().Pages.Create(&pages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := &Handler{Repositories: memory.Repositories(), Cache: util.NewLRU(16)}
+	// twice, the second round is served from the cache
+	for round := 0; round < 2; round++ {
+		pageType, pageID, err := h.cachedPage("https://example.com/a")
+		if err != nil || pageType != "rotator" || pageID != "r_home" {
+			t.Fatalf("round %d: /a is %s %s %v", round, pageType, pageID, err)
+		}
+		pageType, pageID, err = h.cachedPage("https://example.com/b")
+		if err != nil || pageType != "page" || pageID != "p_about" {
+			t.Fatalf("round %d: /b is %s %s %v", round, pageType, pageID, err)
+		}
+		if _, _, err := h.cachedPage("https://example.com/c"); !errors.Is(err, ErrPageNotFound) {
+			t.Fatalf("round %d: an unknown url got %v", round, err)
+		}
+	}
+}
+
+// countingExperiments counts the experiment and assignment reads
+type countingExperiments struct {
+	repository.ExperimentRepository
+	gets, assignments int
+}
+
+func (c *countingExperiments) Get(experimentKeyHex string) (BuilderQuery.Experiment, error) {
+	c.gets++
+	return c.ExperimentRepository.Get(experimentKeyHex)
+}
+
+func (c *countingExperiments) Assignment(experimentKeyHex, visitorKeyHex string) (string, error) {
+	c.assignments++
+	return c.ExperimentRepository.Assignment(experimentKeyHex, visitorKeyHex)
+}
+
+// countingVariants counts the weight reads
+type countingVariants struct {
+	repository.VariantRepository
+	weights int
+}
+
+func (c *countingVariants) Weights(experimentKeyHex string) (map[string]int, error) {
+	c.weights++
+	return c.VariantRepository.Weights(experimentKeyHex)
+}
+
+func TestSelectVariantCachesStrategyAndWeights(t *testing.T) {
+	memory := repository.NewMemory()
+	experimentID := "e_cached_ads"
+	vh := seedExperiment(t, memory, experimentID, "weighted", "", []string{"p_1", "p_2"}, []int{50, 50})
+
+	repos := memory.Repositories()
+	experiments := &countingExperiments{ExperimentRepository: repos.Experiments}
+	variants := &countingVariants{VariantRepository: repos.Variants}
+	repos.Experiments, repos.Variants = experiments, variants
+	h := &Handler{Repositories: repos, Cache: util.NewLRU(64)}
+
+	for i := 0; i < 20; i++ {
+		if _, err := h.selectVariant(vh, util.EncodeString(experimentID), experimentID, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if experiments.gets != 1 || variants.weights != 1 {
+		t.Errorf("20 selections read the experiment %d and the weights %d times", experiments.gets, variants.weights)
+	}
+}
+
+func TestNewVisitorSkipsAssignmentLookup(t *testing.T) {
+	h, _ := newRotateHandler(t)
+	experiments := &countingExperiments{ExperimentRepository: h.Experiments}
+	h.Experiments = experiments
+
+	for i := 0; i < 3; i++ {
+		if _, err := rotate(t, h, "https://example.com/", "fb", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if experiments.assignments != 0 {
+		t.Errorf("visitors without an id looked up %d assignments", experiments.assignments)
+	}
+
+	if _, err := rotate(t, h, "https://example.com/", "fb", "visitor-1"); err != nil {
+		t.Fatal(err)
+	}
+	if experiments.assignments != 1 {
+		t.Errorf("a known visitor looked up %d assignments", experiments.assignments)
+	}
+}
+
+func TestSelectVariantLeavesZeroSuccessToStrategy(t *testing.T) {
+	memory := repository.NewMemory()
+	experimentID := "e_unconverted_ads"
+	vh := seedExperiment(t, memory, experimentID, "thompson", `{"seed":5}`, []string{"p_1", "p_2", "p_3"}, nil)
+	h := &Handler{Repositories: memory.Repositories(), Cache: util.NewLRU(64)}
+
+	served := make(map[string]int)
+	for i := 0; i < 60; i++ {
+		variantID, err := h.selectVariant(vh, util.EncodeString(experimentID), experimentID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served[variantID]++
+	}
+
+	// no variant has a CTA yet, the last one used to be served every time
+	if len(served) < 3 {
+		t.Errorf("thompson served %v", served)
+	}
+}
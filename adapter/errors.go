@@ -0,0 +1,68 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// Errors returned by the rotation path, WriteError maps them to HTTP statuses
+var (
+	ErrPageNotFound     = errors.New("no page found for the given url")
+	ErrNoVariants       = errors.New("no variants available for the experiment")
+	ErrExperimentConfig = errors.New("invalid experiment configuration")
+	ErrStorage          = errors.New("storage error")
+)
+
+// storageError marks err as a failure of the DB or the cache
+func storageError(err error) error {
+	if err == nil || errors.Is(err, ErrStorage) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %v", ErrStorage, err)
+}
+
+// configError marks err as a misconfigured experiment
+func configError(err error) error {
+	if err == nil || errors.Is(err, ErrExperimentConfig) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %v", ErrExperimentConfig, err)
+}
+
+// ErrorStatus returns the HTTP status matching err
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrPageNotFound), errors.Is(err, ErrNoVariants):
+		return http.StatusNotFound
+	case errors.Is(err, ErrStorage):
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+// WriteError logs err and answers with its status and a JSON body. Storage
+// and unexpected errors are answered with a generic message so DB details
+// don't leak to clients.
+func WriteError(w http.ResponseWriter, err error) {
+	status := ErrorStatus(err)
+	log.Printf("error handling request : %v", err)
+
+	message := err.Error()
+	switch {
+	case errors.Is(err, ErrStorage):
+		message = ErrStorage.Error()
+	case errors.Is(err, ErrExperimentConfig):
+		message = ErrExperimentConfig.Error()
+	case status == http.StatusInternalServerError:
+		message = http.StatusText(status)
+	}
+
+	util.ResponseError(w, message, status)
+}
@@ -0,0 +1,196 @@
+package adapter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dennyaris/html-rotate/util"
+	"github.com/go-playground/validator"
+)
+
+// Event is a conversion reported for a variant. When Variant is empty the
+// variant assigned to Visitor in the experiment is used.
+//
+// Events are counted once: by EventID when it is set, otherwise once per
+// visitor, variant and event type. Events without either are always counted.
+// Fallback is echoed from a /rotate response served by a fallback policy,
+// such an event is acknowledged but never counted.
+type Event struct {
+	EventID    string `json:"event_id"`
+	Experiment string `json:"experiment" validate:"required"`
+	Variant    string `json:"variant"`
+	EventType  string `json:"event_type" validate:"required"`
+	Visitor    string `json:"visitor"`
+	Fallback   bool   `json:"fallback"`
+}
+
+// EventDedupTTL is how long the cache remembers a counted event, the dedup
+// table keeps it after that
+var EventDedupTTL = 24 * time.Hour
+
+// eventColumns maps the accepted event types to their variant history column
+var eventColumns = map[string]string{
+	"cta":      "cta",
+	"lead":     "lead",
+	"mql":      "mql",
+	"prospek":  "prospek",
+	"purchase": "purchase",
+}
+
+var (
+	errUnknownEventType = errors.New("unknown event_type")
+	errUnknownVariant   = errors.New("variant not found in experiment")
+	errNoVariant        = errors.New("variant or a visitor with an assigned variant is required")
+	errDuplicateEvent   = errors.New("event already recorded")
+	errFallbackEvent    = errors.New("event of a fallback response")
+)
+
+func (h *Handler) EventHandler(w http.ResponseWriter, r *http.Request) error {
+	var event Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		util.ResponseError(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	if err := validator.New().Struct(event); err != nil {
+		util.ResponseError(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	if err := h.recordEvent(event); err != nil {
+		switch {
+		case errors.Is(err, errDuplicateEvent):
+			util.ResponseSuccess(w, nil, "duplicate event ignored")
+			return nil
+		case errors.Is(err, errFallbackEvent):
+			util.ResponseSuccess(w, nil, "fallback event ignored")
+			return nil
+		case errors.Is(err, errUnknownEventType), errors.Is(err, errNoVariant):
+			util.ResponseError(w, err.Error(), http.StatusBadRequest)
+			return nil
+		case errors.Is(err, errUnknownVariant):
+			util.ResponseError(w, err.Error(), http.StatusNotFound)
+			return nil
+		}
+		return err
+	}
+
+	util.ResponseSuccess(w, nil, "event recorded")
+	return nil
+}
+
+// recordEvent increments the event counter of the variant in today's row of
+// the experiment's variant history shard
+func (h *Handler) recordEvent(event Event) error {
+	column, ok := eventColumns[strings.ToLower(event.EventType)]
+	if !ok {
+		return errUnknownEventType
+	}
+	if event.Fallback {
+		// the fallback impression wasn't counted either
+		return errFallbackEvent
+	}
+
+	exp_hash := sha256.Sum256([]byte(event.Experiment))
+	exp_hashedString := hex.EncodeToString(exp_hash[:])
+
+	variantID := event.Variant
+	if variantID == "" {
+		var err error
+		variantID, err = h.stickyVariant(exp_hashedString, event.Visitor)
+		if err != nil {
+			return storageError(err)
+		}
+		if variantID == "" {
+			return errNoVariant
+		}
+	}
+
+	variant_hash := sha256.Sum256([]byte(variantID))
+	variant_hashedString := hex.EncodeToString(variant_hash[:])
+
+	exists, err := h.Variants.Exists(exp_hashedString, variant_hashedString)
+	if err != nil {
+		return storageError(err)
+	}
+	if !exists {
+		return errUnknownVariant
+	}
+
+	tableName, err := h.historyTable(event.Experiment, exp_hashedString)
+	if err != nil {
+		return storageError(err)
+	}
+
+	dedupKey := eventDedupKey(event, variantID, column)
+	if dedupKey != "" {
+		fresh, err := h.markEventSeen(dedupKey, exp_hashedString)
+		if err != nil {
+			return storageError(err)
+		}
+		if !fresh {
+			return errDuplicateEvent
+		}
+	}
+
+	tanggal := time.Now().Format("2006-01-02")
+
+	err = h.History.Increment(tableName, column, tanggal,
+		event.Experiment, exp_hashedString, variantID, variant_hashedString, 1)
+	if err != nil && dedupKey != "" {
+		// let a retry of the event be counted
+		h.unmarkEventSeen(dedupKey)
+	}
+
+	return storageError(err)
+}
+
+// eventDedupKey returns the hex key identifying the event for deduplication,
+// or an empty string when the event can't be identified
+func eventDedupKey(event Event, variantID, column string) string {
+	switch {
+	case event.EventID != "":
+		return util.EncodeString("id:" + event.Experiment + ":" + event.EventID)
+	case event.Visitor != "":
+		return util.EncodeString("visitor:" + event.Experiment + ":" + variantID + ":" + column + ":" + event.Visitor)
+	}
+
+	return ""
+}
+
+// markEventSeen records the event key and returns false when it was already
+// recorded. The cache rejects recent duplicates without touching the DB, the
+// unique dedup table is the source of truth.
+func (h *Handler) markEventSeen(dedupKey, experimentKeyHex string) (bool, error) {
+	fresh, err := h.Cache.Add("event_"+dedupKey, []byte("1"), EventDedupTTL)
+	if err != nil {
+		log.Printf("error add cache : %v", err)
+	} else if !fresh {
+		return false, nil
+	}
+
+	fresh, err = h.History.MarkEvent(dedupKey, experimentKeyHex)
+	if err != nil {
+		if err := h.Cache.Delete("event_" + dedupKey); err != nil {
+			log.Printf("error delete cache : %v", err)
+		}
+		return false, err
+	}
+
+	return fresh, nil
+}
+
+func (h *Handler) unmarkEventSeen(dedupKey string) {
+	if err := h.Cache.Delete("event_" + dedupKey); err != nil {
+		log.Printf("error delete cache : %v", err)
+	}
+	if err := h.History.UnmarkEvent(dedupKey); err != nil {
+		log.Printf("error deleting event dedup : %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package adapter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+
+	"github.com/dennyaris/html-rotate/adapter/bandit"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// Fallback policies applied when a rotation fails because the DB or the
+// cache is unavailable
+const (
+	// FallbackNone fails the request
+	FallbackNone = "none"
+	// FallbackControl serves the rotator's control page
+	FallbackControl = "control"
+	// FallbackBest serves the variant with the best success rate in the last
+	// known variant history, or a random one when none has a success yet
+	FallbackBest = "best"
+	// FallbackRandom serves a uniform pick among the last known variants
+	FallbackRandom = "random"
+)
+
+// FallbackHeader is set to the policy on responses served by a fallback
+const FallbackHeader = "X-Rotator-Fallback"
+
+// FallbackRule is the fail-open policy of a rotator. ControlPage is the page
+// id served by the control policy.
+type FallbackRule struct {
+	Policy      string
+	ControlPage string
+}
+
+// DefaultFallback applies to the rotators missing from RotatorFallbacks,
+// which is keyed by rotator id
+var (
+	DefaultFallback  = FallbackRule{Policy: FallbackNone}
+	RotatorFallbacks map[string]FallbackRule
+)
+
+func fallbackRule(rotatorID string) FallbackRule {
+	if rule, ok := RotatorFallbacks[rotatorID]; ok {
+		return rule
+	}
+
+	return DefaultFallback
+}
+
+// keepStale remembers the last value loaded for key
+func (h *Handler) keepStale(key string, value []byte) {
+	if h.Stale == nil {
+		return
+	}
+
+	if err := h.Stale.Set(key, value, 0); err != nil {
+		log.Printf("error set stale cache : %v", err)
+	}
+}
+
+// stalePage returns the last known page of url when err is a storage error
+func (h *Handler) stalePage(url string, err error) (string, string, bool) {
+	if h.Stale == nil || !errors.Is(err, ErrStorage) {
+		return "", "", false
+	}
+
+	value, err := h.Stale.Get(util.PageCacheKey(url))
+	if err != nil {
+		return "", "", false
+	}
+
+	var entry pageCacheEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return "", "", false
+	}
+
+	return entry.PageType, entry.PageID, true
+}
+
+// staleVariantHistory returns the last known variant history of an
+// experiment
+func (h *Handler) staleVariantHistory(experimentKeyHex string) []BuilderQuery.VariantHistory {
+	if h.Stale == nil {
+		return nil
+	}
+
+	value, err := h.Stale.Get(util.ExperimentCacheKey(experimentKeyHex))
+	if err != nil {
+		return nil
+	}
+
+	var entry experimentCacheEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return nil
+	}
+
+	return entry.History
+}
+
+// fallbackVariant picks the variant served when the rotation failed with
+// err, following the rotator's fallback policy. It returns the policy and
+// false when the failure isn't a storage error or the policy can't serve
+// anything.
+func (h *Handler) fallbackVariant(rotatorID, adsName string, err error) (string, string, bool) {
+	if !errors.Is(err, ErrStorage) {
+		return "", "", false
+	}
+
+	rule := fallbackRule(rotatorID)
+	experimentID := experimentIDFor(rotatorID, adsName)
+
+	switch rule.Policy {
+	case FallbackControl:
+		if rule.ControlPage == "" {
+			return rule.Policy, "", false
+		}
+		return rule.Policy, variantIDFor(experimentID, rule.ControlPage), true
+
+	case FallbackBest, FallbackRandom:
+		hash := sha256.Sum256([]byte(experimentID))
+		vh := h.staleVariantHistory(hex.EncodeToString(hash[:]))
+		if len(vh) == 0 {
+			return rule.Policy, "", false
+		}
+
+		if rule.Policy == FallbackBest {
+			objective := getObjective(vh)
+			if best := bandit.Best(objectiveStats(vh, objective.Objective)); best != "" {
+				return rule.Policy, best, true
+			}
+		}
+
+		return rule.Policy, vh[rand.Intn(len(vh))].VariantID, true
+	}
+
+	return rule.Policy, "", false
+}
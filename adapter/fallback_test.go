@@ -0,0 +1,151 @@
+package adapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+func TestFallbackEventsAreNotCounted(t *testing.T) {
+	defer func(hosts []string) { AllowedRedirectHosts = hosts }(AllowedRedirectHosts)
+	AllowedRedirectHosts = []string{"example.com"}
+
+	memory := repository.NewMemory()
+	memory.SetSiteSecret(3, "s3cret")
+	err := memory.Repositories().Pages.Create(&models.Page{PageID: "r_test", PageKey: "r_test", UrlKey: "/r", Url: "/r", IsRotator: 1, UserID: 1, SiteID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	experimentID := "e_fallback_ads"
+	seedExperiment(t, memory, experimentID, "", "", []string{"p_1"}, nil)
+	variantID := variantIDFor(experimentID, "1")
+	h := &Handler{Repositories: memory.Repositories(), Cache: util.NewLRU(64)}
+
+	tracking := url.Values{"experiment": {experimentID}, "variant": {variantID}, "fallback": {"1"}}
+	requests := map[string]func(w http.ResponseWriter) error{
+		"event": func(w http.ResponseWriter) error {
+			body := `{"experiment":"` + experimentID + `","variant":"` + variantID + `","event_type":"cta","fallback":true}`
+			return h.EventHandler(w, httptest.NewRequest(http.MethodPost, "/event", bytes.NewBufferString(body)))
+		},
+		"pixel": func(w http.ResponseWriter) error {
+			return h.PixelHandler(w, httptest.NewRequest(http.MethodGet, "/pixel?"+tracking.Encode(), nil))
+		},
+		"click": func(w http.ResponseWriter) error {
+			query := url.Values{"to": {"https://example.com/thanks"}}
+			for k, v := range tracking {
+				query[k] = v
+			}
+			return h.ClickHandler(w, httptest.NewRequest(http.MethodGet, "/click?"+query.Encode(), nil))
+		},
+		"postback": func(w http.ResponseWriter) error {
+			postback := Postback{
+				SiteID:     3,
+				Experiment: experimentID,
+				Variant:    variantID,
+				EventType:  "purchase",
+				Nonce:      "n-fallback",
+				Timestamp:  time.Now().Unix(),
+				Fallback:   true,
+			}
+			return h.PostbackHandler(w, signedPostback(t, postback, "s3cret"))
+		},
+	}
+
+	for name, request := range requests {
+		w := httptest.NewRecorder()
+		if err := request(w); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if w.Code >= http.StatusBadRequest {
+			t.Errorf("%s answered %d: %s", name, w.Code, w.Body)
+		}
+	}
+
+	vh, err := memory.Repositories().History.Stats(util.EncodeString(experimentID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vh) != 1 || vh[0].CTA != 0 || vh[0].Lead != 0 || vh[0].Purchase != 0 {
+		t.Errorf("stats %+v, the fallback events were counted", vh)
+	}
+}
+
+func TestImpressionFailureKeepsAssignedVariant(t *testing.T) {
+	defer func(rule FallbackRule) { DefaultFallback = rule }(DefaultFallback)
+	DefaultFallback = FallbackRule{Policy: FallbackControl, ControlPage: "p_control"}
+
+	h, memory := newRotateHandler(t)
+	experimentID := experimentIDFor("r_home", "fb")
+	seedExperiment(t, memory, experimentID, "weighted", "", []string{"p_1", "p_2", "p_3"}, []int{34, 33, 33})
+
+	// the assignment is stored, the impression write then fails
+	history := newCountingHistory(1)
+	history.HistoryRepository = memory.Repositories().History
+	h.History = history
+
+	w, err := rotate(t, h, "https://example.com/", "fb", "visitor-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp rotateResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.Fallback || w.Header().Get(FallbackHeader) != "" {
+		t.Fatalf("served a fallback %+v to a visitor with an assignment", resp.Data)
+	}
+
+	assigned, err := memory.Repositories().Experiments.Assignment(util.EncodeString(experimentID), visitorKey("visitor-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assigned != resp.Data.SelectedVariant {
+		t.Errorf("served %s, the visitor is assigned %s", resp.Data.SelectedVariant, assigned)
+	}
+}
+
+// unavailableStats fails every read of the variant totals
+type unavailableStats struct {
+	repository.HistoryRepository
+}
+
+func (unavailableStats) Stats(string) ([]BuilderQuery.VariantHistory, error) {
+	return nil, errors.New("db unavailable")
+}
+
+func TestFallbackStoresNoAssignment(t *testing.T) {
+	defer func(rule FallbackRule) { DefaultFallback = rule }(DefaultFallback)
+	DefaultFallback = FallbackRule{Policy: FallbackControl, ControlPage: "p_control"}
+
+	h, memory := newRotateHandler(t)
+	experimentID := experimentIDFor("r_home", "fb")
+	seedExperiment(t, memory, experimentID, "", "", []string{"p_1", "p_2"}, nil)
+	h.History = unavailableStats{memory.Repositories().History}
+
+	w, err := rotate(t, h, "https://example.com/", "fb", "visitor-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp rotateResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Data.Fallback || resp.Data.SelectedVariant != variantIDFor(experimentID, "p_control") {
+		t.Fatalf("served %+v, want the control fallback", resp.Data)
+	}
+
+	_, err = memory.Repositories().Experiments.Assignment(util.EncodeString(experimentID), visitorKey("visitor-1"))
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("assignment lookup %v, want none stored", err)
+	}
+}
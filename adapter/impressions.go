@@ -0,0 +1,167 @@
+package adapter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/repository"
+)
+
+// DefaultFlushInterval is used by an ImpressionBuffer created without an
+// interval
+const DefaultFlushInterval = 5 * time.Second
+
+// CloseRetries is how many times Close retries a failing final flush, the
+// first retry waits CloseRetryDelay and every next one twice as long
+var (
+	CloseRetries    = 3
+	CloseRetryDelay = time.Second
+)
+
+// ImpressionBuffer counts impressions in memory and writes them to the
+// variant history shards in batches, one upsert per (shard, date,
+// experiment, variant) instead of one per request.
+//
+// Delivery is at least once for the counts that reach a flush: a write that
+// fails is merged back into the buffer and retried on the next flush, so a
+// write the DB applied but reported as failed, like a timeout, is counted
+// twice. Counts still buffered when the process dies without Close, or when
+// the final flush keeps failing through the retries of Close, are lost.
+type ImpressionBuffer struct {
+	History  repository.HistoryRepository
+	Interval time.Duration
+
+	mu     sync.Mutex
+	counts map[impressionKey]int
+
+	// flushMu keeps flushes from running concurrently
+	flushMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type impressionKey struct {
+	Table        string
+	Tanggal      string
+	ExperimentID string
+	VariantID    string
+}
+
+func NewImpressionBuffer(history repository.HistoryRepository, interval time.Duration) *ImpressionBuffer {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+
+	return &ImpressionBuffer{
+		History:  history,
+		Interval: interval,
+		counts:   make(map[impressionKey]int),
+	}
+}
+
+// Add counts one impression of the variant
+func (b *ImpressionBuffer) Add(table, tanggal, experimentID, variantID string) {
+	b.add(impressionKey{Table: table, Tanggal: tanggal, ExperimentID: experimentID, VariantID: variantID}, 1)
+}
+
+func (b *ImpressionBuffer) add(key impressionKey, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.counts[key] += n
+}
+
+// Pending returns the number of buffered impressions
+func (b *ImpressionBuffer) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending := 0
+	for _, n := range b.counts {
+		pending += n
+	}
+	return pending
+}
+
+// Flush writes the buffered counts. Counts that fail to be written stay
+// buffered and the first error is returned.
+func (b *ImpressionBuffer) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	counts := b.counts
+	b.counts = make(map[impressionKey]int)
+	b.mu.Unlock()
+
+	var firstErr error
+	for key, n := range counts {
+		exp_hash := sha256.Sum256([]byte(key.ExperimentID))
+		variant_hash := sha256.Sum256([]byte(key.VariantID))
+
+		err := b.History.Increment(key.Table, "impression", key.Tanggal,
+			key.ExperimentID, hex.EncodeToString(exp_hash[:]), key.VariantID, hex.EncodeToString(variant_hash[:]), n)
+		if err != nil {
+			b.add(key, n)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// Start flushes the buffer every Interval until Close is called
+func (b *ImpressionBuffer) Start() {
+	b.stop = make(chan struct{})
+	b.done = make(chan struct{})
+
+	go func() {
+		defer close(b.done)
+
+		ticker := time.NewTicker(b.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := b.Flush(); err != nil {
+					log.Printf("error flushing impressions : %v", err)
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the periodic flush and writes what is left in the buffer,
+// retrying a failing write CloseRetries times. The error reports the counts
+// still buffered, they are lost when the process exits.
+func (b *ImpressionBuffer) Close() error {
+	if b.stop != nil {
+		close(b.stop)
+		<-b.done
+		b.stop = nil
+	}
+
+	err := b.Flush()
+	delay := CloseRetryDelay
+	for retry := 0; err != nil && retry < CloseRetries; retry++ {
+		log.Printf("error flushing impressions, retrying in %s : %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		err = b.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("%d impressions not written : %v", b.Pending(), err)
+	}
+
+	return nil
+}
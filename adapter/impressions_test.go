@@ -0,0 +1,129 @@
+package adapter
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/repository"
+)
+
+// countingHistory records the impression increments, failing the next
+// failures calls
+type countingHistory struct {
+	repository.HistoryRepository
+
+	mu       sync.Mutex
+	calls    int
+	failures int
+	counts   map[impressionKey]int
+}
+
+func newCountingHistory(failures int) *countingHistory {
+	return &countingHistory{failures: failures, counts: make(map[impressionKey]int)}
+}
+
+func (c *countingHistory) Increment(tableName, column, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string, n int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls++
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("db unavailable")
+	}
+	c.counts[impressionKey{Table: tableName, Tanggal: tanggal, ExperimentID: experimentID, VariantID: variantID}] += n
+	return nil
+}
+
+func TestImpressionBufferBatchesPerKey(t *testing.T) {
+	history := newCountingHistory(0)
+	b := NewImpressionBuffer(history, time.Hour)
+
+	for i := 0; i < 5; i++ {
+		b.Add("t_01", "2026-10-18", "e_1", "v_a")
+	}
+	for i := 0; i < 3; i++ {
+		b.Add("t_01", "2026-10-18", "e_1", "v_b")
+	}
+	b.Add("t_01", "2026-10-19", "e_1", "v_a")
+
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if history.calls != 3 {
+		t.Errorf("%d writes for 3 keys", history.calls)
+	}
+	if n := history.counts[impressionKey{"t_01", "2026-10-18", "e_1", "v_a"}]; n != 5 {
+		t.Errorf("v_a got %d impressions, want 5", n)
+	}
+	if n := history.counts[impressionKey{"t_01", "2026-10-18", "e_1", "v_b"}]; n != 3 {
+		t.Errorf("v_b got %d impressions, want 3", n)
+	}
+	if b.Pending() != 0 {
+		t.Errorf("%d impressions left after a flush", b.Pending())
+	}
+}
+
+func TestImpressionBufferRemergesFailedFlush(t *testing.T) {
+	history := newCountingHistory(1)
+	b := NewImpressionBuffer(history, time.Hour)
+
+	b.Add("t_01", "2026-10-18", "e_1", "v_a")
+	b.Add("t_01", "2026-10-18", "e_1", "v_a")
+	if err := b.Flush(); err == nil {
+		t.Fatal("expected the failed write to be reported")
+	}
+	if b.Pending() != 2 {
+		t.Fatalf("%d impressions buffered after a failed flush, want 2", b.Pending())
+	}
+
+	// added while the DB was down, merged into the same key
+	b.Add("t_01", "2026-10-18", "e_1", "v_a")
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := history.counts[impressionKey{"t_01", "2026-10-18", "e_1", "v_a"}]; n != 3 {
+		t.Errorf("v_a got %d impressions, want 3", n)
+	}
+}
+
+func TestImpressionBufferFlushesOnClose(t *testing.T) {
+	history := newCountingHistory(0)
+	b := NewImpressionBuffer(history, time.Hour)
+	b.Start()
+
+	b.Add("t_01", "2026-10-18", "e_1", "v_a")
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := history.counts[impressionKey{"t_01", "2026-10-18", "e_1", "v_a"}]; n != 1 {
+		t.Errorf("v_a got %d impressions, want 1", n)
+	}
+}
+
+func TestImpressionBufferCloseRetries(t *testing.T) {
+	defer func(retries int, delay time.Duration) { CloseRetries, CloseRetryDelay = retries, delay }(CloseRetries, CloseRetryDelay)
+	CloseRetries, CloseRetryDelay = 2, time.Millisecond
+
+	history := newCountingHistory(2)
+	b := NewImpressionBuffer(history, time.Hour)
+	b.Add("t_01", "2026-10-18", "e_1", "v_a")
+	if err := b.Close(); err != nil {
+		t.Fatalf("the last retry succeeded but Close returned %v", err)
+	}
+	if n := history.counts[impressionKey{"t_01", "2026-10-18", "e_1", "v_a"}]; n != 1 {
+		t.Errorf("v_a got %d impressions, want 1", n)
+	}
+
+	history = newCountingHistory(3)
+	b = NewImpressionBuffer(history, time.Hour)
+	b.Add("t_01", "2026-10-18", "e_1", "v_a")
+	if err := b.Close(); err == nil {
+		t.Fatal("expected Close to report the impressions it couldn't write")
+	}
+	if history.calls != 3 {
+		t.Errorf("%d writes, want the flush and 2 retries", history.calls)
+	}
+}
@@ -44,6 +44,18 @@ func (p *Page) Show(db *sql.DB, id string) (*Page, error) {
 	return &page, nil
 }
 
+// ShowByUrlKey returns the page whose url_key is the hex key urlKeyHex
+func (p *Page) ShowByUrlKey(db *sql.DB, urlKeyHex string) (*Page, error) {
+	var page Page
+	q := "SELECT * FROM page WHERE url_key = UNHEX(?) LIMIT 1"
+	err := db.QueryRow(q, urlKeyHex).Scan(&page.PageID, &page.PageKey, &page.UrlKey, &page.Url, &page.IsRotator, &page.UserID, &page.SiteID, &page.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
 func (p *Page) Update(db *sql.DB, id string, data Page) error {
 	q := "Update page set page_key=UNHEX(?), url_key=UNHEX(?), url=?, is_rotator=?, user_id=?, site_id=? " +
 		"WHERE page_id = ?"
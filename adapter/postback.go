@@ -0,0 +1,205 @@
+package adapter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/util"
+	"github.com/go-playground/validator"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the raw postback body,
+// optionally prefixed with "sha256="
+const SignatureHeader = "X-Signature"
+
+// PostbackWindow is how far a postback timestamp may drift from the server
+// clock, nonces are cached for twice this window in front of the nonce table.
+// The nonces older than that are purged from the table at most once per
+// window, by the postback that finds the last purge a window old.
+var PostbackWindow = 5 * time.Minute
+
+const maxPostbackBody = 64 << 10
+
+// Postback is a conversion reported server to server by a site backend
+type Postback struct {
+	EventID    string `json:"event_id"`
+	SiteID     int    `json:"site_id" validate:"required"`
+	Experiment string `json:"experiment" validate:"required"`
+	Variant    string `json:"variant"`
+	Visitor    string `json:"visitor"`
+	EventType  string `json:"event_type" validate:"required"`
+	Nonce      string `json:"nonce" validate:"required"`
+	Timestamp  int64  `json:"timestamp" validate:"required"`
+	Fallback   bool   `json:"fallback"`
+}
+
+// postbackEvents are the event types accepted from a postback
+var postbackEvents = map[string]bool{
+	"purchase": true,
+	"prospek":  true,
+}
+
+func (h *Handler) PostbackHandler(w http.ResponseWriter, r *http.Request) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPostbackBody))
+	if err != nil {
+		util.ResponseError(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	var postback Postback
+	if err := json.Unmarshal(body, &postback); err != nil {
+		util.ResponseError(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := validator.New().Struct(postback); err != nil {
+		util.ResponseError(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	postback.EventType = strings.ToLower(postback.EventType)
+	if !postbackEvents[postback.EventType] {
+		util.ResponseError(w, "event_type must be purchase or prospek", http.StatusBadRequest)
+		return nil
+	}
+
+	secret, err := h.Pages.SiteSecret(postback.SiteID)
+	if errors.Is(err, repository.ErrNotFound) {
+		util.ResponseError(w, "invalid signature", http.StatusUnauthorized)
+		return nil
+	}
+	if err != nil {
+		return storageError(err)
+	}
+	if !validSignature(body, r.Header.Get(SignatureHeader), secret) {
+		util.ResponseError(w, "invalid signature", http.StatusUnauthorized)
+		return nil
+	}
+
+	drift := time.Since(time.Unix(postback.Timestamp, 0))
+	if drift > PostbackWindow || drift < -PostbackWindow {
+		util.ResponseError(w, "timestamp outside of the allowed window", http.StatusUnauthorized)
+		return nil
+	}
+
+	exp_hash := sha256.Sum256([]byte(postback.Experiment))
+	siteID, err := h.Experiments.SiteID(hex.EncodeToString(exp_hash[:]))
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return storageError(err)
+	}
+	if siteID != postback.SiteID {
+		util.ResponseError(w, "experiment doesn't belong to the site", http.StatusForbidden)
+		return nil
+	}
+
+	nonceKey := "nonce_" + strconv.Itoa(postback.SiteID) + "_" + util.EncodeString(postback.Nonce)
+	h.purgeNonces()
+	fresh, err := h.useNonce(nonceKey, postback.SiteID, util.EncodeString(postback.Nonce))
+	if err != nil {
+		return storageError(err)
+	}
+	if !fresh {
+		util.ResponseError(w, "nonce already used", http.StatusUnauthorized)
+		return nil
+	}
+
+	err = h.recordEvent(Event{
+		EventID:    postback.EventID,
+		Experiment: postback.Experiment,
+		Variant:    postback.Variant,
+		EventType:  postback.EventType,
+		Visitor:    postback.Visitor,
+		Fallback:   postback.Fallback,
+	})
+	if err != nil && !ignoredEvent(err) {
+		// let a retry of the postback be recorded
+		h.releaseNonce(nonceKey, postback.SiteID, util.EncodeString(postback.Nonce))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errDuplicateEvent):
+			util.ResponseSuccess(w, nil, "duplicate event ignored")
+			return nil
+		case errors.Is(err, errFallbackEvent):
+			util.ResponseSuccess(w, nil, "fallback event ignored")
+			return nil
+		case errors.Is(err, errNoVariant):
+			util.ResponseError(w, err.Error(), http.StatusBadRequest)
+			return nil
+		case errors.Is(err, errUnknownVariant):
+			util.ResponseError(w, err.Error(), http.StatusNotFound)
+			return nil
+		}
+		return err
+	}
+
+	util.ResponseSuccess(w, nil, "postback recorded")
+	return nil
+}
+
+// validSignature checks the hex HMAC-SHA256 of body with secret in constant
+// time
+func validSignature(body []byte, signature, secret string) bool {
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), "sha256=")
+	given, err := hex.DecodeString(signature)
+	if err != nil || len(given) == 0 || secret == "" {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+// useNonce records a postback nonce, the cache answers the common replays and
+// the nonce table the ones a noop or per process cache can't see
+func (h *Handler) useNonce(cacheKey string, siteID int, nonceKeyHex string) (bool, error) {
+	fresh, err := h.Cache.Add(cacheKey, []byte("1"), 2*PostbackWindow)
+	if err != nil {
+		log.Printf("error add cache : %v", err)
+	} else if !fresh {
+		return false, nil
+	}
+
+	fresh, err = h.Pages.UseNonce(siteID, nonceKeyHex)
+	if err != nil {
+		if err := h.Cache.Delete(cacheKey); err != nil {
+			log.Printf("error delete cache : %v", err)
+		}
+		return false, err
+	}
+
+	return fresh, nil
+}
+
+func (h *Handler) releaseNonce(cacheKey string, siteID int, nonceKeyHex string) {
+	if err := h.Cache.Delete(cacheKey); err != nil {
+		log.Printf("error delete cache : %v", err)
+	}
+	if err := h.Pages.ReleaseNonce(siteID, nonceKeyHex); err != nil {
+		log.Printf("error deleting postback nonce : %v", err)
+	}
+}
+
+// purgeNonces deletes the nonces no postback can replay anymore, when the
+// last purge is a PostbackWindow old
+func (h *Handler) purgeNonces() {
+	now := time.Now()
+	last := h.noncesPurged.Load()
+	if now.Sub(time.Unix(0, last)) < PostbackWindow || !h.noncesPurged.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	if _, err := h.Pages.PurgeNonces(now.Add(-2 * PostbackWindow)); err != nil {
+		log.Printf("error purging postback nonces : %v", err)
+	}
+}
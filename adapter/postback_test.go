@@ -0,0 +1,142 @@
+package adapter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+func signedPostback(t *testing.T, postback Postback, secret string) *http.Request {
+	t.Helper()
+
+	body, err := json.Marshal(postback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	r := httptest.NewRequest(http.MethodPost, "/postback", strings.NewReader(string(body)))
+	r.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestPostbackReplayRejectedWithoutCache(t *testing.T) {
+	memory := repository.NewMemory()
+	memory.SetSiteSecret(3, "s3cret")
+	err := memory.Repositories().Pages.Create(&models.Page{PageID: "r_test", PageKey: "r_test", UrlKey: "/r", Url: "/r", IsRotator: 1, UserID: 1, SiteID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedExperiment(t, memory, "e_postback_ads", "", "", []string{"p_1"}, nil)
+
+	// the noop cache remembers nothing, only the nonce table can see a replay
+	h := &Handler{Repositories: memory.Repositories(), Cache: util.NewNoop()}
+	postback := Postback{
+		SiteID:     3,
+		Experiment: "e_postback_ads",
+		Variant:    variantIDFor("e_postback_ads", "1"),
+		EventType:  "purchase",
+		Nonce:      "n-1",
+		Timestamp:  time.Now().Unix(),
+	}
+
+	w := httptest.NewRecorder()
+	if err := h.PostbackHandler(w, signedPostback(t, postback, "s3cret")); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("first postback answered %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	if err := h.PostbackHandler(w, signedPostback(t, postback, "s3cret")); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed postback answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPostbackNonceReleasedWhenRecordingFails(t *testing.T) {
+	memory := repository.NewMemory()
+	memory.SetSiteSecret(3, "s3cret")
+	err := memory.Repositories().Pages.Create(&models.Page{PageID: "r_test", PageKey: "r_test", UrlKey: "/r", Url: "/r", IsRotator: 1, UserID: 1, SiteID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedExperiment(t, memory, "e_postback_ads", "", "", []string{"p_1"}, nil)
+
+	history := newCountingHistory(1)
+	history.HistoryRepository = memory.Repositories().History
+	h := &Handler{Repositories: memory.Repositories(), Cache: util.NewLRU(64)}
+	h.History = history
+	postback := Postback{
+		SiteID:     3,
+		Experiment: "e_postback_ads",
+		Variant:    variantIDFor("e_postback_ads", "1"),
+		EventType:  "purchase",
+		Nonce:      "n-1",
+		Timestamp:  time.Now().Unix(),
+	}
+
+	if err := h.PostbackHandler(httptest.NewRecorder(), signedPostback(t, postback, "s3cret")); !errors.Is(err, ErrStorage) {
+		t.Fatalf("first postback returned %v, want a storage error", err)
+	}
+
+	// the retry reuses the nonce of the postback that wasn't recorded
+	w := httptest.NewRecorder()
+	if err := h.PostbackHandler(w, signedPostback(t, postback, "s3cret")); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("retried postback answered %d: %s", w.Code, w.Body)
+	}
+	if history.calls != 2 {
+		t.Errorf("%d increments, want the failed one and the retry", history.calls)
+	}
+}
+
+// countingPurges counts the nonce purges
+type countingPurges struct {
+	repository.PageRepository
+	purges []time.Time
+}
+
+func (c *countingPurges) PurgeNonces(before time.Time) (int64, error) {
+	c.purges = append(c.purges, before)
+	return c.PageRepository.PurgeNonces(before)
+}
+
+func TestPostbackNoncesPurgedOncePerWindow(t *testing.T) {
+	pages := &countingPurges{PageRepository: repository.NewMemory().Repositories().Pages}
+	h := &Handler{Cache: util.NewNoop()}
+	h.Pages = pages
+
+	h.purgeNonces()
+	h.purgeNonces()
+	if len(pages.purges) != 1 {
+		t.Fatalf("%d purges within one window", len(pages.purges))
+	}
+	if cutoff := time.Since(pages.purges[0]); cutoff < 2*PostbackWindow || cutoff > 2*PostbackWindow+time.Minute {
+		t.Errorf("purged the nonces older than %s, want twice the window", cutoff)
+	}
+
+	// a window later the next postback purges again
+	h.noncesPurged.Store(time.Now().Add(-PostbackWindow - time.Second).UnixNano())
+	h.purgeNonces()
+	if len(pages.purges) != 2 {
+		t.Errorf("%d purges after a window, want 2", len(pages.purges))
+	}
+}
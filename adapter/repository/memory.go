@@ -0,0 +1,606 @@
+package repository
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// Memory keeps every table in process, it is meant for tests and for running
+// the service without a DB. Nothing survives a restart.
+type Memory struct {
+	mu sync.Mutex
+
+	pages       map[string]models.Page
+	siteSecrets map[int]string
+	nonces      map[string]time.Time
+	rotators    []BuilderQuery.Rotator
+	experiments map[string]BuilderQuery.Experiment
+	assignments map[string]string
+	variants    map[string]*memoryVariant
+	history     map[historyKey]*BuilderQuery.VariantHistory
+	stats       map[string]map[string]*BuilderQuery.VariantHistory
+	events      map[string]bool
+	shardTables map[string]string
+}
+
+type memoryVariant struct {
+	VariantID     string
+	ExperimentKey string
+	PageID        string
+	Weight        int
+}
+
+type historyKey struct {
+	Table         string
+	Tanggal       string
+	ExperimentKey string
+	VariantKey    string
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		pages:       make(map[string]models.Page),
+		siteSecrets: make(map[int]string),
+		nonces:      make(map[string]time.Time),
+		experiments: make(map[string]BuilderQuery.Experiment),
+		assignments: make(map[string]string),
+		variants:    make(map[string]*memoryVariant),
+		history:     make(map[historyKey]*BuilderQuery.VariantHistory),
+		stats:       make(map[string]map[string]*BuilderQuery.VariantHistory),
+		events:      make(map[string]bool),
+		shardTables: make(map[string]string),
+	}
+}
+
+// Repositories returns the repositories reading and writing m
+func (m *Memory) Repositories() Repositories {
+	return Repositories{
+		Pages:       memoryPages{m},
+		Experiments: memoryExperiments{m},
+		Variants:    memoryVariants{m},
+		History:     memoryHistory{m},
+		Shards:      memoryShards{m},
+	}
+}
+
+// AddRotatorPage attaches a page to a rotator like a z_rotator row
+func (m *Memory) AddRotatorPage(rotatorID, pageID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rotators = append(m.rotators, BuilderQuery.Rotator{
+		PageID:     pageID,
+		PageKey:    unhex(util.EncodeString(pageID)),
+		RotatorID:  rotatorID,
+		RotatorKey: unhex(util.EncodeString(rotatorID)),
+	})
+}
+
+// SetSiteSecret sets the postback secret of a site
+func (m *Memory) SetSiteSecret(siteID int, secret string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.siteSecrets[siteID] = secret
+}
+
+// SetVariantWeight sets the traffic weight of an existing variant
+func (m *Memory) SetVariantWeight(experimentKeyHex, variantID string, weight int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, variant := range m.variants {
+		if variant.ExperimentKey == key(experimentKeyHex) && variant.VariantID == variantID {
+			variant.Weight = weight
+		}
+	}
+}
+
+// key normalizes a hex key, UNHEX accepts both cases
+func key(keyHex string) string {
+	return strings.ToLower(keyHex)
+}
+
+func unhex(keyHex string) []byte {
+	b, _ := hex.DecodeString(keyHex)
+	return b
+}
+
+type memoryPages struct {
+	m *Memory
+}
+
+func (r memoryPages) FindByUrlKey(urlKeyHex string) (*models.Page, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, page := range r.m.pages {
+		if hex.EncodeToString([]byte(page.UrlKey)) == key(urlKeyHex) {
+			return &page, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (r memoryPages) Get(pageID string) (*models.Page, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	page, ok := r.m.pages[pageID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &page, nil
+}
+
+func (r memoryPages) Create(page *models.Page) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if _, ok := r.m.pages[page.PageID]; ok {
+		return fmt.Errorf("duplicate page %s", page.PageID)
+	}
+
+	page.PageKey = util.EncodeString(page.PageKey)
+	page.UrlKey = util.EncodeString(page.UrlKey)
+
+	// keys are read back as the raw bytes of the binary columns
+	stored := *page
+	stored.PageKey = string(unhex(page.PageKey))
+	stored.UrlKey = string(unhex(page.UrlKey))
+	stored.Created = time.Now().Format("2006-01-02 15:04:05")
+	r.m.pages[page.PageID] = stored
+
+	return nil
+}
+
+func (r memoryPages) Update(pageID string, page models.Page) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	stored, ok := r.m.pages[pageID]
+	if !ok {
+		return nil
+	}
+
+	stored.PageKey = string(unhex(util.EncodeString(page.PageKey)))
+	stored.UrlKey = string(unhex(util.EncodeString(page.UrlKey)))
+	stored.Url = page.Url
+	stored.IsRotator = page.IsRotator
+	stored.UserID = page.UserID
+	stored.SiteID = page.SiteID
+	r.m.pages[pageID] = stored
+
+	return nil
+}
+
+func (r memoryPages) Delete(pageID string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	delete(r.m.pages, pageID)
+	return nil
+}
+
+func (r memoryPages) SiteSecret(siteID int) (string, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	secret, ok := r.m.siteSecrets[siteID]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return secret, nil
+}
+
+func (r memoryPages) UseNonce(siteID int, nonceKeyHex string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	k := fmt.Sprintf("%d_%s", siteID, key(nonceKeyHex))
+	if _, ok := r.m.nonces[k]; ok {
+		return false, nil
+	}
+	r.m.nonces[k] = time.Now()
+	return true, nil
+}
+
+func (r memoryPages) ReleaseNonce(siteID int, nonceKeyHex string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	delete(r.m.nonces, fmt.Sprintf("%d_%s", siteID, key(nonceKeyHex)))
+	return nil
+}
+
+func (r memoryPages) PurgeNonces(before time.Time) (int64, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	var purged int64
+	for k, created := range r.m.nonces {
+		if created.Before(before) {
+			delete(r.m.nonces, k)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+type memoryExperiments struct {
+	m *Memory
+}
+
+func (r memoryExperiments) Create(experiment BuilderQuery.Experiment) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	experimentKey := key(experiment.ExperimentKey)
+	if _, ok := r.m.experiments[experimentKey]; ok {
+		return false, nil
+	}
+
+	// keys are read back through HEX, which is upper case
+	experiment.ExperimentKey = strings.ToUpper(experiment.ExperimentKey)
+	experiment.RotatorKey = strings.ToUpper(experiment.RotatorKey)
+	r.m.experiments[experimentKey] = experiment
+
+	return true, nil
+}
+
+func (r memoryExperiments) Get(experimentKeyHex string) (BuilderQuery.Experiment, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	experiment, ok := r.m.experiments[key(experimentKeyHex)]
+	if !ok {
+		return BuilderQuery.Experiment{}, ErrNotFound
+	}
+
+	return experiment, nil
+}
+
+func (r memoryExperiments) KeysByPageID(pageID string) ([]string, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	rotatorKeys := make(map[string]bool)
+	for _, rotator := range r.m.rotators {
+		if rotator.PageID == pageID {
+			rotatorKeys[hex.EncodeToString(rotator.RotatorKey)] = true
+		}
+	}
+
+	var keys []string
+	for _, experiment := range r.m.experiments {
+		if experiment.RotatorID == pageID || rotatorKeys[key(experiment.RotatorKey)] {
+			keys = append(keys, experiment.ExperimentKey)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (r memoryExperiments) RotatorPages(rotatorKeyHex string) ([]BuilderQuery.Rotator, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	var rotators []BuilderQuery.Rotator
+	for _, rotator := range r.m.rotators {
+		if hex.EncodeToString(rotator.RotatorKey) == key(rotatorKeyHex) {
+			rotators = append(rotators, rotator)
+		}
+	}
+
+	return rotators, nil
+}
+
+func (r memoryExperiments) SiteID(experimentKeyHex string) (int, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	experiment, ok := r.m.experiments[key(experimentKeyHex)]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	page, ok := r.m.pages[experiment.RotatorID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	return page.SiteID, nil
+}
+
+func assignmentKey(experimentKeyHex, visitorKeyHex string) string {
+	return key(experimentKeyHex) + ":" + key(visitorKeyHex)
+}
+
+func (r memoryExperiments) Assignment(experimentKeyHex, visitorKeyHex string) (string, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	variantID, ok := r.m.assignments[assignmentKey(experimentKeyHex, visitorKeyHex)]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return variantID, nil
+}
+
+func (r memoryExperiments) InsertAssignment(experimentKeyHex, visitorKeyHex, variantID string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	k := assignmentKey(experimentKeyHex, visitorKeyHex)
+	if _, ok := r.m.assignments[k]; ok {
+		return false, nil
+	}
+
+	r.m.assignments[k] = variantID
+	return true, nil
+}
+
+func (r memoryExperiments) DeleteAssignment(experimentKeyHex, visitorKeyHex string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	delete(r.m.assignments, assignmentKey(experimentKeyHex, visitorKeyHex))
+	return nil
+}
+
+type memoryVariants struct {
+	m *Memory
+}
+
+func (r memoryVariants) Create(variantID, variantKeyHex, experimentID, experimentKeyHex, pageID, pageKeyHex string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	k := key(experimentKeyHex) + ":" + key(variantKeyHex)
+	if _, ok := r.m.variants[k]; !ok {
+		r.m.variants[k] = &memoryVariant{VariantID: variantID, ExperimentKey: key(experimentKeyHex), PageID: pageID}
+	}
+
+	return nil
+}
+
+func (r memoryVariants) Exists(experimentKeyHex, variantKeyHex string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	_, ok := r.m.variants[key(experimentKeyHex)+":"+key(variantKeyHex)]
+	return ok, nil
+}
+
+func (r memoryVariants) Weights(experimentKeyHex string) (map[string]int, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	weights := make(map[string]int)
+	for _, variant := range r.m.variants {
+		if variant.ExperimentKey == key(experimentKeyHex) {
+			weights[variant.VariantID] = variant.Weight
+		}
+	}
+
+	return weights, nil
+}
+
+type memoryHistory struct {
+	m *Memory
+}
+
+func (r memoryHistory) Create(tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.historyRow(tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex)
+	return nil
+}
+
+func (r memoryHistory) Increment(tableName, column, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string, n int) error {
+	if !historyCounters[column] {
+		return fmt.Errorf("unknown variant history counter: %s", column)
+	}
+
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	addCounter(r.m.historyRow(tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex), column, n)
+	addCounter(r.m.statsRow(experimentID, experimentKeyHex, variantID, variantKeyHex), column, n)
+	return nil
+}
+
+func (r memoryHistory) CreateStats(experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.statsRow(experimentID, experimentKeyHex, variantID, variantKeyHex)
+	return nil
+}
+
+func (r memoryHistory) Stats(experimentKeyHex string) ([]BuilderQuery.VariantHistory, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	var results []BuilderQuery.VariantHistory
+	for _, row := range r.m.stats[key(experimentKeyHex)] {
+		results = append(results, *row)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].VariantID < results[j].VariantID })
+
+	return results, nil
+}
+
+func (r memoryHistory) MarkEvent(dedupKeyHex, experimentKeyHex string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if r.m.events[key(dedupKeyHex)] {
+		return false, nil
+	}
+
+	r.m.events[key(dedupKeyHex)] = true
+	return true, nil
+}
+
+func (r memoryHistory) UnmarkEvent(dedupKeyHex string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	delete(r.m.events, key(dedupKeyHex))
+	return nil
+}
+
+type memoryShards struct {
+	m *Memory
+}
+
+func (r memoryShards) Table(experimentKeyHex string) (string, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	table, ok := r.m.shardTables[key(experimentKeyHex)]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return table, nil
+}
+
+func (r memoryShards) Pin(experimentKeyHex, experimentID, table string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if _, ok := r.m.shardTables[key(experimentKeyHex)]; ok {
+		return false, nil
+	}
+
+	r.m.shardTables[key(experimentKeyHex)] = table
+	return true, nil
+}
+
+func (r memoryShards) Set(experimentKeyHex, experimentID, table string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.shardTables[key(experimentKeyHex)] = table
+	return nil
+}
+
+func (r memoryShards) Assignments() ([]BuilderQuery.ShardAssignment, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	var assignments []BuilderQuery.ShardAssignment
+	for experimentKey, experiment := range r.m.experiments {
+		assignments = append(assignments, BuilderQuery.ShardAssignment{
+			ExperimentID:  experiment.ExperimentID,
+			ExperimentKey: experiment.ExperimentKey,
+			HistoryTable:  r.m.shardTables[experimentKey],
+		})
+	}
+	sort.Slice(assignments, func(i, j int) bool { return assignments[i].ExperimentID < assignments[j].ExperimentID })
+
+	return assignments, nil
+}
+
+func (r memoryShards) MoveHistory(fromTable, toTable, experimentKeyHex string) (int64, error) {
+	if fromTable == toTable {
+		return 0, nil
+	}
+
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	var moved int64
+	for k, row := range r.m.history {
+		if k.Table != fromTable || k.ExperimentKey != key(experimentKeyHex) {
+			continue
+		}
+
+		target := r.m.historyRow(toTable, row.Tanggal, row.ExperimentID, experimentKeyHex, row.VariantID, hex.EncodeToString(row.VariantKey))
+		target.Impression += row.Impression
+		target.CTA += row.CTA
+		target.Lead += row.Lead
+		target.Mql += row.Mql
+		target.Prospek += row.Prospek
+		target.Purchase += row.Purchase
+
+		delete(r.m.history, k)
+		moved++
+	}
+
+	return moved, nil
+}
+
+// historyRow returns the daily history row of a variant, creating it when
+// missing. The caller must hold the lock.
+func (m *Memory) historyRow(tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string) *BuilderQuery.VariantHistory {
+	k := historyKey{Table: tableName, Tanggal: tanggal, ExperimentKey: key(experimentKeyHex), VariantKey: key(variantKeyHex)}
+
+	row, ok := m.history[k]
+	if !ok {
+		row = &BuilderQuery.VariantHistory{
+			VariantID:     variantID,
+			VariantKey:    unhex(variantKeyHex),
+			ExperimentID:  experimentID,
+			ExperimentKey: unhex(experimentKeyHex),
+			Tanggal:       tanggal,
+		}
+		m.history[k] = row
+	}
+
+	return row
+}
+
+// statsRow returns the totals row of a variant, creating it when missing.
+// The caller must hold the lock.
+func (m *Memory) statsRow(experimentID, experimentKeyHex, variantID, variantKeyHex string) *BuilderQuery.VariantHistory {
+	stats, ok := m.stats[key(experimentKeyHex)]
+	if !ok {
+		stats = make(map[string]*BuilderQuery.VariantHistory)
+		m.stats[key(experimentKeyHex)] = stats
+	}
+
+	row, ok := stats[key(variantKeyHex)]
+	if !ok {
+		row = &BuilderQuery.VariantHistory{
+			VariantID:     variantID,
+			VariantKey:    unhex(variantKeyHex),
+			ExperimentID:  experimentID,
+			ExperimentKey: unhex(experimentKeyHex),
+		}
+		stats[key(variantKeyHex)] = row
+	}
+
+	return row
+}
+
+func addCounter(row *BuilderQuery.VariantHistory, column string, n int) {
+	switch column {
+	case "impression":
+		row.Impression += uint(n)
+	case "cta":
+		row.CTA += uint(n)
+	case "lead":
+		row.Lead += uint(n)
+	case "mql":
+		row.Mql += uint(n)
+	case "prospek":
+		row.Prospek += uint(n)
+	case "purchase":
+		row.Purchase += uint(n)
+	}
+}
@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dennyaris/html-rotate/util"
+)
+
+func TestMemoryMoveHistoryMergesCounters(t *testing.T) {
+	m := NewMemory()
+	history, shards := m.Repositories().History, m.Repositories().Shards
+	experimentKey, variantKey := util.EncodeString("e_move_fb"), util.EncodeString("v_1")
+	other := util.EncodeString("e_other_fb")
+
+	increments := []struct {
+		table, column, tanggal, experimentKey string
+		n                                     int
+	}{
+		{"z_rotator_variant_history_10", "impression", "2024-01-01", experimentKey, 5},
+		{"z_rotator_variant_history_10", "cta", "2024-01-01", experimentKey, 2},
+		{"z_rotator_variant_history_10", "impression", "2024-01-02", experimentKey, 7},
+		// written by a server that already had the new table
+		{"z_rotator_variant_history_20", "impression", "2024-01-01", experimentKey, 3},
+		{"z_rotator_variant_history_20", "cta", "2024-01-01", experimentKey, 1},
+		// another experiment in the old table stays there
+		{"z_rotator_variant_history_10", "impression", "2024-01-01", other, 9},
+	}
+	for _, i := range increments {
+		if err := history.Increment(i.table, i.column, i.tanggal, "e", i.experimentKey, "v_1", variantKey, i.n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := shards.MoveHistory("z_rotator_variant_history_10", "z_rotator_variant_history_20", experimentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Errorf("moved %d rows, want 2", moved)
+	}
+
+	row := func(table, tanggal, experimentKey string) (uint, uint, bool) {
+		r, ok := m.history[historyKey{Table: table, Tanggal: tanggal, ExperimentKey: key(experimentKey), VariantKey: key(variantKey)}]
+		if !ok {
+			return 0, 0, false
+		}
+		return r.Impression, r.CTA, true
+	}
+
+	cases := []struct {
+		table, tanggal, experimentKey string
+		impression, cta               uint
+		exists                        bool
+	}{
+		{"z_rotator_variant_history_20", "2024-01-01", experimentKey, 8, 3, true},
+		{"z_rotator_variant_history_20", "2024-01-02", experimentKey, 7, 0, true},
+		{"z_rotator_variant_history_10", "2024-01-01", experimentKey, 0, 0, false},
+		{"z_rotator_variant_history_10", "2024-01-02", experimentKey, 0, 0, false},
+		{"z_rotator_variant_history_10", "2024-01-01", other, 9, 0, true},
+	}
+	for _, c := range cases {
+		impression, cta, exists := row(c.table, c.tanggal, c.experimentKey)
+		if exists != c.exists || impression != c.impression || cta != c.cta {
+			t.Errorf("%s %s: impression %d cta %d exists %v, want %d %d %v",
+				c.table, c.tanggal, impression, cta, exists, c.impression, c.cta, c.exists)
+		}
+	}
+
+	// moving again finds nothing left
+	if moved, err := shards.MoveHistory("z_rotator_variant_history_10", "z_rotator_variant_history_20", experimentKey); err != nil || moved != 0 {
+		t.Errorf("second move: %d rows, %v", moved, err)
+	}
+}
+
+func TestMemoryMoveHistoryToSameTable(t *testing.T) {
+	m := NewMemory()
+	experimentKey, variantKey := util.EncodeString("e_same_fb"), util.EncodeString("v_1")
+	if err := m.Repositories().History.Increment("z_rotator_variant_history_10", "impression", "2024-01-01", "e", experimentKey, "v_1", variantKey, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := m.Repositories().Shards.MoveHistory("z_rotator_variant_history_10", "z_rotator_variant_history_10", experimentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 0 {
+		t.Errorf("moved %d rows within one table", moved)
+	}
+
+	row := m.history[historyKey{Table: "z_rotator_variant_history_10", Tanggal: "2024-01-01", ExperimentKey: key(experimentKey), VariantKey: key(variantKey)}]
+	if row == nil || row.Impression != 4 {
+		t.Errorf("row %+v, want the 4 impressions untouched", row)
+	}
+}
+
+func TestMemoryShardPin(t *testing.T) {
+	shards := NewMemory().Repositories().Shards
+	experimentKey := util.EncodeString("e_pin_fb")
+
+	if _, err := shards.Table(experimentKey); err != ErrNotFound {
+		t.Fatalf("unpinned experiment: %v, want ErrNotFound", err)
+	}
+
+	steps := []struct {
+		set    bool
+		table  string
+		pinned bool
+		want   string
+	}{
+		{table: "z_rotator_variant_history_10", pinned: true, want: "z_rotator_variant_history_10"},
+		// a second pin keeps the first table
+		{table: "z_rotator_variant_history_20", pinned: false, want: "z_rotator_variant_history_10"},
+		{set: true, table: "z_rotator_variant_history_30", want: "z_rotator_variant_history_30"},
+	}
+	for i, step := range steps {
+		if step.set {
+			if err := shards.Set(experimentKey, "e_pin_fb", step.table); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			pinned, err := shards.Pin(experimentKey, "e_pin_fb", step.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pinned != step.pinned {
+				t.Errorf("step %d: pinned %v, want %v", i, pinned, step.pinned)
+			}
+		}
+
+		table, err := shards.Table(experimentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table != step.want {
+			t.Errorf("step %d: table %s, want %s", i, table, step.want)
+		}
+	}
+}
+
+func TestMemoryNonces(t *testing.T) {
+	pages := NewMemory().Repositories().Pages
+	nonce := util.EncodeString("n-1")
+
+	steps := []struct {
+		name string
+		do   func() (bool, error)
+		want bool
+	}{
+		{"first use", func() (bool, error) { return pages.UseNonce(3, nonce) }, true},
+		{"replay", func() (bool, error) { return pages.UseNonce(3, nonce) }, false},
+		{"other site", func() (bool, error) { return pages.UseNonce(4, nonce) }, true},
+		{"after release", func() (bool, error) {
+			if err := pages.ReleaseNonce(3, nonce); err != nil {
+				return false, err
+			}
+			return pages.UseNonce(3, nonce)
+		}, true},
+		{"recent nonces kept", func() (bool, error) {
+			if _, err := pages.PurgeNonces(time.Now().Add(-time.Hour)); err != nil {
+				return false, err
+			}
+			return pages.UseNonce(3, nonce)
+		}, false},
+		{"after purge", func() (bool, error) {
+			purged, err := pages.PurgeNonces(time.Now().Add(time.Second))
+			if err != nil || purged != 2 {
+				return false, fmt.Errorf("purged %d nonces: %v", purged, err)
+			}
+			return pages.UseNonce(3, nonce)
+		}, true},
+	}
+
+	for _, step := range steps {
+		fresh, err := step.do()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if fresh != step.want {
+			t.Errorf("%s: fresh %v, want %v", step.name, fresh, step.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+)
+
+// NewMySQL returns the repositories backed by the MySQL schema, the queries
+// live in package builder_query and the page model
+func NewMySQL(db *sql.DB) Repositories {
+	return Repositories{
+		Pages:       mysqlPages{db},
+		Experiments: mysqlExperiments{db},
+		Variants:    mysqlVariants{db},
+		History:     mysqlHistory{db},
+		Shards:      mysqlShards{db},
+	}
+}
+
+type mysqlPages struct {
+	db *sql.DB
+}
+
+func (r mysqlPages) FindByUrlKey(urlKeyHex string) (*models.Page, error) {
+	return (&models.Page{}).ShowByUrlKey(r.db, urlKeyHex)
+}
+
+func (r mysqlPages) Get(pageID string) (*models.Page, error) {
+	return (&models.Page{}).Show(r.db, pageID)
+}
+
+func (r mysqlPages) Create(page *models.Page) error {
+	return page.Create(r.db)
+}
+
+func (r mysqlPages) Update(pageID string, page models.Page) error {
+	return page.Update(r.db, pageID, page)
+}
+
+func (r mysqlPages) Delete(pageID string) error {
+	return (&models.Page{}).Delete(r.db, pageID)
+}
+
+func (r mysqlPages) SiteSecret(siteID int) (string, error) {
+	return BuilderQuery.GetSiteSecret(r.db, siteID)
+}
+
+func (r mysqlPages) UseNonce(siteID int, nonceKeyHex string) (bool, error) {
+	return BuilderQuery.InsertPostbackNonce(r.db, siteID, nonceKeyHex)
+}
+
+func (r mysqlPages) ReleaseNonce(siteID int, nonceKeyHex string) error {
+	return BuilderQuery.DeletePostbackNonce(r.db, siteID, nonceKeyHex)
+}
+
+func (r mysqlPages) PurgeNonces(before time.Time) (int64, error) {
+	return BuilderQuery.DeleteExpiredPostbackNonces(r.db, before)
+}
+
+type mysqlExperiments struct {
+	db *sql.DB
+}
+
+func (r mysqlExperiments) Create(experiment BuilderQuery.Experiment) (bool, error) {
+	data := map[string]string{
+		"experiment_id":  experiment.ExperimentID,
+		"experiment_key": experiment.ExperimentKey,
+		"rotator_id":     experiment.RotatorID,
+		"rotator_key":    experiment.RotatorKey,
+		"ads_name":       experiment.AdsName,
+	}
+	if experiment.Strategy != "" {
+		data["strategy"] = experiment.Strategy
+	}
+	if experiment.StrategyParams != "" {
+		data["strategy_params"] = experiment.StrategyParams
+	}
+
+	return BuilderQuery.InsertIntoTable(r.db, "z_rotator_experiment", data)
+}
+
+func (r mysqlExperiments) Get(experimentKeyHex string) (BuilderQuery.Experiment, error) {
+	return BuilderQuery.SelectFromZRotatorExperiment(r.db, experimentKeyHex)
+}
+
+func (r mysqlExperiments) KeysByPageID(pageID string) ([]string, error) {
+	return BuilderQuery.GetExperimentKeysByPageID(r.db, pageID)
+}
+
+func (r mysqlExperiments) RotatorPages(rotatorKeyHex string) ([]BuilderQuery.Rotator, error) {
+	return BuilderQuery.GetPagesByRotatorKey(r.db, rotatorKeyHex)
+}
+
+func (r mysqlExperiments) SiteID(experimentKeyHex string) (int, error) {
+	return BuilderQuery.GetExperimentSiteID(r.db, experimentKeyHex)
+}
+
+func (r mysqlExperiments) Assignment(experimentKeyHex, visitorKeyHex string) (string, error) {
+	return BuilderQuery.GetAssignment(r.db, experimentKeyHex, visitorKeyHex)
+}
+
+func (r mysqlExperiments) InsertAssignment(experimentKeyHex, visitorKeyHex, variantID string) (bool, error) {
+	return BuilderQuery.InsertAssignment(r.db, experimentKeyHex, visitorKeyHex, variantID)
+}
+
+func (r mysqlExperiments) DeleteAssignment(experimentKeyHex, visitorKeyHex string) error {
+	return BuilderQuery.DeleteAssignment(r.db, experimentKeyHex, visitorKeyHex)
+}
+
+type mysqlVariants struct {
+	db *sql.DB
+}
+
+func (r mysqlVariants) Create(variantID, variantKeyHex, experimentID, experimentKeyHex, pageID, pageKeyHex string) error {
+	return BuilderQuery.InsertVariant(r.db, variantID, variantKeyHex, experimentID, experimentKeyHex, pageID, pageKeyHex)
+}
+
+func (r mysqlVariants) Exists(experimentKeyHex, variantKeyHex string) (bool, error) {
+	return BuilderQuery.VariantExists(r.db, experimentKeyHex, variantKeyHex)
+}
+
+func (r mysqlVariants) Weights(experimentKeyHex string) (map[string]int, error) {
+	return BuilderQuery.GetVariantWeights(r.db, experimentKeyHex)
+}
+
+type mysqlHistory struct {
+	db *sql.DB
+}
+
+func (r mysqlHistory) Create(tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	return BuilderQuery.InsertVariantHistory(r.db, tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex)
+}
+
+func (r mysqlHistory) Increment(tableName, column, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string, n int) error {
+	return BuilderQuery.IncrementVariantHistory(r.db, tableName, column, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex, n)
+}
+
+func (r mysqlHistory) CreateStats(experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	return BuilderQuery.InsertVariantStats(r.db, experimentID, experimentKeyHex, variantID, variantKeyHex)
+}
+
+func (r mysqlHistory) Stats(experimentKeyHex string) ([]BuilderQuery.VariantHistory, error) {
+	return BuilderQuery.GetVariantStatsByExperimentKey(r.db, experimentKeyHex)
+}
+
+func (r mysqlHistory) MarkEvent(dedupKeyHex, experimentKeyHex string) (bool, error) {
+	return BuilderQuery.InsertEventDedup(r.db, dedupKeyHex, experimentKeyHex)
+}
+
+func (r mysqlHistory) UnmarkEvent(dedupKeyHex string) error {
+	return BuilderQuery.DeleteEventDedup(r.db, dedupKeyHex)
+}
+
+type mysqlShards struct {
+	db *sql.DB
+}
+
+func (r mysqlShards) Table(experimentKeyHex string) (string, error) {
+	return BuilderQuery.GetShardTable(r.db, experimentKeyHex)
+}
+
+func (r mysqlShards) Pin(experimentKeyHex, experimentID, table string) (bool, error) {
+	return BuilderQuery.PinShardTable(r.db, experimentKeyHex, experimentID, table)
+}
+
+func (r mysqlShards) Set(experimentKeyHex, experimentID, table string) error {
+	return BuilderQuery.SetShardTable(r.db, experimentKeyHex, experimentID, table)
+}
+
+func (r mysqlShards) Assignments() ([]BuilderQuery.ShardAssignment, error) {
+	return BuilderQuery.GetShardAssignments(r.db)
+}
+
+func (r mysqlShards) MoveHistory(fromTable, toTable, experimentKeyHex string) (int64, error) {
+	return BuilderQuery.MoveVariantHistory(r.db, fromTable, toTable, experimentKeyHex)
+}
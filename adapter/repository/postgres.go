@@ -0,0 +1,388 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// NewPostgres returns the repositories backed by a Postgres database created
+// by the postgres migrations. Binary keys are bytea columns written with the
+// bytes UNHEX would produce and read back upper case like HEX, INSERT IGNORE
+// becomes ON CONFLICT DO NOTHING and ON DUPLICATE KEY UPDATE becomes ON
+// CONFLICT DO UPDATE.
+func NewPostgres(db *sql.DB) Repositories {
+	return Repositories{
+		Pages:       postgresPages{db},
+		Experiments: postgresExperiments{db},
+		Variants:    postgresVariants{db},
+		History:     postgresHistory{db},
+		Shards:      postgresShards{db},
+	}
+}
+
+// postgresHex selects a bytea key as upper case hex
+func postgresHex(column string) string {
+	return "upper(encode(" + column + ", 'hex'))"
+}
+
+type postgresPages struct {
+	db *sql.DB
+}
+
+const postgresPageColumns = "page_id, page_key, url_key, url, is_rotator, user_id, site_id, created"
+
+func (r postgresPages) find(where string, arg interface{}) (*models.Page, error) {
+	var page models.Page
+	q := "SELECT page_id, page_key, url_key, url, is_rotator, user_id, site_id, to_char(created, 'YYYY-MM-DD HH24:MI:SS') " +
+		"FROM page WHERE " + where + " LIMIT 1"
+	err := r.db.QueryRow(q, arg).Scan(&page.PageID, &page.PageKey, &page.UrlKey, &page.Url, &page.IsRotator, &page.UserID, &page.SiteID, &page.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+func (r postgresPages) FindByUrlKey(urlKeyHex string) (*models.Page, error) {
+	return r.find("url_key = $1", unhex(urlKeyHex))
+}
+
+func (r postgresPages) Get(pageID string) (*models.Page, error) {
+	return r.find("page_id = $1", pageID)
+}
+
+func (r postgresPages) Create(page *models.Page) error {
+	page.PageKey = util.EncodeString(page.PageKey)
+	page.UrlKey = util.EncodeString(page.UrlKey)
+
+	q := "INSERT INTO page (" + postgresPageColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	_, err := r.db.Exec(q, page.PageID, unhex(page.PageKey), unhex(page.UrlKey), page.Url, page.IsRotator, page.UserID, page.SiteID,
+		time.Now().Format(timeFormat))
+	return err
+}
+
+func (r postgresPages) Update(pageID string, page models.Page) error {
+	q := "UPDATE page SET page_key = $1, url_key = $2, url = $3, is_rotator = $4, user_id = $5, site_id = $6 WHERE page_id = $7"
+	_, err := r.db.Exec(q, unhex(util.EncodeString(page.PageKey)), unhex(util.EncodeString(page.UrlKey)), page.Url, page.IsRotator,
+		page.UserID, page.SiteID, pageID)
+	return err
+}
+
+func (r postgresPages) Delete(pageID string) error {
+	_, err := r.db.Exec("DELETE FROM page WHERE page_id = $1", pageID)
+	return err
+}
+
+func (r postgresPages) SiteSecret(siteID int) (string, error) {
+	var secret string
+	err := r.db.QueryRow("SELECT secret FROM site_secret WHERE site_id = $1 LIMIT 1", siteID).Scan(&secret)
+	return secret, err
+}
+
+func (r postgresPages) UseNonce(siteID int, nonceKeyHex string) (bool, error) {
+	q := "INSERT INTO z_rotator_postback_nonce (site_id, nonce_key, created) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+	return rowsInserted(r.db.Exec(q, siteID, unhex(nonceKeyHex), time.Now().Format(timeFormat)))
+}
+
+func (r postgresPages) ReleaseNonce(siteID int, nonceKeyHex string) error {
+	_, err := r.db.Exec("DELETE FROM z_rotator_postback_nonce WHERE site_id = $1 AND nonce_key = $2", siteID, unhex(nonceKeyHex))
+	return err
+}
+
+func (r postgresPages) PurgeNonces(before time.Time) (int64, error) {
+	result, err := r.db.Exec("DELETE FROM z_rotator_postback_nonce WHERE created < $1", before.Format(timeFormat))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+type postgresExperiments struct {
+	db *sql.DB
+}
+
+func (r postgresExperiments) Create(experiment BuilderQuery.Experiment) (bool, error) {
+	q := "INSERT INTO z_rotator_experiment (experiment_id, experiment_key, ads_name, rotator_id, rotator_key, strategy, strategy_params) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING"
+	return rowsInserted(r.db.Exec(q, experiment.ExperimentID, unhex(experiment.ExperimentKey), experiment.AdsName,
+		experiment.RotatorID, unhex(experiment.RotatorKey), nullString(experiment.Strategy), nullString(experiment.StrategyParams)))
+}
+
+func (r postgresExperiments) Get(experimentKeyHex string) (BuilderQuery.Experiment, error) {
+	var row BuilderQuery.Experiment
+	var strategy, strategyParams sql.NullString
+
+	q := "SELECT experiment_id, " + postgresHex("experiment_key") + ", ads_name, rotator_id, " + postgresHex("rotator_key") + ", status, strategy, strategy_params " +
+		"FROM z_rotator_experiment WHERE experiment_key = $1 LIMIT 1"
+	err := r.db.QueryRow(q, unhex(experimentKeyHex)).Scan(&row.ExperimentID, &row.ExperimentKey, &row.AdsName, &row.RotatorID,
+		&row.RotatorKey, &row.Status, &strategy, &strategyParams)
+	if err != nil {
+		return BuilderQuery.Experiment{}, err
+	}
+	row.Strategy = strategy.String
+	row.StrategyParams = strategyParams.String
+
+	return row, nil
+}
+
+func (r postgresExperiments) KeysByPageID(pageID string) ([]string, error) {
+	q := "SELECT " + postgresHex("experiment_key") + " FROM z_rotator_experiment WHERE rotator_id = $1 " +
+		"OR rotator_key IN (SELECT rotator_key FROM z_rotator WHERE page_id = $1)"
+	rows, err := r.db.Query(q, pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (r postgresExperiments) RotatorPages(rotatorKeyHex string) ([]BuilderQuery.Rotator, error) {
+	q := "SELECT page_id, page_key, rotator_id, rotator_key FROM z_rotator WHERE rotator_key = $1"
+	rows, err := r.db.Query(q, unhex(rotatorKeyHex))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rotators []BuilderQuery.Rotator
+	for rows.Next() {
+		var rotator BuilderQuery.Rotator
+		if err := rows.Scan(&rotator.PageID, &rotator.PageKey, &rotator.RotatorID, &rotator.RotatorKey); err != nil {
+			return nil, err
+		}
+		rotators = append(rotators, rotator)
+	}
+
+	return rotators, rows.Err()
+}
+
+func (r postgresExperiments) SiteID(experimentKeyHex string) (int, error) {
+	var siteID int
+	q := "SELECT p.site_id FROM z_rotator_experiment e JOIN page p ON p.page_id = e.rotator_id WHERE e.experiment_key = $1 LIMIT 1"
+	err := r.db.QueryRow(q, unhex(experimentKeyHex)).Scan(&siteID)
+	return siteID, err
+}
+
+func (r postgresExperiments) Assignment(experimentKeyHex, visitorKeyHex string) (string, error) {
+	var variantID string
+	q := "SELECT variant_id FROM z_rotator_assignment WHERE experiment_key = $1 AND visitor_key = $2 LIMIT 1"
+	err := r.db.QueryRow(q, unhex(experimentKeyHex), unhex(visitorKeyHex)).Scan(&variantID)
+	return variantID, err
+}
+
+func (r postgresExperiments) InsertAssignment(experimentKeyHex, visitorKeyHex, variantID string) (bool, error) {
+	q := "INSERT INTO z_rotator_assignment (experiment_key, visitor_key, variant_id, created) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+	return rowsInserted(r.db.Exec(q, unhex(experimentKeyHex), unhex(visitorKeyHex), variantID, time.Now().Format(timeFormat)))
+}
+
+func (r postgresExperiments) DeleteAssignment(experimentKeyHex, visitorKeyHex string) error {
+	q := "DELETE FROM z_rotator_assignment WHERE experiment_key = $1 AND visitor_key = $2"
+	_, err := r.db.Exec(q, unhex(experimentKeyHex), unhex(visitorKeyHex))
+	return err
+}
+
+type postgresVariants struct {
+	db *sql.DB
+}
+
+func (r postgresVariants) Create(variantID, variantKeyHex, experimentID, experimentKeyHex, pageID, pageKeyHex string) error {
+	q := "INSERT INTO z_rotator_variant (variant_id, variant_key, experiment_id, experiment_key, page_id, page_key) VALUES ($1, $2, $3, $4, $5, $6) " +
+		"ON CONFLICT DO NOTHING"
+	_, err := r.db.Exec(q, variantID, unhex(variantKeyHex), experimentID, unhex(experimentKeyHex), pageID, unhex(pageKeyHex))
+	return err
+}
+
+func (r postgresVariants) Exists(experimentKeyHex, variantKeyHex string) (bool, error) {
+	var found int
+	q := "SELECT 1 FROM z_rotator_variant WHERE experiment_key = $1 AND variant_key = $2 LIMIT 1"
+	err := r.db.QueryRow(q, unhex(experimentKeyHex), unhex(variantKeyHex)).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (r postgresVariants) Weights(experimentKeyHex string) (map[string]int, error) {
+	rows, err := r.db.Query("SELECT variant_id, weight FROM z_rotator_variant WHERE experiment_key = $1", unhex(experimentKeyHex))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	weights := make(map[string]int)
+	for rows.Next() {
+		var variantID string
+		var weight sql.NullInt64
+		if err := rows.Scan(&variantID, &weight); err != nil {
+			return nil, err
+		}
+		weights[variantID] = int(weight.Int64)
+	}
+
+	return weights, rows.Err()
+}
+
+type postgresHistory struct {
+	db *sql.DB
+}
+
+func (r postgresHistory) Create(tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	q := "INSERT INTO " + tableName + " (variant_id, variant_key, experiment_id, experiment_key, tanggal) VALUES ($1, $2, $3, $4, $5) " +
+		"ON CONFLICT DO NOTHING"
+	_, err := r.db.Exec(q, variantID, unhex(variantKeyHex), experimentID, unhex(experimentKeyHex), tanggal)
+	return err
+}
+
+// Increment is the upsert MySQL runs in rotatorGetPage, the counters are
+// qualified with the table name as excluded has the same columns
+func (r postgresHistory) Increment(tableName, column, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string, n int) error {
+	if !historyCounters[column] {
+		return fmt.Errorf("unknown variant history counter: %s", column)
+	}
+
+	historyQuery := "INSERT INTO " + tableName + " (tanggal, experiment_id, experiment_key, variant_id, variant_key, " + column + ") " +
+		"VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (experiment_key, variant_key, tanggal) " +
+		"DO UPDATE SET " + column + " = " + tableName + "." + column + " + excluded." + column
+	statsQuery := "INSERT INTO z_rotator_variant_stats (experiment_id, experiment_key, variant_id, variant_key, " + column + ") " +
+		"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (experiment_key, variant_key) " +
+		"DO UPDATE SET " + column + " = z_rotator_variant_stats." + column + " + excluded." + column
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(historyQuery, tanggal, experimentID, unhex(experimentKeyHex), variantID, unhex(variantKeyHex), n); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(statsQuery, experimentID, unhex(experimentKeyHex), variantID, unhex(variantKeyHex), n); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r postgresHistory) CreateStats(experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	q := "INSERT INTO z_rotator_variant_stats (experiment_id, experiment_key, variant_id, variant_key) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+	_, err := r.db.Exec(q, experimentID, unhex(experimentKeyHex), variantID, unhex(variantKeyHex))
+	return err
+}
+
+func (r postgresHistory) Stats(experimentKeyHex string) ([]BuilderQuery.VariantHistory, error) {
+	q := "SELECT variant_id, impression, cta, lead, mql, prospek, purchase FROM z_rotator_variant_stats WHERE experiment_key = $1 ORDER BY variant_id"
+	rows, err := r.db.Query(q, unhex(experimentKeyHex))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []BuilderQuery.VariantHistory
+	for rows.Next() {
+		var result BuilderQuery.VariantHistory
+		err := rows.Scan(&result.VariantID, &result.Impression, &result.CTA, &result.Lead, &result.Mql, &result.Prospek, &result.Purchase)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+func (r postgresHistory) MarkEvent(dedupKeyHex, experimentKeyHex string) (bool, error) {
+	q := "INSERT INTO z_rotator_event_dedup (dedup_key, experiment_key, created) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+	return rowsInserted(r.db.Exec(q, unhex(dedupKeyHex), unhex(experimentKeyHex), time.Now().Format(timeFormat)))
+}
+
+func (r postgresHistory) UnmarkEvent(dedupKeyHex string) error {
+	_, err := r.db.Exec("DELETE FROM z_rotator_event_dedup WHERE dedup_key = $1", unhex(dedupKeyHex))
+	return err
+}
+
+type postgresShards struct {
+	db *sql.DB
+}
+
+func (r postgresShards) Table(experimentKeyHex string) (string, error) {
+	var table string
+	err := r.db.QueryRow("SELECT history_table FROM z_rotator_shard_map WHERE experiment_key = $1 LIMIT 1", unhex(experimentKeyHex)).Scan(&table)
+	return table, err
+}
+
+func (r postgresShards) Pin(experimentKeyHex, experimentID, table string) (bool, error) {
+	q := "INSERT INTO z_rotator_shard_map (experiment_key, experiment_id, history_table, updated) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+	return rowsInserted(r.db.Exec(q, unhex(experimentKeyHex), experimentID, table, time.Now().Format(timeFormat)))
+}
+
+func (r postgresShards) Set(experimentKeyHex, experimentID, table string) error {
+	q := "INSERT INTO z_rotator_shard_map (experiment_key, experiment_id, history_table, updated) VALUES ($1, $2, $3, $4) " +
+		"ON CONFLICT (experiment_key) DO UPDATE SET history_table = excluded.history_table, updated = excluded.updated"
+	_, err := r.db.Exec(q, unhex(experimentKeyHex), experimentID, table, time.Now().Format(timeFormat))
+	return err
+}
+
+func (r postgresShards) Assignments() ([]BuilderQuery.ShardAssignment, error) {
+	q := "SELECT e.experiment_id, upper(encode(e.experiment_key, 'hex')), COALESCE(m.history_table, '') FROM z_rotator_experiment e " +
+		"LEFT JOIN z_rotator_shard_map m ON m.experiment_key = e.experiment_key ORDER BY e.experiment_id"
+	rows, err := r.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assignments []BuilderQuery.ShardAssignment
+	for rows.Next() {
+		var assignment BuilderQuery.ShardAssignment
+		if err := rows.Scan(&assignment.ExperimentID, &assignment.ExperimentKey, &assignment.HistoryTable); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, assignment)
+	}
+
+	return assignments, rows.Err()
+}
+
+// MoveHistory deletes and copies the rows in one statement. Under READ
+// COMMITTED an INSERT ... SELECT followed by a DELETE would delete the rows
+// servers still writing to the old table commit in between without copying
+// them.
+func (r postgresShards) MoveHistory(fromTable, toTable, experimentKeyHex string) (int64, error) {
+	if fromTable == toTable {
+		return 0, nil
+	}
+
+	columns := "tanggal, experiment_id, experiment_key, variant_id, variant_key, impression, cta, lead, mql, prospek, purchase"
+	q := "WITH moved AS (DELETE FROM " + fromTable + " WHERE experiment_key = $1 RETURNING " + columns + ") " +
+		"INSERT INTO " + toTable + " (" + columns + ") SELECT " + columns + " FROM moved " +
+		"ON CONFLICT (experiment_key, variant_key, tanggal) DO UPDATE SET impression = " + toTable + ".impression + excluded.impression, " +
+		"cta = " + toTable + ".cta + excluded.cta, lead = " + toTable + ".lead + excluded.lead, mql = " + toTable + ".mql + excluded.mql, " +
+		"prospek = " + toTable + ".prospek + excluded.prospek, purchase = " + toTable + ".purchase + excluded.purchase"
+
+	result, err := r.db.Exec(q, unhex(experimentKeyHex))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,23 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPostgresHex(t *testing.T) {
+	if got, want := postgresHex("e.experiment_key"), "upper(encode(e.experiment_key, 'hex'))"; got != want {
+		t.Errorf("%s, want %s", got, want)
+	}
+}
+
+func TestPostgresIncrementRejectsUnknownColumns(t *testing.T) {
+	// the column is checked before the DB is used
+	history := postgresHistory{}
+	for _, column := range []string{"impressions", "cta = 0, lead", "Purchase"} {
+		err := history.Increment("z_rotator_variant_history_01", column, "2024-01-01", "e", "00", "v", "00", 1)
+		if err == nil || !strings.Contains(err.Error(), "unknown variant history counter") {
+			t.Errorf("%q: %v", column, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package repository hides the storage of pages, experiments, variants and
+// their history behind interfaces, with MySQL and Postgres implementations
+// for production, a SQLite one for local development and an in-memory one
+// for tests and for running without a DB.
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+)
+
+// ErrNotFound is returned by every implementation when a row doesn't exist.
+// It is sql.ErrNoRows so callers written against the MySQL queries keep
+// working.
+var ErrNotFound = sql.ErrNoRows
+
+// Keys named *KeyHex are hex sha256 keys, matched case insensitively like
+// UNHEX does.
+
+// PageRepository stores the pages and the secrets of their sites
+type PageRepository interface {
+	// FindByUrlKey returns the page whose url_key is urlKeyHex
+	FindByUrlKey(urlKeyHex string) (*models.Page, error)
+	Get(pageID string) (*models.Page, error)
+	// Create stores the page, its PageKey and UrlKey are hashed first
+	Create(page *models.Page) error
+	Update(pageID string, page models.Page) error
+	Delete(pageID string) error
+	// SiteSecret returns the shared secret a site signs its postbacks with
+	SiteSecret(siteID int) (string, error)
+	// UseNonce stores a postback nonce of the site, it returns false when the
+	// nonce was already used
+	UseNonce(siteID int, nonceKeyHex string) (bool, error)
+	// ReleaseNonce deletes a postback nonce so the postback can be retried
+	ReleaseNonce(siteID int, nonceKeyHex string) error
+	// PurgeNonces deletes the nonces stored before the given time and returns
+	// the number of deleted nonces
+	PurgeNonces(before time.Time) (int64, error)
+}
+
+// ExperimentRepository stores the experiments, the pages of their rotators
+// and the variant assigned to each visitor
+type ExperimentRepository interface {
+	// Create stores the experiment, it returns false when it already exists
+	Create(experiment BuilderQuery.Experiment) (bool, error)
+	Get(experimentKeyHex string) (BuilderQuery.Experiment, error)
+	// KeysByPageID returns the keys of the experiments running on the page,
+	// either as the rotator or as one of the rotator's pages
+	KeysByPageID(pageID string) ([]string, error)
+	// RotatorPages returns the pages attached to a rotator
+	RotatorPages(rotatorKeyHex string) ([]BuilderQuery.Rotator, error)
+	// SiteID returns the site of the rotator page the experiment runs on
+	SiteID(experimentKeyHex string) (int, error)
+
+	Assignment(experimentKeyHex, visitorKeyHex string) (string, error)
+	// InsertAssignment returns false when the visitor already has an
+	// assignment in the experiment
+	InsertAssignment(experimentKeyHex, visitorKeyHex, variantID string) (bool, error)
+	DeleteAssignment(experimentKeyHex, visitorKeyHex string) error
+}
+
+// VariantRepository stores the variants of the experiments
+type VariantRepository interface {
+	// Create adds a page to an experiment as one of its variants, an existing
+	// variant is left untouched
+	Create(variantID, variantKeyHex, experimentID, experimentKeyHex, pageID, pageKeyHex string) error
+	Exists(experimentKeyHex, variantKeyHex string) (bool, error)
+	// Weights returns the traffic weight of every variant keyed by variant id
+	Weights(experimentKeyHex string) (map[string]int, error)
+}
+
+// HistoryRepository stores the daily counters of the variants in the history
+// tables, their running totals and the keys of the counted events
+type HistoryRepository interface {
+	// Create adds the empty daily row of a variant
+	Create(tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string) error
+	// Increment adds n to a counter of the variant's daily row and totals
+	Increment(tableName, column, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string, n int) error
+
+	// CreateStats adds the empty totals row of a variant
+	CreateStats(experimentID, experimentKeyHex, variantID, variantKeyHex string) error
+	// Stats returns the totals of every variant of an experiment ordered by
+	// variant id, or nil when it has none
+	Stats(experimentKeyHex string) ([]BuilderQuery.VariantHistory, error)
+
+	// MarkEvent stores the dedup key of a counted event, it returns false
+	// when the key was already stored
+	MarkEvent(dedupKeyHex, experimentKeyHex string) (bool, error)
+	UnmarkEvent(dedupKeyHex string) error
+}
+
+// ShardRepository stores the variant history table each experiment is pinned
+// to and moves history rows between tables
+type ShardRepository interface {
+	// Table returns the history table the experiment is pinned to
+	Table(experimentKeyHex string) (string, error)
+	// Pin pins an experiment without a table, it returns false when the
+	// experiment is already pinned
+	Pin(experimentKeyHex, experimentID, table string) (bool, error)
+	// Set pins the experiment to table, replacing its previous table
+	Set(experimentKeyHex, experimentID, table string) error
+	// Assignments returns every experiment with its pinned table
+	Assignments() ([]BuilderQuery.ShardAssignment, error)
+	// MoveHistory moves the rows of an experiment between history tables,
+	// adding up the counters of days already in the target, and returns the
+	// number of moved rows
+	MoveHistory(fromTable, toTable, experimentKeyHex string) (int64, error)
+}
+
+// historyCounters are the variant history columns that can be incremented
+var historyCounters = map[string]bool{
+	"impression": true, "cta": true, "lead": true, "mql": true, "prospek": true, "purchase": true,
+}
+
+// timeFormat is the layout of the created columns
+const timeFormat = "2006-01-02 15:04:05"
+
+// rowsInserted reports whether an insert ignoring duplicates wrote a row
+func rowsInserted(result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Repositories groups the repositories of one storage backend
+type Repositories struct {
+	Pages       PageRepository
+	Experiments ExperimentRepository
+	Variants    VariantRepository
+	History     HistoryRepository
+	Shards      ShardRepository
+}
+
+// New returns the repositories of the database driver, mysql, postgres or
+// sqlite
+func New(driver string, db *sql.DB) (Repositories, error) {
+	switch driver {
+	case "mysql":
+		return NewMySQL(db), nil
+	case "postgres":
+		return NewPostgres(db), nil
+	case "sqlite":
+		return NewSQLite(db), nil
+	}
+
+	return Repositories{}, fmt.Errorf("no repositories for driver %s", driver)
+}
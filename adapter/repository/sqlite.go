@@ -0,0 +1,385 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// NewSQLite returns the repositories backed by a SQLite database created by
+// the sqlite migrations. Binary keys are BLOB columns written with the bytes
+// UNHEX would produce, INSERT IGNORE becomes INSERT OR IGNORE and ON
+// DUPLICATE KEY UPDATE becomes ON CONFLICT DO UPDATE.
+func NewSQLite(db *sql.DB) Repositories {
+	return Repositories{
+		Pages:       sqlitePages{db},
+		Experiments: sqliteExperiments{db},
+		Variants:    sqliteVariants{db},
+		History:     sqliteHistory{db},
+		Shards:      sqliteShards{db},
+	}
+}
+
+type sqlitePages struct {
+	db *sql.DB
+}
+
+const sqlitePageColumns = "page_id, page_key, url_key, url, is_rotator, user_id, site_id, created"
+
+func (r sqlitePages) find(where string, arg interface{}) (*models.Page, error) {
+	var page models.Page
+	q := "SELECT " + sqlitePageColumns + " FROM page WHERE " + where + " LIMIT 1"
+	err := r.db.QueryRow(q, arg).Scan(&page.PageID, &page.PageKey, &page.UrlKey, &page.Url, &page.IsRotator, &page.UserID, &page.SiteID, &page.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+func (r sqlitePages) FindByUrlKey(urlKeyHex string) (*models.Page, error) {
+	return r.find("url_key = ?", unhex(urlKeyHex))
+}
+
+func (r sqlitePages) Get(pageID string) (*models.Page, error) {
+	return r.find("page_id = ?", pageID)
+}
+
+func (r sqlitePages) Create(page *models.Page) error {
+	page.PageKey = util.EncodeString(page.PageKey)
+	page.UrlKey = util.EncodeString(page.UrlKey)
+
+	q := "INSERT INTO page (" + sqlitePageColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.db.Exec(q, page.PageID, unhex(page.PageKey), unhex(page.UrlKey), page.Url, page.IsRotator, page.UserID, page.SiteID,
+		time.Now().Format(timeFormat))
+	return err
+}
+
+func (r sqlitePages) Update(pageID string, page models.Page) error {
+	q := "UPDATE page SET page_key = ?, url_key = ?, url = ?, is_rotator = ?, user_id = ?, site_id = ? WHERE page_id = ?"
+	_, err := r.db.Exec(q, unhex(util.EncodeString(page.PageKey)), unhex(util.EncodeString(page.UrlKey)), page.Url, page.IsRotator,
+		page.UserID, page.SiteID, pageID)
+	return err
+}
+
+func (r sqlitePages) Delete(pageID string) error {
+	_, err := r.db.Exec("DELETE FROM page WHERE page_id = ?", pageID)
+	return err
+}
+
+func (r sqlitePages) SiteSecret(siteID int) (string, error) {
+	var secret string
+	err := r.db.QueryRow("SELECT secret FROM site_secret WHERE site_id = ? LIMIT 1", siteID).Scan(&secret)
+	return secret, err
+}
+
+func (r sqlitePages) UseNonce(siteID int, nonceKeyHex string) (bool, error) {
+	q := "INSERT OR IGNORE INTO z_rotator_postback_nonce (site_id, nonce_key, created) VALUES (?, ?, ?)"
+	return rowsInserted(r.db.Exec(q, siteID, unhex(nonceKeyHex), time.Now().Format(timeFormat)))
+}
+
+func (r sqlitePages) ReleaseNonce(siteID int, nonceKeyHex string) error {
+	_, err := r.db.Exec("DELETE FROM z_rotator_postback_nonce WHERE site_id = ? AND nonce_key = ?", siteID, unhex(nonceKeyHex))
+	return err
+}
+
+func (r sqlitePages) PurgeNonces(before time.Time) (int64, error) {
+	result, err := r.db.Exec("DELETE FROM z_rotator_postback_nonce WHERE created < ?", before.Format(timeFormat))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+type sqliteExperiments struct {
+	db *sql.DB
+}
+
+func (r sqliteExperiments) Create(experiment BuilderQuery.Experiment) (bool, error) {
+	q := "INSERT OR IGNORE INTO z_rotator_experiment (experiment_id, experiment_key, ads_name, rotator_id, rotator_key, strategy, strategy_params) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?)"
+	return rowsInserted(r.db.Exec(q, experiment.ExperimentID, unhex(experiment.ExperimentKey), experiment.AdsName,
+		experiment.RotatorID, unhex(experiment.RotatorKey), nullString(experiment.Strategy), nullString(experiment.StrategyParams)))
+}
+
+func (r sqliteExperiments) Get(experimentKeyHex string) (BuilderQuery.Experiment, error) {
+	var row BuilderQuery.Experiment
+	var strategy, strategyParams sql.NullString
+
+	q := "SELECT experiment_id, hex(experiment_key), ads_name, rotator_id, hex(rotator_key), status, strategy, strategy_params " +
+		"FROM z_rotator_experiment WHERE experiment_key = ? LIMIT 1"
+	err := r.db.QueryRow(q, unhex(experimentKeyHex)).Scan(&row.ExperimentID, &row.ExperimentKey, &row.AdsName, &row.RotatorID,
+		&row.RotatorKey, &row.Status, &strategy, &strategyParams)
+	if err != nil {
+		return BuilderQuery.Experiment{}, err
+	}
+	row.Strategy = strategy.String
+	row.StrategyParams = strategyParams.String
+
+	return row, nil
+}
+
+func (r sqliteExperiments) KeysByPageID(pageID string) ([]string, error) {
+	q := "SELECT hex(experiment_key) FROM z_rotator_experiment WHERE rotator_id = ? " +
+		"OR rotator_key IN (SELECT rotator_key FROM z_rotator WHERE page_id = ?)"
+	rows, err := r.db.Query(q, pageID, pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (r sqliteExperiments) RotatorPages(rotatorKeyHex string) ([]BuilderQuery.Rotator, error) {
+	q := "SELECT page_id, page_key, rotator_id, rotator_key FROM z_rotator WHERE rotator_key = ?"
+	rows, err := r.db.Query(q, unhex(rotatorKeyHex))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rotators []BuilderQuery.Rotator
+	for rows.Next() {
+		var rotator BuilderQuery.Rotator
+		if err := rows.Scan(&rotator.PageID, &rotator.PageKey, &rotator.RotatorID, &rotator.RotatorKey); err != nil {
+			return nil, err
+		}
+		rotators = append(rotators, rotator)
+	}
+
+	return rotators, rows.Err()
+}
+
+func (r sqliteExperiments) SiteID(experimentKeyHex string) (int, error) {
+	var siteID int
+	q := "SELECT p.site_id FROM z_rotator_experiment e JOIN page p ON p.page_id = e.rotator_id WHERE e.experiment_key = ? LIMIT 1"
+	err := r.db.QueryRow(q, unhex(experimentKeyHex)).Scan(&siteID)
+	return siteID, err
+}
+
+func (r sqliteExperiments) Assignment(experimentKeyHex, visitorKeyHex string) (string, error) {
+	var variantID string
+	q := "SELECT variant_id FROM z_rotator_assignment WHERE experiment_key = ? AND visitor_key = ? LIMIT 1"
+	err := r.db.QueryRow(q, unhex(experimentKeyHex), unhex(visitorKeyHex)).Scan(&variantID)
+	return variantID, err
+}
+
+func (r sqliteExperiments) InsertAssignment(experimentKeyHex, visitorKeyHex, variantID string) (bool, error) {
+	q := "INSERT OR IGNORE INTO z_rotator_assignment (experiment_key, visitor_key, variant_id, created) VALUES (?, ?, ?, ?)"
+	return rowsInserted(r.db.Exec(q, unhex(experimentKeyHex), unhex(visitorKeyHex), variantID, time.Now().Format(timeFormat)))
+}
+
+func (r sqliteExperiments) DeleteAssignment(experimentKeyHex, visitorKeyHex string) error {
+	q := "DELETE FROM z_rotator_assignment WHERE experiment_key = ? AND visitor_key = ?"
+	_, err := r.db.Exec(q, unhex(experimentKeyHex), unhex(visitorKeyHex))
+	return err
+}
+
+type sqliteVariants struct {
+	db *sql.DB
+}
+
+func (r sqliteVariants) Create(variantID, variantKeyHex, experimentID, experimentKeyHex, pageID, pageKeyHex string) error {
+	q := "INSERT OR IGNORE INTO z_rotator_variant (variant_id, variant_key, experiment_id, experiment_key, page_id, page_key) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := r.db.Exec(q, variantID, unhex(variantKeyHex), experimentID, unhex(experimentKeyHex), pageID, unhex(pageKeyHex))
+	return err
+}
+
+func (r sqliteVariants) Exists(experimentKeyHex, variantKeyHex string) (bool, error) {
+	var found int
+	q := "SELECT 1 FROM z_rotator_variant WHERE experiment_key = ? AND variant_key = ? LIMIT 1"
+	err := r.db.QueryRow(q, unhex(experimentKeyHex), unhex(variantKeyHex)).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (r sqliteVariants) Weights(experimentKeyHex string) (map[string]int, error) {
+	rows, err := r.db.Query("SELECT variant_id, weight FROM z_rotator_variant WHERE experiment_key = ?", unhex(experimentKeyHex))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	weights := make(map[string]int)
+	for rows.Next() {
+		var variantID string
+		var weight sql.NullInt64
+		if err := rows.Scan(&variantID, &weight); err != nil {
+			return nil, err
+		}
+		weights[variantID] = int(weight.Int64)
+	}
+
+	return weights, rows.Err()
+}
+
+type sqliteHistory struct {
+	db *sql.DB
+}
+
+func (r sqliteHistory) Create(tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	q := "INSERT OR IGNORE INTO " + tableName + " (variant_id, variant_key, experiment_id, experiment_key, tanggal) VALUES (?, ?, ?, ?, ?)"
+	_, err := r.db.Exec(q, variantID, unhex(variantKeyHex), experimentID, unhex(experimentKeyHex), tanggal)
+	return err
+}
+
+func (r sqliteHistory) Increment(tableName, column, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string, n int) error {
+	if !historyCounters[column] {
+		return fmt.Errorf("unknown variant history counter: %s", column)
+	}
+
+	historyQuery := "INSERT INTO " + tableName + " (tanggal, experiment_id, experiment_key, variant_id, variant_key, " + column + ") " +
+		"VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (experiment_key, variant_key, tanggal) DO UPDATE SET " + column + " = " + column + " + excluded." + column
+	statsQuery := "INSERT INTO z_rotator_variant_stats (experiment_id, experiment_key, variant_id, variant_key, " + column + ") " +
+		"VALUES (?, ?, ?, ?, ?) ON CONFLICT (experiment_key, variant_key) DO UPDATE SET " + column + " = " + column + " + excluded." + column
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(historyQuery, tanggal, experimentID, unhex(experimentKeyHex), variantID, unhex(variantKeyHex), n); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(statsQuery, experimentID, unhex(experimentKeyHex), variantID, unhex(variantKeyHex), n); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r sqliteHistory) CreateStats(experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	q := "INSERT OR IGNORE INTO z_rotator_variant_stats (experiment_id, experiment_key, variant_id, variant_key) VALUES (?, ?, ?, ?)"
+	_, err := r.db.Exec(q, experimentID, unhex(experimentKeyHex), variantID, unhex(variantKeyHex))
+	return err
+}
+
+func (r sqliteHistory) Stats(experimentKeyHex string) ([]BuilderQuery.VariantHistory, error) {
+	q := "SELECT variant_id, impression, cta, lead, mql, prospek, purchase FROM z_rotator_variant_stats WHERE experiment_key = ? ORDER BY variant_id"
+	rows, err := r.db.Query(q, unhex(experimentKeyHex))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []BuilderQuery.VariantHistory
+	for rows.Next() {
+		var result BuilderQuery.VariantHistory
+		err := rows.Scan(&result.VariantID, &result.Impression, &result.CTA, &result.Lead, &result.Mql, &result.Prospek, &result.Purchase)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+func (r sqliteHistory) MarkEvent(dedupKeyHex, experimentKeyHex string) (bool, error) {
+	q := "INSERT OR IGNORE INTO z_rotator_event_dedup (dedup_key, experiment_key, created) VALUES (?, ?, ?)"
+	return rowsInserted(r.db.Exec(q, unhex(dedupKeyHex), unhex(experimentKeyHex), time.Now().Format(timeFormat)))
+}
+
+func (r sqliteHistory) UnmarkEvent(dedupKeyHex string) error {
+	_, err := r.db.Exec("DELETE FROM z_rotator_event_dedup WHERE dedup_key = ?", unhex(dedupKeyHex))
+	return err
+}
+
+type sqliteShards struct {
+	db *sql.DB
+}
+
+func (r sqliteShards) Table(experimentKeyHex string) (string, error) {
+	var table string
+	err := r.db.QueryRow("SELECT history_table FROM z_rotator_shard_map WHERE experiment_key = ? LIMIT 1", unhex(experimentKeyHex)).Scan(&table)
+	return table, err
+}
+
+func (r sqliteShards) Pin(experimentKeyHex, experimentID, table string) (bool, error) {
+	q := "INSERT OR IGNORE INTO z_rotator_shard_map (experiment_key, experiment_id, history_table, updated) VALUES (?, ?, ?, ?)"
+	return rowsInserted(r.db.Exec(q, unhex(experimentKeyHex), experimentID, table, time.Now().Format(timeFormat)))
+}
+
+func (r sqliteShards) Set(experimentKeyHex, experimentID, table string) error {
+	q := "INSERT INTO z_rotator_shard_map (experiment_key, experiment_id, history_table, updated) VALUES (?, ?, ?, ?) " +
+		"ON CONFLICT (experiment_key) DO UPDATE SET history_table = excluded.history_table, updated = excluded.updated"
+	_, err := r.db.Exec(q, unhex(experimentKeyHex), experimentID, table, time.Now().Format(timeFormat))
+	return err
+}
+
+func (r sqliteShards) Assignments() ([]BuilderQuery.ShardAssignment, error) {
+	q := "SELECT e.experiment_id, hex(e.experiment_key), COALESCE(m.history_table, '') FROM z_rotator_experiment e " +
+		"LEFT JOIN z_rotator_shard_map m ON m.experiment_key = e.experiment_key ORDER BY e.experiment_id"
+	rows, err := r.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assignments []BuilderQuery.ShardAssignment
+	for rows.Next() {
+		var assignment BuilderQuery.ShardAssignment
+		if err := rows.Scan(&assignment.ExperimentID, &assignment.ExperimentKey, &assignment.HistoryTable); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, assignment)
+	}
+
+	return assignments, rows.Err()
+}
+
+func (r sqliteShards) MoveHistory(fromTable, toTable, experimentKeyHex string) (int64, error) {
+	if fromTable == toTable {
+		return 0, nil
+	}
+
+	columns := "tanggal, experiment_id, experiment_key, variant_id, variant_key, impression, cta, lead, mql, prospek, purchase"
+	insertQuery := "INSERT INTO " + toTable + " (" + columns + ") SELECT " + columns + " FROM " + fromTable + " WHERE experiment_key = ? " +
+		"ON CONFLICT (experiment_key, variant_key, tanggal) DO UPDATE SET impression = " + toTable + ".impression + excluded.impression, " +
+		"cta = " + toTable + ".cta + excluded.cta, lead = " + toTable + ".lead + excluded.lead, mql = " + toTable + ".mql + excluded.mql, " +
+		"prospek = " + toTable + ".prospek + excluded.prospek, purchase = " + toTable + ".purchase + excluded.purchase"
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(insertQuery, unhex(experimentKeyHex)); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM "+fromTable+" WHERE experiment_key = ?", unhex(experimentKeyHex))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	moved, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return moved, tx.Commit()
+}
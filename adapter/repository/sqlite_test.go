@@ -0,0 +1,244 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	"github.com/dennyaris/html-rotate/migrations"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+	"github.com/dennyaris/html-rotate/util"
+	_ "modernc.org/sqlite"
+)
+
+func newSQLiteRepositories(t *testing.T) (Repositories, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "rotator.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.New(db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := New("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repos, db
+}
+
+func TestSQLitePagesAndExperiments(t *testing.T) {
+	repos, _ := newSQLiteRepositories(t)
+
+	err := repos.Pages.Create(&models.Page{PageID: "r_home", PageKey: "r_home", UrlKey: "https://example.com/", Url: "https://example.com/", IsRotator: 1, UserID: 1, SiteID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := repos.Pages.FindByUrlKey(util.EncodeString("https://example.com/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.PageID != "r_home" || page.SiteID != 3 {
+		t.Errorf("found %+v", page)
+	}
+	if _, err := repos.Pages.FindByUrlKey(util.EncodeString("https://example.com/missing")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing page: %v, want ErrNotFound", err)
+	}
+
+	experimentKey := util.EncodeString("e_home_fb")
+	experiment := BuilderQuery.Experiment{ExperimentID: "e_home_fb", ExperimentKey: experimentKey, AdsName: "fb", RotatorID: "r_home", RotatorKey: util.EncodeString("r_home")}
+	for i, want := range []bool{true, false} {
+		created, err := repos.Experiments.Create(experiment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != want {
+			t.Errorf("create %d returned %v, want %v", i, created, want)
+		}
+	}
+	if siteID, err := repos.Experiments.SiteID(experimentKey); err != nil || siteID != 3 {
+		t.Errorf("site %d: %v", siteID, err)
+	}
+
+	visitorKey := util.EncodeString("visitor-1")
+	if inserted, err := repos.Experiments.InsertAssignment(experimentKey, visitorKey, "v_home_fb_1"); err != nil || !inserted {
+		t.Fatalf("first assignment inserted %v: %v", inserted, err)
+	}
+	if inserted, err := repos.Experiments.InsertAssignment(experimentKey, visitorKey, "v_home_fb_2"); err != nil || inserted {
+		t.Fatalf("second assignment inserted %v: %v", inserted, err)
+	}
+	if variantID, err := repos.Experiments.Assignment(experimentKey, visitorKey); err != nil || variantID != "v_home_fb_1" {
+		t.Errorf("assignment %s: %v", variantID, err)
+	}
+}
+
+func TestSQLiteIncrement(t *testing.T) {
+	repos, db := newSQLiteRepositories(t)
+	experimentKey, variantKey := util.EncodeString("e_home_fb"), util.EncodeString("v_home_fb_1")
+	table := "z_rotator_variant_history_07"
+
+	increments := []struct {
+		column, tanggal string
+		n               int
+	}{
+		{"impression", "2024-01-01", 3},
+		{"impression", "2024-01-01", 2},
+		{"cta", "2024-01-01", 1},
+		{"impression", "2024-01-02", 4},
+	}
+	for _, i := range increments {
+		if err := repos.History.Increment(table, i.column, i.tanggal, "e_home_fb", experimentKey, "v_home_fb_1", variantKey, i.n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repos.History.Increment(table, "impression; DROP TABLE page", "2024-01-01", "e_home_fb", experimentKey, "v_home_fb_1", variantKey, 1); err == nil {
+		t.Error("incremented an unknown column")
+	}
+
+	var impression, cta int
+	err := db.QueryRow("SELECT impression, cta FROM "+table+" WHERE tanggal = '2024-01-01' AND experiment_key = ?", unhex(experimentKey)).Scan(&impression, &cta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if impression != 5 || cta != 1 {
+		t.Errorf("daily row has %d impressions and %d ctas, want 5 and 1", impression, cta)
+	}
+
+	stats, err := repos.History.Stats(experimentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Impression != 9 || stats[0].CTA != 1 {
+		t.Errorf("totals %+v, want 9 impressions and 1 cta", stats)
+	}
+}
+
+func TestSQLiteMoveHistory(t *testing.T) {
+	repos, db := newSQLiteRepositories(t)
+	experimentKey, variantKey := util.EncodeString("e_home_fb"), util.EncodeString("v_home_fb_1")
+
+	increments := []struct {
+		table, column, tanggal string
+		n                      int
+	}{
+		{"z_rotator_variant_history_10", "impression", "2024-01-01", 5},
+		{"z_rotator_variant_history_10", "cta", "2024-01-01", 2},
+		{"z_rotator_variant_history_10", "impression", "2024-01-02", 7},
+		{"z_rotator_variant_history_20", "impression", "2024-01-01", 3},
+	}
+	for _, i := range increments {
+		if err := repos.History.Increment(i.table, i.column, i.tanggal, "e_home_fb", experimentKey, "v_home_fb_1", variantKey, i.n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if moved, err := repos.Shards.MoveHistory("z_rotator_variant_history_10", "z_rotator_variant_history_10", experimentKey); err != nil || moved != 0 {
+		t.Errorf("moving within a table moved %d rows: %v", moved, err)
+	}
+
+	moved, err := repos.Shards.MoveHistory("z_rotator_variant_history_10", "z_rotator_variant_history_20", experimentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Errorf("moved %d rows, want 2", moved)
+	}
+
+	var left int
+	if err := db.QueryRow("SELECT COUNT(*) FROM z_rotator_variant_history_10").Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d rows left in the old table", left)
+	}
+
+	rows := map[string][2]int{"2024-01-01": {8, 2}, "2024-01-02": {7, 0}}
+	for tanggal, want := range rows {
+		var impression, cta int
+		err := db.QueryRow("SELECT impression, cta FROM z_rotator_variant_history_20 WHERE tanggal = ? AND experiment_key = ?", tanggal, unhex(experimentKey)).Scan(&impression, &cta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if impression != want[0] || cta != want[1] {
+			t.Errorf("%s: %d impressions and %d ctas, want %v", tanggal, impression, cta, want)
+		}
+	}
+}
+
+func TestSQLiteShardMap(t *testing.T) {
+	repos, _ := newSQLiteRepositories(t)
+	experimentKey := util.EncodeString("e_home_fb")
+
+	if _, err := repos.Shards.Table(experimentKey); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unpinned experiment: %v, want ErrNotFound", err)
+	}
+	if pinned, err := repos.Shards.Pin(experimentKey, "e_home_fb", "z_rotator_variant_history_10"); err != nil || !pinned {
+		t.Fatalf("pinned %v: %v", pinned, err)
+	}
+	if pinned, err := repos.Shards.Pin(experimentKey, "e_home_fb", "z_rotator_variant_history_20"); err != nil || pinned {
+		t.Fatalf("pinned twice %v: %v", pinned, err)
+	}
+	if err := repos.Shards.Set(experimentKey, "e_home_fb", "z_rotator_variant_history_30"); err != nil {
+		t.Fatal(err)
+	}
+	if table, err := repos.Shards.Table(experimentKey); err != nil || table != "z_rotator_variant_history_30" {
+		t.Errorf("table %s: %v", table, err)
+	}
+}
+
+func TestSQLiteNoncesAndEvents(t *testing.T) {
+	repos, db := newSQLiteRepositories(t)
+	nonce := util.EncodeString("n-1")
+
+	if fresh, err := repos.Pages.UseNonce(3, nonce); err != nil || !fresh {
+		t.Fatalf("first use fresh %v: %v", fresh, err)
+	}
+	if fresh, err := repos.Pages.UseNonce(3, nonce); err != nil || fresh {
+		t.Fatalf("replay fresh %v: %v", fresh, err)
+	}
+	if err := repos.Pages.ReleaseNonce(3, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if fresh, err := repos.Pages.UseNonce(3, nonce); err != nil || !fresh {
+		t.Fatalf("use after release fresh %v: %v", fresh, err)
+	}
+
+	// a nonce from before the window
+	if _, err := db.Exec("UPDATE z_rotator_postback_nonce SET created = ?", time.Now().Add(-time.Hour).Format(timeFormat)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos.Pages.UseNonce(3, util.EncodeString("n-2")); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := repos.Pages.PurgeNonces(time.Now().Add(-10 * time.Minute)); err != nil || purged != 1 {
+		t.Errorf("purged %d nonces: %v", purged, err)
+	}
+	if fresh, err := repos.Pages.UseNonce(3, util.EncodeString("n-2")); err != nil || fresh {
+		t.Errorf("recent nonce purged, fresh %v: %v", fresh, err)
+	}
+
+	dedupKey, experimentKey := util.EncodeString("id:e_home_fb:1"), util.EncodeString("e_home_fb")
+	for i, want := range []bool{true, false} {
+		if fresh, err := repos.History.MarkEvent(dedupKey, experimentKey); err != nil || fresh != want {
+			t.Errorf("mark %d fresh %v: %v", i, fresh, err)
+		}
+	}
+	if err := repos.History.UnmarkEvent(dedupKey); err != nil {
+		t.Fatal(err)
+	}
+	if fresh, err := repos.History.MarkEvent(dedupKey, experimentKey); err != nil || !fresh {
+		t.Errorf("mark after unmark fresh %v: %v", fresh, err)
+	}
+}
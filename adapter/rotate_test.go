@@ -0,0 +1,170 @@
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dennyaris/html-rotate/adapter/models"
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// rotateResponse is the body of a /rotate answer
+type rotateResponse struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    rotatorData `json:"data"`
+}
+
+func newRotateHandler(t *testing.T) (*Handler, *repository.Memory) {
+	t.Helper()
+
+	memory := repository.NewMemory()
+	err := memory.Repositories().Pages.Create(&models.Page{PageID: "r_home", PageKey: "r_home", UrlKey: "https://example.com/", Url: "https://example.com/", IsRotator: 1, UserID: 1, SiteID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory.AddRotatorPage("r_home", "p_1")
+	memory.AddRotatorPage("r_home", "p_2")
+
+	return &Handler{Repositories: memory.Repositories(), Cache: util.NewLRU(64)}, memory
+}
+
+func rotate(t *testing.T, h *Handler, pageUrl, ads, visitor string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	query := url.Values{"url": {pageUrl}, "ads": {ads}}
+	r := httptest.NewRequest(http.MethodGet, "/rotate?"+query.Encode(), nil)
+	if visitor != "" {
+		r.Header.Set(VisitorHeader, visitor)
+	}
+	w := httptest.NewRecorder()
+	return w, h.RotateHandler(w, r)
+}
+
+func TestRotateHandlerRequiresParams(t *testing.T) {
+	h, _ := newRotateHandler(t)
+
+	for _, c := range []struct{ url, ads string }{{"", "fb"}, {"https://example.com/", ""}} {
+		w, err := rotate(t, h, c.url, c.ads, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("url %q ads %q answered %d", c.url, c.ads, w.Code)
+		}
+	}
+}
+
+func TestRotateHandlerUnknownUrl(t *testing.T) {
+	h, _ := newRotateHandler(t)
+
+	_, err := rotate(t, h, "https://example.com/missing", "fb", "")
+	if !errors.Is(err, ErrPageNotFound) {
+		t.Fatalf("got %v, want ErrPageNotFound", err)
+	}
+	if status := ErrorStatus(err); status != http.StatusNotFound {
+		t.Errorf("answered %d", status)
+	}
+}
+
+func TestRotateHandlerServesRotator(t *testing.T) {
+	h, memory := newRotateHandler(t)
+
+	var served []string
+	for i := 0; i < 3; i++ {
+		w, err := rotate(t, h, "https://example.com/", "fb", "visitor-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("answered %d: %s", w.Code, w.Body)
+		}
+
+		var resp rotateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data.PageID != "r_home" || resp.Data.Fallback {
+			t.Fatalf("unexpected rotator data %+v", resp.Data)
+		}
+		served = append(served, resp.Data.SelectedVariant)
+	}
+
+	// the visitor keeps the page it was served first
+	experimentID := experimentIDFor("r_home", "fb")
+	if served[0] != variantIDFor(experimentID, "1") && served[0] != variantIDFor(experimentID, "2") {
+		t.Fatalf("served %s, want one of the rotator's pages", served[0])
+	}
+	for _, variantID := range served {
+		if variantID != served[0] {
+			t.Fatalf("served %v to one visitor", served)
+		}
+	}
+
+	vh, err := memory.Repositories().History.Stats(util.EncodeString(experimentID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var impressions uint
+	for _, v := range vh {
+		impressions += v.Impression
+	}
+	if len(vh) != 2 || impressions != 3 {
+		t.Errorf("stats %+v, want 3 impressions over the 2 pages", vh)
+	}
+
+	// editing an attached page finds the experiment to invalidate
+	keys, err := memory.Repositories().Experiments.KeysByPageID("p_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !strings.EqualFold(keys[0], util.EncodeString(experimentID)) {
+		t.Errorf("experiments of p_1 %v, want %s", keys, experimentID)
+	}
+}
+
+func TestRotateHandlerRotatorWithoutPages(t *testing.T) {
+	memory := repository.NewMemory()
+	err := memory.Repositories().Pages.Create(&models.Page{PageID: "r_empty", PageKey: "r_empty", UrlKey: "https://example.com/empty", Url: "https://example.com/empty", IsRotator: 1, UserID: 1, SiteID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{Repositories: memory.Repositories(), Cache: util.NewLRU(64)}
+
+	if _, err := rotate(t, h, "https://example.com/empty", "fb", "visitor-1"); !errors.Is(err, ErrNoVariants) {
+		t.Fatalf("got %v, want ErrNoVariants", err)
+	}
+}
+
+func TestRotateHandlerKeepsVisitorVariant(t *testing.T) {
+	h, memory := newRotateHandler(t)
+	experimentID := experimentIDFor("r_home", "fb")
+	seedExperiment(t, memory, experimentID, "weighted", "", []string{"p_1", "p_2", "p_3"}, []int{34, 33, 33})
+
+	for _, visitor := range []string{"visitor-1", "visitor-2", "visitor-3"} {
+		first := ""
+		for i := 0; i < 5; i++ {
+			w, err := rotate(t, h, "https://example.com/", "fb", visitor)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var resp rotateResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if first == "" {
+				first = resp.Data.SelectedVariant
+			}
+			if resp.Data.SelectedVariant != first {
+				t.Fatalf("%s was served %s then %s", visitor, first, resp.Data.SelectedVariant)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+func init() {
+	Register("legacy", func(json.RawMessage) (Sharder, error) { return Legacy{}, nil })
+	Register("crc32-mod", func(params json.RawMessage) (Sharder, error) {
+		shards, err := countParam("crc32-mod", params)
+		if err != nil {
+			return nil, err
+		}
+		return Modulo{Shards: shards}, nil
+	})
+	Register("consistent", func(params json.RawMessage) (Sharder, error) {
+		return newConsistentFromParams(params)
+	})
+	Register("single", func(params json.RawMessage) (Sharder, error) {
+		p := struct {
+			Shard int `json:"shard"`
+		}{}
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, fmt.Errorf("invalid single params: %v", err)
+			}
+		}
+		if p.Shard < 0 || p.Shard >= Count {
+			return nil, fmt.Errorf("single shard must be between 0 and %d", Count-1)
+		}
+		return Single{Index: p.Shard}, nil
+	})
+}
+
+// Legacy uses the first two decimal digits of the crc32 of the experiment id.
+// Leading digits aren't uniform, shards 10 to 42 get most experiments and 00
+// to 09 none, it is kept for the experiments placed before the other schemes.
+type Legacy struct{}
+
+func (Legacy) Shard(experimentID string) int {
+	digits := strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(experimentID))), 10)
+	if len(digits) < 2 {
+		// a crc below 10, the original slicing would have panicked
+		digits = "0" + digits
+	}
+
+	shard, _ := strconv.Atoi(digits[:2])
+	return shard
+}
+
+// Modulo spreads the experiments evenly over the first Shards shards with the
+// crc32 of their id. Changing Shards moves almost every experiment.
+type Modulo struct {
+	Shards int
+}
+
+func (m Modulo) Shard(experimentID string) int {
+	return int(crc32.ChecksumIEEE([]byte(experimentID)) % uint32(m.Shards))
+}
+
+// Consistent places the experiments on a hash ring holding Replicas points of
+// each of the first Shards shards. Adding or removing a shard only moves the
+// experiments of the ring arcs it gains or loses.
+type Consistent struct {
+	points []uint32
+	shards map[uint32]int
+}
+
+// ConsistentParams are the settings of the consistent scheme
+type ConsistentParams struct {
+	Shards   int `json:"shards"`
+	Replicas int `json:"replicas"`
+}
+
+func newConsistentFromParams(raw json.RawMessage) (*Consistent, error) {
+	shards, err := countParam("consistent", raw)
+	if err != nil {
+		return nil, err
+	}
+
+	params := ConsistentParams{Replicas: 64}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, fmt.Errorf("invalid consistent params: %v", err)
+		}
+	}
+	if params.Replicas < 1 {
+		return nil, fmt.Errorf("consistent replicas must be positive")
+	}
+
+	return NewConsistent(shards, params.Replicas), nil
+}
+
+func NewConsistent(shards, replicas int) *Consistent {
+	c := &Consistent{shards: make(map[uint32]int, shards*replicas)}
+	for shard := 0; shard < shards; shard++ {
+		for i := 0; i < replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%02d#%d", shard, i)))
+			if _, taken := c.shards[point]; taken {
+				continue
+			}
+			c.shards[point] = shard
+			c.points = append(c.points, point)
+		}
+	}
+	sort.Slice(c.points, func(i, j int) bool { return c.points[i] < c.points[j] })
+
+	return c
+}
+
+func (c *Consistent) Shard(experimentID string) int {
+	hash := crc32.ChecksumIEEE([]byte(experimentID))
+	i := sort.Search(len(c.points), func(i int) bool { return c.points[i] >= hash })
+	if i == len(c.points) {
+		i = 0
+	}
+
+	return c.shards[c.points[i]]
+}
+
+// Single keeps every experiment in one table
+type Single struct {
+	Index int
+}
+
+func (s Single) Shard(string) int {
+	return s.Index
+}
@@ -0,0 +1,184 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"testing"
+)
+
+// experimentIDs are ids shaped like the ones the service derives from
+// rotator ids and ads names
+func experimentIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("e_%d_ads%d", i, i%7)
+	}
+	return ids
+}
+
+// baselineTable is the table choice the service shipped with, before the
+// schemes existed
+func baselineTable(experimentID string) string {
+	crc := crc32.ChecksumIEEE([]byte(experimentID))
+	return "z_rotator_variant_history_" + strconv.FormatUint(uint64(crc), 10)[:2]
+}
+
+func TestLegacyMatchesBaseline(t *testing.T) {
+	for _, id := range experimentIDs(5000) {
+		if got, want := TableFor(Legacy{}, id), baselineTable(id); got != want {
+			t.Fatalf("%s: legacy placed it in %s, the baseline in %s", id, got, want)
+		}
+	}
+}
+
+func TestSchemeTables(t *testing.T) {
+	consistent, err := newConsistentFromParams(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		sharder      Sharder
+		experimentID string
+		table        string
+	}{
+		{Legacy{}, "e_home_fb", "z_rotator_variant_history_28"},
+		{Legacy{}, "e_landing_tiktok", "z_rotator_variant_history_33"},
+		{Legacy{}, "e_promo_ig", "z_rotator_variant_history_14"},
+		{Modulo{Shards: 100}, "e_home_fb", "z_rotator_variant_history_27"},
+		{Modulo{Shards: 100}, "e_landing_tiktok", "z_rotator_variant_history_01"},
+		{Modulo{Shards: 100}, "e_promo_ig", "z_rotator_variant_history_85"},
+		{consistent, "e_home_fb", "z_rotator_variant_history_27"},
+		{consistent, "e_123_ads", "z_rotator_variant_history_92"},
+		{consistent, "e_promo_ig", "z_rotator_variant_history_87"},
+		{Single{Index: 7}, "e_home_fb", "z_rotator_variant_history_07"},
+		{Single{Index: 7}, "e_promo_ig", "z_rotator_variant_history_07"},
+	}
+
+	for _, c := range cases {
+		if got := TableFor(c.sharder, c.experimentID); got != c.table {
+			t.Errorf("%T %s: %s, want %s", c.sharder, c.experimentID, got, c.table)
+		}
+	}
+}
+
+func TestSchemesStayInRange(t *testing.T) {
+	sharders := map[string]Sharder{
+		"legacy":        Legacy{},
+		"crc32-mod 100": Modulo{Shards: 100},
+		"crc32-mod 16":  Modulo{Shards: 16},
+		"consistent 16": NewConsistent(16, 64),
+	}
+	limits := map[string]int{"legacy": Count, "crc32-mod 100": 100, "crc32-mod 16": 16, "consistent 16": 16}
+
+	for name, sharder := range sharders {
+		counts := make([]int, Count)
+		for _, id := range experimentIDs(20000) {
+			s := sharder.Shard(id)
+			if s < 0 || s >= limits[name] {
+				t.Fatalf("%s placed %s in shard %d", name, id, s)
+			}
+			counts[s]++
+		}
+
+		if name == "legacy" {
+			continue
+		}
+		// the even schemes keep every shard within half of its fair share
+		fair := 20000 / limits[name]
+		for s := 0; s < limits[name]; s++ {
+			if counts[s] < fair/2 || counts[s] > fair*3/2 {
+				t.Errorf("%s shard %d got %d experiments, fair share %d", name, s, counts[s], fair)
+			}
+		}
+	}
+}
+
+func TestConsistentRingStability(t *testing.T) {
+	before, after := NewConsistent(10, 64), NewConsistent(11, 64)
+
+	moved := 0
+	ids := experimentIDs(20000)
+	for _, id := range ids {
+		from, to := before.Shard(id), after.Shard(id)
+		if from == to {
+			continue
+		}
+		moved++
+		if to != 10 {
+			t.Fatalf("%s moved from shard %d to %d, only the new shard may gain experiments", id, from, to)
+		}
+	}
+
+	// about 1/11 of the experiments belong to the new shard
+	if share := float64(moved) / float64(len(ids)); share < 0.04 || share > 0.16 {
+		t.Errorf("adding a shard moved %.3f of the experiments", share)
+	}
+
+	// removing it moves them back
+	for _, id := range ids {
+		if after.Shard(id) != 10 && after.Shard(id) != before.Shard(id) {
+			t.Fatalf("%s changed shard without moving to the new one", id)
+		}
+	}
+}
+
+func TestModuloMovesMostWhenResized(t *testing.T) {
+	moved := 0
+	ids := experimentIDs(5000)
+	for _, id := range ids {
+		if (Modulo{Shards: 10}).Shard(id) != (Modulo{Shards: 11}).Shard(id) {
+			moved++
+		}
+	}
+	if moved < len(ids)/2 {
+		t.Errorf("resizing crc32-mod moved only %d of %d experiments", moved, len(ids))
+	}
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		name   string
+		params string
+		fails  bool
+	}{
+		{name: ""},
+		{name: "legacy"},
+		{name: "crc32-mod"},
+		{name: "crc32-mod", params: `{"shards":16}`},
+		{name: "crc32-mod", params: `{"shards":0}`, fails: true},
+		{name: "crc32-mod", params: `{"shards":101}`, fails: true},
+		{name: "crc32-mod", params: `{"shards":"16"}`, fails: true},
+		{name: "consistent", params: `{"shards":8,"replicas":16}`},
+		{name: "consistent", params: `{"replicas":0}`, fails: true},
+		{name: "single", params: `{"shard":99}`},
+		{name: "single", params: `{"shard":100}`, fails: true},
+		{name: "single", params: `{"shard":-1}`, fails: true},
+		{name: "range", fails: true},
+	}
+
+	for _, c := range cases {
+		var params json.RawMessage
+		if c.params != "" {
+			params = json.RawMessage(c.params)
+		}
+		sharder, err := New(c.name, params)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%s %s: expected an error", c.name, c.params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", c.name, c.params, err)
+			continue
+		}
+		if c.name == "" {
+			if _, ok := sharder.(Legacy); !ok {
+				t.Errorf("the default scheme is %T, want Legacy", sharder)
+			}
+		}
+	}
+}
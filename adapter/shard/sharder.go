@@ -0,0 +1,103 @@
+// Package shard decides which variant history table, z_rotator_variant_history_00
+// to z_rotator_variant_history_99, holds the daily rows of an experiment.
+// Schemes are registered by name like the bandit strategies.
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dennyaris/html-rotate/migrations"
+)
+
+// TablePrefix is the name of the history tables without their shard suffix
+const TablePrefix = "z_rotator_variant_history_"
+
+// Count is the number of history tables created by the migrations
+const Count = migrations.HistoryShards
+
+// Sharder places the history of an experiment in a shard
+type Sharder interface {
+	// Shard returns the shard of the experiment, between 0 and Count-1
+	Shard(experimentID string) int
+}
+
+// Table returns the history table of a shard
+func Table(shard int) string {
+	return fmt.Sprintf("%s%02d", TablePrefix, shard)
+}
+
+// TableFor returns the history table the sharder places the experiment in
+func TableFor(sharder Sharder, experimentID string) string {
+	return Table(sharder.Shard(experimentID))
+}
+
+// Factory builds a Sharder from its raw params
+type Factory func(params json.RawMessage) (Sharder, error)
+
+// DefaultScheme keeps the placement the service always had
+const DefaultScheme = "legacy"
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a scheme available by name. Registering the same name twice
+// replaces the previous factory.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry[name] = factory
+}
+
+// New returns the scheme registered under name, or the default scheme when
+// name is empty
+func New(name string, params json.RawMessage) (Sharder, error) {
+	if name == "" {
+		name = DefaultScheme
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sharding scheme: %s", name)
+	}
+
+	return factory(params)
+}
+
+// Names returns the registered scheme names in sorted order
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// countParam reads the shards param of a scheme, Count when it is missing
+func countParam(scheme string, raw json.RawMessage) (int, error) {
+	params := struct {
+		Shards int `json:"shards"`
+	}{Shards: Count}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return 0, fmt.Errorf("invalid %s params: %v", scheme, err)
+		}
+	}
+	if params.Shards < 1 || params.Shards > Count {
+		return 0, fmt.Errorf("%s shards must be between 1 and %d", scheme, Count)
+	}
+
+	return params.Shards, nil
+}
@@ -0,0 +1,56 @@
+package adapter
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/adapter/shard"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// HistorySharder places the variant history of new experiments. Experiments
+// already pinned in z_rotator_shard_map keep their table until resharded.
+var HistorySharder shard.Sharder = shard.Legacy{}
+
+// ShardCacheTTL is how long the table of an experiment is cached, a reshard
+// waits longer than this before its last sweep of the old table
+var ShardCacheTTL = 60 * time.Second
+
+// historyTable returns the variant history table of an experiment. An
+// experiment without a table is pinned on first use: experiments created
+// before the shard map to their legacy shard, where their rows are, and new
+// ones to the table of HistorySharder.
+func (h *Handler) historyTable(experimentID, experimentKeyHex string) (string, error) {
+	value, err := h.loads.GetOrLoad(h.Cache, util.ShardCacheKey(experimentKeyHex), ShardCacheTTL, func() ([]byte, error) {
+		table, err := pinnedTable(h.Repositories, experimentID, experimentKeyHex)
+		return []byte(table), err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+func pinnedTable(repos repository.Repositories, experimentID, experimentKeyHex string) (string, error) {
+	table, err := repos.Shards.Table(experimentKeyHex)
+	if !errors.Is(err, repository.ErrNotFound) {
+		return table, err
+	}
+
+	table = shard.TableFor(HistorySharder, experimentID)
+	_, err = repos.Experiments.Get(experimentKeyHex)
+	if err == nil {
+		table = shard.TableFor(shard.Legacy{}, experimentID)
+	} else if !errors.Is(err, repository.ErrNotFound) {
+		return "", err
+	}
+
+	if _, err := repos.Shards.Pin(experimentKeyHex, experimentID, table); err != nil {
+		return "", err
+	}
+
+	// a concurrent pin may have won
+	return repos.Shards.Table(experimentKeyHex)
+}
@@ -0,0 +1,48 @@
+package adapter
+
+import (
+	"testing"
+
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/adapter/shard"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+func TestHistoryTablePinning(t *testing.T) {
+	defer func(sharder shard.Sharder) { HistorySharder = sharder }(HistorySharder)
+	HistorySharder = shard.Single{Index: 5}
+
+	memory := repository.NewMemory()
+	seedExperiment(t, memory, "e_home_fb", "", "", []string{"p_1"}, nil)
+	if _, err := memory.Repositories().Shards.Pin(util.EncodeString("e_promo_ig"), "e_promo_ig", "z_rotator_variant_history_50"); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{Repositories: memory.Repositories(), Cache: util.NewLRU(64)}
+
+	cases := []struct {
+		name         string
+		experimentID string
+		table        string
+	}{
+		// created before the shard map, its rows are on the legacy shard
+		{"existing experiment", "e_home_fb", "z_rotator_variant_history_28"},
+		{"new experiment", "e_landing_tiktok", "z_rotator_variant_history_05"},
+		{"pinned experiment", "e_promo_ig", "z_rotator_variant_history_50"},
+	}
+
+	for _, c := range cases {
+		key := util.EncodeString(c.experimentID)
+		table, err := h.historyTable(c.experimentID, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table != c.table {
+			t.Errorf("%s: table %s, want %s", c.name, table, c.table)
+		}
+
+		pinned, err := memory.Repositories().Shards.Table(key)
+		if err != nil || pinned != c.table {
+			t.Errorf("%s: pinned to %q (%v), want %s", c.name, pinned, err, c.table)
+		}
+	}
+}
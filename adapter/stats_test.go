@@ -0,0 +1,156 @@
+package adapter
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/adapter/shard"
+	"github.com/dennyaris/html-rotate/migrations"
+	"github.com/dennyaris/html-rotate/util"
+	_ "modernc.org/sqlite"
+)
+
+// migrateSQLite applies the first n sqlite migrations, every one when n is
+// zero
+func migrateSQLite(t *testing.T, db *sql.DB, n int) {
+	t.Helper()
+
+	migrator, err := migrations.New(db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > 0 {
+		migrator.Migrations = migrator.Migrations[:n]
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "rotator.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// seedLegacyExperiment writes a rotator experiment the way the service did
+// before the totals table: one variant and its daily history rows
+func seedLegacyExperiment(t *testing.T, db *sql.DB, url, rotatorID, adsName string) (string, string) {
+	t.Helper()
+
+	experimentID := experimentIDFor(rotatorID, adsName)
+	variantID := variantIDFor(experimentID, rotatorID)
+	table := shard.TableFor(shard.Legacy{}, experimentID)
+	key := func(s string) []byte {
+		b, _ := hex.DecodeString(util.EncodeString(s))
+		return b
+	}
+
+	stmts := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"INSERT INTO page (page_id, page_key, url_key, url, is_rotator, user_id, site_id, created) VALUES (?, ?, ?, ?, 1, 1, 1, '2024-01-01 00:00:00')",
+			[]interface{}{rotatorID, key(rotatorID), key(url), url}},
+		{"INSERT INTO z_rotator_experiment (experiment_id, experiment_key, ads_name, rotator_id, rotator_key) VALUES (?, ?, ?, ?, ?)",
+			[]interface{}{experimentID, key(experimentID), adsName, rotatorID, key(rotatorID)}},
+		{"INSERT INTO z_rotator_variant (variant_id, variant_key, experiment_id, experiment_key, page_id, page_key) VALUES (?, ?, ?, ?, ?, ?)",
+			[]interface{}{variantID, key(variantID), experimentID, key(experimentID), rotatorID, key(rotatorID)}},
+		{"INSERT INTO " + table + " (tanggal, experiment_id, experiment_key, variant_id, variant_key, impression, cta) VALUES ('2024-01-01', ?, ?, ?, ?, 60, 6)",
+			[]interface{}{experimentID, key(experimentID), variantID, key(variantID)}},
+		{"INSERT INTO " + table + " (tanggal, experiment_id, experiment_key, variant_id, variant_key, impression, cta) VALUES ('2024-01-02', ?, ?, ?, ?, 40, 4)",
+			[]interface{}{experimentID, key(experimentID), variantID, key(variantID)}},
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt.query, stmt.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return experimentID, variantID
+}
+
+func TestEventBeforeFirstRotateKeepsHistory(t *testing.T) {
+	db := openSQLite(t)
+	migrateSQLite(t, db, 1)
+	experimentID, variantID := seedLegacyExperiment(t, db, "https://example.com/", "r_old", "fb")
+	migrateSQLite(t, db, 0)
+
+	repos, err := repository.New("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{Repositories: repos, Cache: util.NewLRU(64)}
+
+	// a conversion reaches the totals before the experiment's first rotation
+	body := `{"experiment":"` + experimentID + `","variant":"` + variantID + `","event_type":"cta"}`
+	w := httptest.NewRecorder()
+	if err := h.EventHandler(w, httptest.NewRequest(http.MethodPost, "/event", bytes.NewBufferString(body))); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("event answered %d: %s", w.Code, w.Body)
+	}
+
+	if _, err := rotate(t, h, "https://example.com/", "fb", "visitor-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rotation read the totals before counting its own impression
+	vh, err := h.cachedVariantHistory(util.EncodeString(experimentID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vh) != 1 || vh[0].Impression != 100 || vh[0].CTA != 11 {
+		t.Fatalf("the rotation read %+v, want the history totals and the new cta", vh)
+	}
+
+	vh, err = repos.History.Stats(util.EncodeString(experimentID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vh) != 1 || vh[0].Impression != 101 || vh[0].CTA != 11 {
+		t.Fatalf("totals %+v after the rotation, want 101 impressions and 11 ctas", vh)
+	}
+}
+
+func TestBackfillMigrationRepairsPartialTotals(t *testing.T) {
+	db := openSQLite(t)
+	migrateSQLite(t, db, 1)
+	experimentID, variantID := seedLegacyExperiment(t, db, "https://example.com/", "r_old", "fb")
+	migrateSQLite(t, db, 7)
+
+	repos, err := repository.New("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what a deploy without the backfill migration recorded: a totals row
+	// holding only the event counted since
+	err = repos.History.Increment(shard.TableFor(shard.Legacy{}, experimentID), "cta", "2024-02-01",
+		experimentID, util.EncodeString(experimentID), variantID, util.EncodeString(variantID), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrateSQLite(t, db, 0)
+
+	vh, err := repos.History.Stats(util.EncodeString(experimentID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vh) != 1 || vh[0].Impression != 100 || vh[0].CTA != 11 {
+		t.Fatalf("totals %+v, want 100 impressions and 11 ctas", vh)
+	}
+}
@@ -0,0 +1,135 @@
+package adapter
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// AllowedRedirectHosts are the hosts /click may redirect to, a host also
+// allows its subdomains. An empty list rejects every redirect.
+var AllowedRedirectHosts []string
+
+// trackingEvents are the event types the pixel and click endpoints record
+var trackingEvents = map[string]bool{
+	"cta":  true,
+	"lead": true,
+}
+
+// transparentGIF is a 1x1 transparent GIF
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+var errTrackingEvent = errors.New("event must be cta or lead")
+
+// PixelHandler records an event and always answers with a transparent GIF
+// so a broken tracking call never shows up on the landing page
+func (h *Handler) PixelHandler(w http.ResponseWriter, r *http.Request) error {
+	event, err := trackingEvent(r, "lead")
+	if err == nil {
+		err = h.recordEvent(event)
+	}
+	if err != nil && !ignoredEvent(err) {
+		log.Printf("error recording pixel event : %v", err)
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	w.WriteHeader(http.StatusOK)
+	w.Write(transparentGIF)
+
+	return nil
+}
+
+// ClickHandler records a CTA event and redirects the visitor to the "to"
+// param, which must point to an allowed host
+func (h *Handler) ClickHandler(w http.ResponseWriter, r *http.Request) error {
+	to := strings.TrimSpace(r.URL.Query().Get("to"))
+	if to == "" {
+		util.ResponseError(w, "params to is empty!", http.StatusBadRequest)
+		return nil
+	}
+	if !redirectAllowed(to) {
+		util.ResponseError(w, "redirect target is not allowed", http.StatusBadRequest)
+		return nil
+	}
+
+	event, err := trackingEvent(r, "cta")
+	if err == nil {
+		err = h.recordEvent(event)
+	}
+	if err != nil && !ignoredEvent(err) {
+		log.Printf("error recording click event : %v", err)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, to, http.StatusFound)
+
+	return nil
+}
+
+// trackingEvent builds the event from the query params, defaultType is used
+// when the request doesn't name an event type
+func trackingEvent(r *http.Request, defaultType string) (Event, error) {
+	query := r.URL.Query()
+
+	event := Event{
+		EventID:    strings.TrimSpace(query.Get("event_id")),
+		Experiment: strings.TrimSpace(query.Get("experiment")),
+		Variant:    strings.TrimSpace(query.Get("variant")),
+		EventType:  strings.ToLower(strings.TrimSpace(query.Get("event"))),
+		Visitor:    requestVisitorID(r),
+		Fallback:   query.Get("fallback") == "1" || query.Get("fallback") == "true",
+	}
+	if event.EventType == "" {
+		event.EventType = defaultType
+	}
+
+	if event.Experiment == "" {
+		return Event{}, errors.New("params experiment is empty")
+	}
+	if !trackingEvents[event.EventType] {
+		return Event{}, errTrackingEvent
+	}
+
+	return event, nil
+}
+
+// ignoredEvent reports whether err only means the event wasn't counted on
+// purpose
+func ignoredEvent(err error) bool {
+	return errors.Is(err, errDuplicateEvent) || errors.Is(err, errFallbackEvent)
+}
+
+// redirectAllowed reports whether target is an absolute http(s) URL on one of
+// the AllowedRedirectHosts
+func redirectAllowed(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return false
+	}
+
+	for _, allowed := range AllowedRedirectHosts {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "" {
+			continue
+		}
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,145 @@
+package adapter
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dennyaris/html-rotate/adapter/repository"
+)
+
+// Visitor identification, checked in this order: query param, header, cookie
+const (
+	VisitorParam  = "visitor"
+	VisitorHeader = "X-Visitor-ID"
+	VisitorCookie = "rotator_vid"
+
+	visitorCookieMaxAge = 365 * 24 * 60 * 60
+)
+
+// requestVisitorID returns the ID of the visitor making the request, or an
+// empty string when the request doesn't carry one
+func requestVisitorID(r *http.Request) string {
+	if visitor := strings.TrimSpace(r.URL.Query().Get(VisitorParam)); visitor != "" {
+		return visitor
+	}
+	if visitor := strings.TrimSpace(r.Header.Get(VisitorHeader)); visitor != "" {
+		return visitor
+	}
+	if cookie, err := r.Cookie(VisitorCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// visitorID returns the ID of the visitor making the request. A visitor
+// without one gets a new random ID stored in a cookie so the next visit
+// is recognised, issued is then true.
+func visitorID(w http.ResponseWriter, r *http.Request) (visitor string, issued bool) {
+	if visitor := requestVisitorID(r); visitor != "" {
+		return visitor, false
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("error generating visitor id : %v", err)
+		return "", false
+	}
+	visitor = hex.EncodeToString(buf)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     VisitorCookie,
+		Value:    visitor,
+		Path:     "/",
+		MaxAge:   visitorCookieMaxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return visitor, true
+}
+
+func stickyCacheKey(experimentKeyHex, visitorKeyHex string) string {
+	return "sticky_" + experimentKeyHex[:32] + visitorKeyHex[:32]
+}
+
+func visitorKey(visitor string) string {
+	hash := sha256.Sum256([]byte(visitor))
+	return hex.EncodeToString(hash[:])
+}
+
+// stickyVariant returns the variant previously served to the visitor in the
+// experiment, the cache is checked first and the DB is the fallback. An
+// empty string means the visitor has no assignment yet.
+func (h *Handler) stickyVariant(experimentKeyHex, visitor string) (string, error) {
+	if visitor == "" {
+		return "", nil
+	}
+
+	visitorKeyHex := visitorKey(visitor)
+	cacheKey := stickyCacheKey(experimentKeyHex, visitorKeyHex)
+
+	value, err := h.Cache.Get(cacheKey)
+	if err == nil && len(value) > 0 {
+		return string(value), nil
+	}
+
+	variantID, err := h.Experiments.Assignment(experimentKeyHex, visitorKeyHex)
+	if errors.Is(err, repository.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := h.Cache.Set(cacheKey, []byte(variantID), 0); err != nil {
+		log.Printf("error set cache : %v", err)
+	}
+
+	return variantID, nil
+}
+
+// saveStickyVariant stores the variant served to the visitor for the
+// lifetime of the experiment. When another request stored an assignment
+// first that one wins and is returned.
+func (h *Handler) saveStickyVariant(experimentKeyHex, visitor, variantID string) (string, error) {
+	if visitor == "" || variantID == "" {
+		return variantID, nil
+	}
+
+	visitorKeyHex := visitorKey(visitor)
+
+	inserted, err := h.Experiments.InsertAssignment(experimentKeyHex, visitorKeyHex, variantID)
+	if err != nil {
+		return "", err
+	}
+	if !inserted {
+		variantID, err = h.Experiments.Assignment(experimentKeyHex, visitorKeyHex)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := h.Cache.Set(stickyCacheKey(experimentKeyHex, visitorKeyHex), []byte(variantID), 0); err != nil {
+		log.Printf("error set cache : %v", err)
+	}
+
+	return variantID, nil
+}
+
+// clearStickyVariant removes the visitor's assignment so a new variant can be
+// assigned
+func (h *Handler) clearStickyVariant(experimentKeyHex, visitor string) error {
+	visitorKeyHex := visitorKey(visitor)
+
+	if err := h.Cache.Delete(stickyCacheKey(experimentKeyHex, visitorKeyHex)); err != nil {
+		log.Printf("error delete cache : %v", err)
+	}
+
+	return h.Experiments.DeleteAssignment(experimentKeyHex, visitorKeyHex)
+}
@@ -0,0 +1,460 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/bandit"
+	"github.com/dennyaris/html-rotate/adapter/shard"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of every environment variable read by Load
+const EnvPrefix = "ROTATOR_"
+
+// Config is the service configuration. It is built from the defaults, then
+// the config file, then the environment variables, each overriding the
+// previous one.
+type Config struct {
+	Server   ServerConfig   `yaml:"server" json:"server"`
+	Database DatabaseConfig `yaml:"database" json:"database"`
+	Cache    CacheConfig    `yaml:"cache" json:"cache"`
+	Bandit   BanditConfig   `yaml:"bandit" json:"bandit"`
+	Tracking TrackingConfig `yaml:"tracking" json:"tracking"`
+	Fallback FallbackConfig `yaml:"fallback" json:"fallback"`
+	Sharding ShardingConfig `yaml:"sharding" json:"sharding"`
+}
+
+type ServerConfig struct {
+	Addr            string   `yaml:"addr" json:"addr"`
+	ReadTimeout     Duration `yaml:"read_timeout" json:"read_timeout"`
+	WriteTimeout    Duration `yaml:"write_timeout" json:"write_timeout"`
+	IdleTimeout     Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	// AdminToken is the bearer token of the /api routes and /flushall, they
+	// are disabled when it is empty
+	AdminToken string `yaml:"admin_token" json:"admin_token"`
+}
+
+type DatabaseConfig struct {
+	// Driver is mysql, postgres, sqlite, or memory to keep every table in
+	// process and lose it on restart
+	Driver string `yaml:"driver" json:"driver"`
+	// DSN overrides the connection built from User, Password, Host, Port
+	// and Name. For sqlite it is the database file.
+	DSN             string   `yaml:"dsn" json:"dsn"`
+	User            string   `yaml:"user" json:"user"`
+	Password        string   `yaml:"password" json:"password"`
+	Host            string   `yaml:"host" json:"host"`
+	Port            string   `yaml:"port" json:"port"`
+	Name            string   `yaml:"name" json:"name"`
+	MaxOpenConns    int      `yaml:"max_open_conns" json:"max_open_conns"`
+	MaxIdleConns    int      `yaml:"max_idle_conns" json:"max_idle_conns"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime" json:"conn_max_lifetime"`
+}
+
+type CacheConfig struct {
+	// Backend is one of memcached, tiered, lru or noop
+	Backend string `yaml:"backend" json:"backend"`
+	// Addr is the memcached server
+	Addr string `yaml:"addr" json:"addr"`
+	// Size is the entry capacity of the in process LRU
+	Size int `yaml:"size" json:"size"`
+	// L1TTL is how long the tiered backend keeps an entry in process, so
+	// also how long another instance can serve it after an invalidation
+	L1TTL         Duration `yaml:"l1_ttl" json:"l1_ttl"`
+	PageTTL       Duration `yaml:"page_ttl" json:"page_ttl"`
+	ExperimentTTL Duration `yaml:"experiment_ttl" json:"experiment_ttl"`
+	// ShardTTL is the lifetime of the cached history table of an experiment
+	ShardTTL Duration `yaml:"shard_ttl" json:"shard_ttl"`
+}
+
+type BanditConfig struct {
+	// Strategy and Params are used by experiments that don't name a strategy
+	Strategy string          `yaml:"strategy" json:"strategy"`
+	Params   json.RawMessage `yaml:"-" json:"params"`
+	// ImpressionFlushInterval is how often buffered impressions are written
+	ImpressionFlushInterval Duration `yaml:"impression_flush_interval" json:"impression_flush_interval"`
+}
+
+type TrackingConfig struct {
+	// RedirectHosts are the hosts /click may redirect to, subdomains included
+	RedirectHosts  []string `yaml:"redirect_hosts" json:"redirect_hosts"`
+	PostbackWindow Duration `yaml:"postback_window" json:"postback_window"`
+	EventDedupTTL  Duration `yaml:"event_dedup_ttl" json:"event_dedup_ttl"`
+}
+
+// FallbackConfig is the fail-open policy of /rotate when the DB or the cache
+// is unavailable. It lives in the config file rather than the DB so it can
+// be read while the DB is down.
+type FallbackConfig struct {
+	// Default applies to the rotators missing from Rotators
+	Default FallbackRule `yaml:"default" json:"default"`
+	// Rotators is keyed by rotator id
+	Rotators map[string]FallbackRule `yaml:"rotators" json:"rotators"`
+	// StaleSize is the entry capacity of the last known pages and variant
+	// histories read by the best and random policies
+	StaleSize int `yaml:"stale_size" json:"stale_size"`
+}
+
+type FallbackRule struct {
+	// Policy is one of none, control, best or random
+	Policy string `yaml:"policy" json:"policy"`
+	// ControlPage is the page id served by the control policy
+	ControlPage string `yaml:"control_page" json:"control_page"`
+}
+
+// ShardingConfig picks the variant history table of new experiments, the
+// table of an experiment is stored when it is first used and only changes
+// with the reshard command
+type ShardingConfig struct {
+	// Scheme is one of legacy, crc32-mod, consistent or single
+	Scheme string          `yaml:"scheme" json:"scheme"`
+	Params json.RawMessage `yaml:"-" json:"params"`
+}
+
+// Default returns the configuration used when nothing overrides it
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:            ":9090",
+			ReadTimeout:     Duration(5 * time.Second),
+			WriteTimeout:    Duration(10 * time.Second),
+			IdleTimeout:     Duration(60 * time.Second),
+			ShutdownTimeout: Duration(15 * time.Second),
+		},
+		Database: DatabaseConfig{
+			Driver:          "mysql",
+			User:            "root",
+			Host:            "localhost",
+			Port:            "3306",
+			Name:            "builder",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: Duration(5 * time.Minute),
+		},
+		Cache: CacheConfig{
+			Backend:       "tiered",
+			Addr:          "localhost:11211",
+			Size:          10000,
+			L1TTL:         Duration(2 * time.Second),
+			PageTTL:       Duration(60 * time.Second),
+			ExperimentTTL: Duration(10 * time.Second),
+			ShardTTL:      Duration(60 * time.Second),
+		},
+		Bandit: BanditConfig{
+			Strategy:                bandit.DefaultStrategy,
+			ImpressionFlushInterval: Duration(5 * time.Second),
+		},
+		Tracking: TrackingConfig{
+			PostbackWindow: Duration(5 * time.Minute),
+			EventDedupTTL:  Duration(24 * time.Hour),
+		},
+		Fallback: FallbackConfig{
+			Default:   FallbackRule{Policy: "none"},
+			StaleSize: 10000,
+		},
+		Sharding: ShardingConfig{
+			Scheme: shard.DefaultScheme,
+		},
+	}
+}
+
+// Load reads the config file at path, YAML or JSON by its extension, applies
+// the environment overrides and validates the result. An empty path only
+// uses the defaults and the environment.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			err = cfg.unmarshalYAML(data)
+		case ".json":
+			err = json.Unmarshal(data, cfg)
+		default:
+			err = fmt.Errorf("unsupported config file type: %s", path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading config %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// unmarshalYAML decodes a YAML config, the bandit and sharding params are
+// converted to JSON since that is what the strategies and schemes read
+func (c *Config) unmarshalYAML(data []byte) error {
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return err
+	}
+
+	var raw struct {
+		Bandit struct {
+			Params map[string]interface{} `yaml:"params"`
+		} `yaml:"bandit"`
+		Sharding struct {
+			Params map[string]interface{} `yaml:"params"`
+		} `yaml:"sharding"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw.Bandit.Params != nil {
+		params, err := json.Marshal(raw.Bandit.Params)
+		if err != nil {
+			return err
+		}
+		c.Bandit.Params = params
+	}
+	if raw.Sharding.Params != nil {
+		params, err := json.Marshal(raw.Sharding.Params)
+		if err != nil {
+			return err
+		}
+		c.Sharding.Params = params
+	}
+
+	return nil
+}
+
+// DataSourceName returns the DSN of the database, built for MySQL or Postgres
+// when DSN isn't set
+func (d DatabaseConfig) DataSourceName() string {
+	if d.DSN != "" {
+		return d.DSN
+	}
+
+	if d.Driver == "postgres" {
+		host := d.Host
+		if d.Port != "" {
+			host = net.JoinHostPort(d.Host, d.Port)
+		}
+		dsn := url.URL{Scheme: "postgres", User: url.UserPassword(d.User, d.Password), Host: host, Path: "/" + d.Name}
+		return dsn.String()
+	}
+
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", d.User, d.Password, d.Host, d.Port, d.Name)
+}
+
+// Validate checks the configuration is usable
+func (c *Config) Validate() error {
+	var errs []string
+
+	if c.Server.Addr == "" {
+		errs = append(errs, "server.addr is required")
+	}
+	if c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 || c.Server.ShutdownTimeout < 0 {
+		errs = append(errs, "server timeouts must not be negative")
+	}
+
+	switch c.Database.Driver {
+	case "mysql", "postgres":
+		if c.Database.DSN == "" && (c.Database.Host == "" || c.Database.Name == "") {
+			errs = append(errs, "database.dsn or database.host and database.name are required")
+		}
+	case "sqlite":
+		if c.Database.DSN == "" {
+			errs = append(errs, "database.dsn is required for the sqlite driver")
+		}
+	case "memory":
+	default:
+		errs = append(errs, "database.driver must be mysql, postgres, sqlite or memory")
+	}
+	if c.Database.MaxOpenConns < 0 || c.Database.MaxIdleConns < 0 {
+		errs = append(errs, "database pool sizes must not be negative")
+	}
+
+	switch c.Cache.Backend {
+	case "memcached", "tiered":
+		if c.Cache.Addr == "" {
+			errs = append(errs, "cache.addr is required for the "+c.Cache.Backend+" backend")
+		}
+	case "lru", "noop":
+	default:
+		errs = append(errs, "cache.backend must be one of memcached, tiered, lru or noop")
+	}
+	if c.Cache.Size < 0 {
+		errs = append(errs, "cache.size must not be negative")
+	}
+	if c.Cache.L1TTL < 0 || c.Cache.PageTTL < 0 || c.Cache.ExperimentTTL < 0 {
+		errs = append(errs, "cache TTLs must not be negative")
+	}
+	if c.Cache.ShardTTL <= 0 {
+		// a reshard waits for the cached tables to expire
+		errs = append(errs, "cache.shard_ttl must be positive")
+	}
+
+	if _, err := bandit.New(c.Bandit.Strategy, c.Bandit.Params); err != nil {
+		errs = append(errs, "bandit: "+err.Error())
+	}
+	if c.Bandit.ImpressionFlushInterval <= 0 {
+		errs = append(errs, "bandit.impression_flush_interval must be positive")
+	}
+
+	if c.Tracking.PostbackWindow <= 0 {
+		errs = append(errs, "tracking.postback_window must be positive")
+	}
+	if c.Tracking.EventDedupTTL < 0 {
+		errs = append(errs, "tracking.event_dedup_ttl must not be negative")
+	}
+
+	errs = append(errs, c.Fallback.Default.validate("fallback.default")...)
+	for rotatorID, rule := range c.Fallback.Rotators {
+		errs = append(errs, rule.validate("fallback.rotators."+rotatorID)...)
+	}
+	if c.Fallback.StaleSize < 0 {
+		errs = append(errs, "fallback.stale_size must not be negative")
+	}
+
+	if _, err := shard.New(c.Sharding.Scheme, c.Sharding.Params); err != nil {
+		errs = append(errs, "sharding: "+err.Error())
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (r FallbackRule) validate(path string) []string {
+	switch r.Policy {
+	case "control":
+		if r.ControlPage == "" {
+			return []string{path + ".control_page is required for the control policy"}
+		}
+	case "none", "best", "random":
+	default:
+		return []string{path + ".policy must be one of none, control, best or random"}
+	}
+
+	return nil
+}
+
+// applyEnv overrides the configuration with the ROTATOR_* environment
+// variables that are set
+func (c *Config) applyEnv() error {
+	vars := []struct {
+		name string
+		set  func(string) error
+	}{
+		{"SERVER_ADDR", setString(&c.Server.Addr)},
+		{"SERVER_READ_TIMEOUT", setDuration(&c.Server.ReadTimeout)},
+		{"SERVER_WRITE_TIMEOUT", setDuration(&c.Server.WriteTimeout)},
+		{"SERVER_IDLE_TIMEOUT", setDuration(&c.Server.IdleTimeout)},
+		{"SERVER_SHUTDOWN_TIMEOUT", setDuration(&c.Server.ShutdownTimeout)},
+		{"SERVER_ADMIN_TOKEN", setString(&c.Server.AdminToken)},
+
+		{"DB_DRIVER", setString(&c.Database.Driver)},
+		{"DB_DSN", setString(&c.Database.DSN)},
+		{"DB_USER", setString(&c.Database.User)},
+		{"DB_PASSWORD", setString(&c.Database.Password)},
+		{"DB_HOST", setString(&c.Database.Host)},
+		{"DB_PORT", setString(&c.Database.Port)},
+		{"DB_NAME", setString(&c.Database.Name)},
+		{"DB_MAX_OPEN_CONNS", setInt(&c.Database.MaxOpenConns)},
+		{"DB_MAX_IDLE_CONNS", setInt(&c.Database.MaxIdleConns)},
+		{"DB_CONN_MAX_LIFETIME", setDuration(&c.Database.ConnMaxLifetime)},
+
+		{"CACHE_BACKEND", setString(&c.Cache.Backend)},
+		{"CACHE_ADDR", setString(&c.Cache.Addr)},
+		{"CACHE_SIZE", setInt(&c.Cache.Size)},
+		{"CACHE_L1_TTL", setDuration(&c.Cache.L1TTL)},
+		{"CACHE_PAGE_TTL", setDuration(&c.Cache.PageTTL)},
+		{"CACHE_EXPERIMENT_TTL", setDuration(&c.Cache.ExperimentTTL)},
+		{"CACHE_SHARD_TTL", setDuration(&c.Cache.ShardTTL)},
+
+		{"BANDIT_STRATEGY", setString(&c.Bandit.Strategy)},
+		{"BANDIT_PARAMS", func(v string) error {
+			c.Bandit.Params = json.RawMessage(v)
+			return nil
+		}},
+		{"BANDIT_IMPRESSION_FLUSH_INTERVAL", setDuration(&c.Bandit.ImpressionFlushInterval)},
+
+		{"TRACKING_REDIRECT_HOSTS", func(v string) error {
+			c.Tracking.RedirectHosts = nil
+			for _, host := range strings.Split(v, ",") {
+				if host = strings.TrimSpace(host); host != "" {
+					c.Tracking.RedirectHosts = append(c.Tracking.RedirectHosts, host)
+				}
+			}
+			return nil
+		}},
+		{"TRACKING_POSTBACK_WINDOW", setDuration(&c.Tracking.PostbackWindow)},
+		{"TRACKING_EVENT_DEDUP_TTL", setDuration(&c.Tracking.EventDedupTTL)},
+
+		{"FALLBACK_POLICY", setString(&c.Fallback.Default.Policy)},
+		{"FALLBACK_CONTROL_PAGE", setString(&c.Fallback.Default.ControlPage)},
+		{"FALLBACK_STALE_SIZE", setInt(&c.Fallback.StaleSize)},
+
+		{"SHARDING_SCHEME", setString(&c.Sharding.Scheme)},
+		{"SHARDING_PARAMS", func(v string) error {
+			c.Sharding.Params = json.RawMessage(v)
+			return nil
+		}},
+	}
+
+	for _, v := range vars {
+		value, ok := os.LookupEnv(EnvPrefix + v.name)
+		if !ok {
+			continue
+		}
+		if err := v.set(value); err != nil {
+			return fmt.Errorf("invalid %s%s: %v", EnvPrefix, v.name, err)
+		}
+	}
+
+	return nil
+}
+
+func setString(dst *string) func(string) error {
+	return func(v string) error {
+		*dst = v
+		return nil
+	}
+}
+
+func setInt(dst *int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*dst = n
+		return nil
+	}
+}
+
+func setDuration(dst *Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*dst = Duration(d)
+		return nil
+	}
+}
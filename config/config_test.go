@@ -0,0 +1,215 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+		data string
+		env  map[string]string
+		// want edits the defaults into the expected config
+		want func(c *Config)
+		// err is part of the expected error
+		err string
+	}{
+		{
+			name: "defaults",
+			want: func(c *Config) {},
+		},
+		{
+			name: "yaml",
+			file: "config.yaml",
+			data: `
+server:
+  addr: ":8080"
+  read_timeout: 3s
+database:
+  driver: sqlite
+  dsn: rotator.db
+cache:
+  backend: lru
+  size: 500
+bandit:
+  strategy: epsilon-greedy
+  params:
+    epsilon: 0.2
+tracking:
+  redirect_hosts: [example.com, shop.example.com]
+fallback:
+  default:
+    policy: random
+  rotators:
+    r_home:
+      policy: control
+      control_page: p_1
+sharding:
+  scheme: crc32-mod
+  params:
+    shards: 16
+`,
+			want: func(c *Config) {
+				c.Server.Addr = ":8080"
+				c.Server.ReadTimeout = Duration(3 * time.Second)
+				c.Database.Driver, c.Database.DSN = "sqlite", "rotator.db"
+				c.Cache.Backend, c.Cache.Size = "lru", 500
+				c.Bandit.Strategy, c.Bandit.Params = "epsilon-greedy", json.RawMessage(`{"epsilon":0.2}`)
+				c.Tracking.RedirectHosts = []string{"example.com", "shop.example.com"}
+				c.Fallback.Default.Policy = "random"
+				c.Fallback.Rotators = map[string]FallbackRule{"r_home": {Policy: "control", ControlPage: "p_1"}}
+				c.Sharding.Scheme, c.Sharding.Params = "crc32-mod", json.RawMessage(`{"shards":16}`)
+			},
+		},
+		{
+			name: "json",
+			file: "config.json",
+			data: `{
+				"database": {"driver": "postgres", "host": "db", "port": "5432", "name": "rotator"},
+				"cache": {"backend": "noop", "experiment_ttl": "30s"},
+				"bandit": {"strategy": "thompson", "params": {"alpha0": 2}},
+				"tracking": {"postback_window": "1m"}
+			}`,
+			want: func(c *Config) {
+				c.Database.Driver, c.Database.Host, c.Database.Port, c.Database.Name = "postgres", "db", "5432", "rotator"
+				c.Cache.Backend, c.Cache.ExperimentTTL = "noop", Duration(30*time.Second)
+				c.Bandit.Strategy, c.Bandit.Params = "thompson", json.RawMessage(`{"alpha0": 2}`)
+				c.Tracking.PostbackWindow = Duration(time.Minute)
+			},
+		},
+		{
+			name: "env overrides the file",
+			file: "config.yaml",
+			data: `
+server:
+  addr: ":8080"
+cache:
+  backend: lru
+  l1_ttl: 1s
+tracking:
+  redirect_hosts: [example.com]
+`,
+			env: map[string]string{
+				"ROTATOR_SERVER_ADDR":             ":7070",
+				"ROTATOR_SERVER_ADMIN_TOKEN":      "t0ken",
+				"ROTATOR_CACHE_L1_TTL":            "5s",
+				"ROTATOR_DB_MAX_OPEN_CONNS":       "10",
+				"ROTATOR_TRACKING_REDIRECT_HOSTS": " a.example.com, ,b.example.com ",
+				"ROTATOR_SHARDING_SCHEME":         "single",
+				"ROTATOR_SHARDING_PARAMS":         `{"shard":3}`,
+			},
+			want: func(c *Config) {
+				c.Server.Addr, c.Server.AdminToken = ":7070", "t0ken"
+				c.Cache.Backend, c.Cache.L1TTL = "lru", Duration(5*time.Second)
+				c.Database.MaxOpenConns = 10
+				c.Tracking.RedirectHosts = []string{"a.example.com", "b.example.com"}
+				c.Sharding.Scheme, c.Sharding.Params = "single", json.RawMessage(`{"shard":3}`)
+			},
+		},
+		{
+			name: "unsupported file type",
+			file: "config.toml",
+			data: `addr = ":8080"`,
+			err:  "unsupported config file type",
+		},
+		{
+			name: "malformed duration",
+			file: "config.json",
+			data: `{"server": {"read_timeout": 5}}`,
+			err:  "duration must be a string",
+		},
+		{
+			name: "malformed env",
+			env:  map[string]string{"ROTATOR_CACHE_SIZE": "many"},
+			err:  "invalid ROTATOR_CACHE_SIZE",
+		},
+		{
+			name: "unknown driver",
+			env:  map[string]string{"ROTATOR_DB_DRIVER": "oracle"},
+			err:  "database.driver must be mysql, postgres, sqlite or memory",
+		},
+		{
+			name: "sqlite without a file",
+			env:  map[string]string{"ROTATOR_DB_DRIVER": "sqlite"},
+			err:  "database.dsn is required for the sqlite driver",
+		},
+		{
+			name: "control policy without a page",
+			file: "config.yaml",
+			data: "fallback:\n  rotators:\n    r_home:\n      policy: control\n",
+			err:  "fallback.rotators.r_home.control_page is required",
+		},
+		{
+			name: "unknown strategy",
+			env:  map[string]string{"ROTATOR_BANDIT_STRATEGY": "softmax"},
+			err:  "unknown bandit strategy",
+		},
+		{
+			name: "bad sharding params",
+			env:  map[string]string{"ROTATOR_SHARDING_SCHEME": "crc32-mod", "ROTATOR_SHARDING_PARAMS": `{"shards":0}`},
+			err:  "sharding:",
+		},
+		{
+			name: "every error is reported",
+			env:  map[string]string{"ROTATOR_CACHE_SHARD_TTL": "0s", "ROTATOR_TRACKING_POSTBACK_WINDOW": "0s"},
+			err:  "cache.shard_ttl must be positive; tracking.postback_window must be positive",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for name, value := range c.env {
+				t.Setenv(name, value)
+			}
+
+			path := ""
+			if c.file != "" {
+				path = filepath.Join(t.TempDir(), c.file)
+				if err := os.WriteFile(path, []byte(c.data), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg, err := Load(path)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("error %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := Default()
+			c.want(want)
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("config\n%+v\nwant\n%+v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestDataSourceName(t *testing.T) {
+	cases := []struct {
+		db   DatabaseConfig
+		want string
+	}{
+		{DatabaseConfig{Driver: "mysql", User: "root", Password: "pw", Host: "db", Port: "3306", Name: "builder"}, "root:pw@tcp(db:3306)/builder"},
+		{DatabaseConfig{Driver: "postgres", User: "rotator", Password: "p@ss", Host: "db", Port: "5432", Name: "rotator"}, "postgres://rotator:p%40ss@db:5432/rotator"},
+		{DatabaseConfig{Driver: "postgres", DSN: "postgres://other"}, "postgres://other"},
+	}
+
+	for _, c := range cases {
+		if got := c.db.DataSourceName(); got != c.want {
+			t.Errorf("%s: %s, want %s", c.db.Driver, got, c.want)
+		}
+	}
+}
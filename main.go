@@ -1,35 +1,44 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	con "github.com/dennyaris/html-rotate/adapter"
 	con_api "github.com/dennyaris/html-rotate/adapter/api"
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/adapter/shard"
+	"github.com/dennyaris/html-rotate/config"
 	"github.com/dennyaris/html-rotate/util"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
-)
-
-// DB Config
-const (
-	DBUser = "root"
-	DBPass = ""
-	DBHost = "localhost"
-	DBPort = "3306"
-	DBName = "builder"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 var db *sql.DB
 
-func connectDatabase() (*sql.DB, error) {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", DBUser, DBPass, DBHost, DBPort, DBName))
+func connectDatabase(cfg config.DatabaseConfig) (*sql.DB, error) {
+	db, err := sql.Open(cfg.Driver, cfg.DataSourceName())
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Driver == "sqlite" {
+		// SQLite takes one writer at a time, more connections only wait on
+		// its lock
+		cfg.MaxOpenConns = 1
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime.Duration())
 	return db, nil
 }
 
@@ -39,74 +48,196 @@ func disconnectDatabase(*sql.DB) {
 	}
 }
 
-// memcached config
-const (
-	MemcachedHost = "localhost"
-	MemcachedPort = "11211"
-)
-
 func main() {
-	var err error
-	db, err = connectDatabase() // Connect to the database
+	configPath := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "path to a YAML or JSON config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
 	if err != nil {
-		fmt.Println("Error connecting to the database:", err)
+		fmt.Println("Error loading the config:", err)
 		os.Exit(1)
 	}
-	defer disconnectDatabase(db) // Ensure the database connection is closed when main() exits
 
-	util.InitMemcached(fmt.Sprintf("%s:%s", MemcachedHost, MemcachedPort))
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(cfg, flag.Args()[1:]); err != nil {
+			fmt.Println("Error migrating the database:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "reshard" {
+		if err := runReshard(cfg, flag.Args()[1:]); err != nil {
+			fmt.Println("Error resharding the variant history:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var repos repository.Repositories
+	if cfg.Database.Driver == "memory" {
+		repos = repository.NewMemory().Repositories()
+	} else {
+		db, err = connectDatabase(cfg.Database) // Connect to the database
+		if err != nil {
+			fmt.Println("Error connecting to the database:", err)
+			os.Exit(1)
+		}
+		if err := checkSchema(db, cfg.Database.Driver); err != nil {
+			fmt.Println("Error checking the database schema:", err)
+			fmt.Println("Run the migrate command to update it")
+			os.Exit(1)
+		}
+		repos, err = repository.New(cfg.Database.Driver, db)
+		if err != nil {
+			fmt.Println("Error opening the repositories:", err)
+			os.Exit(1)
+		}
+	}
+
+	cache, err := util.NewCache(cfg.Cache.Backend, cfg.Cache.Addr, cfg.Cache.Size, cfg.Cache.L1TTL.Duration())
+	if err != nil {
+		fmt.Println("Error creating the cache:", err)
+		os.Exit(1)
+	}
+
+	con.PageCacheTTL = cfg.Cache.PageTTL.Duration()
+	con.ExperimentCacheTTL = cfg.Cache.ExperimentTTL.Duration()
+	con.ShardCacheTTL = cfg.Cache.ShardTTL.Duration()
+	con.DefaultStrategy = cfg.Bandit.Strategy
+	con.DefaultStrategyParams = cfg.Bandit.Params
+	con.AllowedRedirectHosts = cfg.Tracking.RedirectHosts
+	con.PostbackWindow = cfg.Tracking.PostbackWindow.Duration()
+	con.EventDedupTTL = cfg.Tracking.EventDedupTTL.Duration()
+	con.DefaultFallback = con.FallbackRule(cfg.Fallback.Default)
+	con.RotatorFallbacks = make(map[string]con.FallbackRule, len(cfg.Fallback.Rotators))
+	for rotatorID, rule := range cfg.Fallback.Rotators {
+		con.RotatorFallbacks[rotatorID] = con.FallbackRule(rule)
+	}
+
+	con.HistorySharder, err = shard.New(cfg.Sharding.Scheme, cfg.Sharding.Params)
+	if err != nil {
+		fmt.Println("Error creating the history sharder:", err)
+		os.Exit(1)
+	}
+
+	impressions := con.NewImpressionBuffer(repos.History, cfg.Bandit.ImpressionFlushInterval.Duration())
+	impressions.Start()
+
+	handler := con.Handler{
+		Repositories: repos,
+		Cache:        cache,
+		Impressions:  impressions,
+		Stale:        util.NewLRU(cfg.Fallback.StaleSize),
+	}
 
 	route := mux.NewRouter()
+	route.Use(util.Recover)
 	route.HandleFunc("/rotate", func(w http.ResponseWriter, r *http.Request) {
-		err := con.RotateHandler(w, r, db)
+		err := handler.RotateHandler(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			con.WriteError(w, err)
 			return
 		}
 	}).Methods("GET")
-	route.HandleFunc("/flushall", func(w http.ResponseWriter, r *http.Request) {
-		util.Flush()
-		util.ResponseSuccess(w, nil, "success flush memcached")
-	}).Methods("GET")
-
-	// API
-	apiHandler := con_api.Handler{
-		DB: db,
-	}
-	route.HandleFunc("/api/page/create", apiHandler.CreatePage).Methods("POST")
-	route.HandleFunc("/api/page/{id}", apiHandler.GetPage).Methods("GET")
-	route.HandleFunc("/api/page/update/{id}", apiHandler.Update).Methods("PATCH")
-	route.HandleFunc("/api/page/delete/{id}", apiHandler.DeletePage).Methods("DELETE")
-	route.HandleFunc("/api/memcached/update/{key}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		key := vars["key"]
-
-		if key == "" {
-			util.ResponseError(w, "params key is empty", http.StatusBadRequest)
+	route.HandleFunc("/event", func(w http.ResponseWriter, r *http.Request) {
+		err := handler.EventHandler(w, r)
+		if err != nil {
+			con.WriteError(w, err)
 			return
 		}
-
-		var newData con.PageData
-		if err := json.NewDecoder(r.Body).Decode(&newData); err != nil {
-			util.ResponseError(w, err.Error(), http.StatusInternalServerError)
+	}).Methods("POST")
+	route.HandleFunc("/pixel.gif", func(w http.ResponseWriter, r *http.Request) {
+		err := handler.PixelHandler(w, r)
+		if err != nil {
+			con.WriteError(w, err)
 			return
 		}
-
-		_, err = util.GetMemcachedValue(key)
+	}).Methods("GET")
+	route.HandleFunc("/click", func(w http.ResponseWriter, r *http.Request) {
+		err := handler.ClickHandler(w, r)
 		if err != nil {
-			util.ResponseError(w, err.Error(), http.StatusInternalServerError)
+			con.WriteError(w, err)
 			return
 		}
-
-		jsonData, _ := json.Marshal(newData)
-		dataCache, err := util.UpdateValueMemcached(key, jsonData, 60)
+	}).Methods("GET")
+	route.HandleFunc("/postback", func(w http.ResponseWriter, r *http.Request) {
+		err := handler.PostbackHandler(w, r)
 		if err != nil {
+			con.WriteError(w, err)
+			return
+		}
+	}).Methods("POST")
+
+	// API
+	if cfg.Server.AdminToken == "" {
+		log.Println("server.admin_token is empty, the admin api is disabled")
+	}
+	apiHandler := con_api.Handler{
+		Repositories: repos,
+		Cache:        cache,
+		Stale:        handler.Stale,
+	}
+	// the admin routes change pages and drop cached data, they need the
+	// admin token
+	admin := route.NewRoute().Subrouter()
+	admin.Use(util.AdminGuard(cfg.Server.AdminToken))
+	admin.HandleFunc("/flushall", func(w http.ResponseWriter, r *http.Request) {
+		if err := cache.Flush(); err != nil {
 			util.ResponseError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		util.ResponseSuccess(w, nil, "success flush memcached")
+	}).Methods("GET")
+	admin.HandleFunc("/api/page/create", apiHandler.CreatePage).Methods("POST")
+	admin.HandleFunc("/api/page/{id}", apiHandler.GetPage).Methods("GET")
+	admin.HandleFunc("/api/page/update/{id}", apiHandler.Update).Methods("PATCH")
+	admin.HandleFunc("/api/page/delete/{id}", apiHandler.DeletePage).Methods("DELETE")
+	admin.HandleFunc("/api/cache/invalidate", apiHandler.InvalidateCache).Methods("POST")
+
+	server := &http.Server{
+		Addr:         cfg.Server.Addr,
+		Handler:      route,
+		ReadTimeout:  cfg.Server.ReadTimeout.Duration(),
+		WriteTimeout: cfg.Server.WriteTimeout.Duration(),
+		IdleTimeout:  cfg.Server.IdleTimeout.Duration(),
+	}
 
-		util.ResponseSuccess(w, string(dataCache.Value), "success update memcached")
-	}).Methods("PATCH")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("listening on %s", cfg.Server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	failed := false
+	select {
+	case err := <-serverErr:
+		log.Printf("error serving http : %v", err)
+		failed = true
+	case <-ctx.Done():
+		log.Println("shutting down")
+	}
 
-	http.ListenAndServe(":9090", route)
+	// stop accepting requests and wait for the in-flight ones, then write the
+	// impressions they buffered before closing the cache and the database
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration())
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error shutting down the server : %v", err)
+	}
+	if err := impressions.Close(); err != nil {
+		log.Printf("error flushing impressions : %v", err)
+	}
+	if closer, ok := cache.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("error closing the cache : %v", err)
+		}
+	}
+	disconnectDatabase(db)
+
+	if failed {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dennyaris/html-rotate/config"
+	"github.com/dennyaris/html-rotate/migrations"
+)
+
+const migrateUsage = "usage: migrate [up | down [steps] | status]"
+
+// runMigrate runs the migrate subcommand against the configured database
+func runMigrate(cfg *config.Config, args []string) error {
+	if cfg.Database.Driver == "memory" {
+		return errors.New("the memory driver has no schema to migrate")
+	}
+
+	db, err := connectDatabase(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrations.New(db, cfg.Database.Driver)
+	if err != nil {
+		return err
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		ran, err := migrator.Up()
+		for _, migration := range ran {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(ran) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return errors.New(migrateUsage)
+			}
+		}
+
+		ran, err := migrator.Down(steps)
+		for _, migration := range ran {
+			fmt.Printf("reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+
+	case "status":
+		return printMigrationStatus(migrator)
+	}
+
+	return errors.New(migrateUsage)
+}
+
+func printMigrationStatus(migrator *migrations.Migrator) error {
+	applied, err := migrator.Applied()
+	if err != nil {
+		return err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, version := range applied {
+		done[version] = true
+	}
+
+	for _, migration := range migrator.Migrations {
+		state := "pending"
+		if done[migration.Version] {
+			state = "applied"
+		}
+		fmt.Printf("%04d_%s %s\n", migration.Version, migration.Name, state)
+	}
+
+	if err := migrator.Check(); err != nil {
+		fmt.Println(err)
+	}
+	return nil
+}
+
+// checkSchema refuses a database whose schema doesn't match the binary
+func checkSchema(db *sql.DB, driver string) error {
+	migrator, err := migrations.New(db, driver)
+	if err != nil {
+		return err
+	}
+
+	return migrator.Check()
+}
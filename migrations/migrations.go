@@ -0,0 +1,325 @@
+// Package migrations holds the versioned schema of the service and applies
+// it. Every migration is a pair of files named <version>_<name>.up.sql and
+// <version>_<name>.down.sql under the directory of its dialect. The files are
+// text/template documents, {{range shards}} repeats a block for every
+// variant history shard.
+package migrations
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+//go:embed mysql/*.sql postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// VersionTable records the applied migrations
+const VersionTable = "schema_migrations"
+
+// HistoryShards is the number of variant history tables,
+// z_rotator_variant_history_00 to z_rotator_variant_history_99
+const HistoryShards = 100
+
+// ErrSchemaMismatch is returned by Check when the applied migrations differ
+// from the ones built into the binary
+var ErrSchemaMismatch = errors.New("schema mismatch")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load returns the migrations of a dialect ordered by version
+func Load(dialect string) ([]Migration, error) {
+	return load(files, dialect)
+}
+
+func load(fsys fs.FS, dialect string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dialect)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for dialect %s", dialect)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, match[2])
+		}
+
+		text, err := render(fsys, dialect, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			migration.Up = text
+		} else {
+			migration.Down = text
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+func render(fsys fs.FS, dialect, name string) (string, error) {
+	data, err := fs.ReadFile(fsys, path.Join(dialect, name))
+	if err != nil {
+		return "", err
+	}
+
+	tmpl, err := template.New(name).Funcs(template.FuncMap{"shards": shards}).Parse(string(data))
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// shards returns the suffixes of the variant history tables
+func shards() []string {
+	suffixes := make([]string, HistoryShards)
+	for i := range suffixes {
+		suffixes[i] = fmt.Sprintf("%02d", i)
+	}
+	return suffixes
+}
+
+// statements splits a migration into its statements, they end with a
+// semicolon at the end of a line
+func statements(text string) []string {
+	var stmts []string
+	var current strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+
+	return stmts
+}
+
+// Migrator applies the migrations of a dialect to a database
+type Migrator struct {
+	DB         *sql.DB
+	Dialect    string
+	Migrations []Migration
+}
+
+func New(db *sql.DB, dialect string) (*Migrator, error) {
+	migrations, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Dialect: dialect, Migrations: migrations}, nil
+}
+
+func (m *Migrator) createVersionTable() error {
+	_, err := m.DB.Exec("CREATE TABLE IF NOT EXISTS " + VersionTable + " (" +
+		"version INT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)")
+	return err
+}
+
+// Applied returns the versions recorded in the version table, ascending. The
+// version table is created when missing.
+func (m *Migrator) Applied() ([]int, error) {
+	if err := m.createVersionTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.Query("SELECT version FROM " + VersionTable + " ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// Up applies the pending migrations in order and returns them. A failing
+// migration stops the run, MySQL commits DDL right away so the statements
+// before the failing one stay applied, and so does postgres as they aren't
+// run in a transaction.
+func (m *Migrator) Up() ([]Migration, error) {
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, version := range applied {
+		done[version] = true
+	}
+
+	var ran []Migration
+	for _, migration := range m.Migrations {
+		if done[migration.Version] {
+			continue
+		}
+
+		if err := m.run(migration.Up); err != nil {
+			return ran, fmt.Errorf("migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		if _, err := m.DB.Exec(m.bind("INSERT INTO "+VersionTable+" (version, name) VALUES (?, ?)"), migration.Version, migration.Name); err != nil {
+			return ran, err
+		}
+		ran = append(ran, migration)
+	}
+
+	return ran, nil
+}
+
+// Down reverts the last steps applied migrations and returns them
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for i := len(applied) - 1; i >= 0 && len(ran) < steps; i-- {
+		migration, ok := m.find(applied[i])
+		if !ok {
+			return ran, fmt.Errorf("migration %d is applied but unknown to this binary", applied[i])
+		}
+
+		if err := m.run(migration.Down); err != nil {
+			return ran, fmt.Errorf("migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		if _, err := m.DB.Exec(m.bind("DELETE FROM "+VersionTable+" WHERE version = ?"), migration.Version); err != nil {
+			return ran, err
+		}
+		ran = append(ran, migration)
+	}
+
+	return ran, nil
+}
+
+// Check returns ErrSchemaMismatch unless exactly the migrations built into
+// the binary are applied
+func (m *Migrator) Check() error {
+	applied, err := m.Applied()
+	if err != nil {
+		return err
+	}
+
+	var pending, unknown []string
+	done := make(map[int]bool, len(applied))
+	for _, version := range applied {
+		done[version] = true
+		if _, ok := m.find(version); !ok {
+			unknown = append(unknown, strconv.Itoa(version))
+		}
+	}
+	for _, migration := range m.Migrations {
+		if !done[migration.Version] {
+			pending = append(pending, strconv.Itoa(migration.Version))
+		}
+	}
+
+	switch {
+	case len(unknown) > 0:
+		return fmt.Errorf("%w: the database has migrations %s unknown to this binary", ErrSchemaMismatch, strings.Join(unknown, ", "))
+	case len(pending) > 0:
+		return fmt.Errorf("%w: migrations %s are pending", ErrSchemaMismatch, strings.Join(pending, ", "))
+	}
+
+	return nil
+}
+
+// bind rewrites the ? placeholders of a query to the $1, $2... of postgres
+func (m *Migrator) bind(query string) string {
+	if m.Dialect != "postgres" {
+		return query
+	}
+
+	var buf strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&buf, "$%d", n)
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+func (m *Migrator) find(version int) (Migration, bool) {
+	for _, migration := range m.Migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
+
+func (m *Migrator) run(text string) error {
+	for _, stmt := range statements(text) {
+		if _, err := m.DB.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
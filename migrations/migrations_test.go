@@ -0,0 +1,281 @@
+package migrations
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "modernc.org/sqlite"
+)
+
+var dialects = []string{"mysql", "postgres", "sqlite"}
+
+func TestLoadOrdersEveryDialectAlike(t *testing.T) {
+	var names []string
+	for _, dialect := range dialects {
+		migrations, err := Load(dialect)
+		if err != nil {
+			t.Fatalf("%s: %v", dialect, err)
+		}
+
+		var got []string
+		for i, migration := range migrations {
+			if migration.Version != i+1 {
+				t.Errorf("%s: migration %d has version %d", dialect, i, migration.Version)
+			}
+			got = append(got, migration.Name)
+		}
+		if names == nil {
+			names = got
+		} else if strings.Join(got, ",") != strings.Join(names, ",") {
+			t.Errorf("%s migrations %v differ from %v", dialect, got, names)
+		}
+	}
+
+	if _, err := Load("oracle"); err == nil {
+		t.Error("loaded migrations of an unknown dialect")
+	}
+}
+
+func TestLoadFileNames(t *testing.T) {
+	file := func(text string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(text)} }
+
+	cases := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int
+		err      string
+	}{
+		{
+			name: "ordered by version, not by name",
+			files: fstest.MapFS{
+				"db/0010_tenth.up.sql":   file("SELECT 10;"),
+				"db/0010_tenth.down.sql": file("SELECT -10;"),
+				"db/0002_second.up.sql":  file("SELECT 2;"),
+				"db/2_second.down.sql":   file("SELECT -2;"),
+			},
+			versions: []int{2, 10},
+		},
+		{
+			name:  "invalid name",
+			files: fstest.MapFS{"db/0001-base.up.sql": file("SELECT 1;")},
+			err:   "invalid migration file name: 0001-base.up.sql",
+		},
+		{
+			name:  "missing direction",
+			files: fstest.MapFS{"db/0001_base.sql": file("SELECT 1;")},
+			err:   "invalid migration file name",
+		},
+		{
+			name: "two names",
+			files: fstest.MapFS{
+				"db/0001_base.up.sql":    file("SELECT 1;"),
+				"db/0001_other.down.sql": file("SELECT -1;"),
+			},
+			err: "migration 1 has two names",
+		},
+		{
+			name:  "missing down",
+			files: fstest.MapFS{"db/0001_base.up.sql": file("SELECT 1;")},
+			err:   "migration 1_base needs both an up and a down file",
+		},
+		{
+			name: "broken template",
+			files: fstest.MapFS{
+				"db/0001_base.up.sql":   file("{{range shards}}SELECT 1;"),
+				"db/0001_base.down.sql": file("SELECT -1;"),
+			},
+			err: "unexpected EOF",
+		},
+	}
+
+	for _, c := range cases {
+		migrations, err := load(c.files, "db")
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		var versions []int
+		for _, migration := range migrations {
+			versions = append(versions, migration.Version)
+		}
+		if len(versions) != len(c.versions) || versions[0] != c.versions[0] || versions[1] != c.versions[1] {
+			t.Errorf("%s: versions %v, want %v", c.name, versions, c.versions)
+		}
+	}
+}
+
+func TestRenderShards(t *testing.T) {
+	for _, dialect := range dialects {
+		migrations, err := Load(dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := migrations[0]
+
+		for _, text := range []string{base.Up, base.Down} {
+			if strings.Contains(text, "{{") {
+				t.Errorf("%s: the base migration has an unrendered template", dialect)
+			}
+			for _, table := range []string{"z_rotator_variant_history_00", "z_rotator_variant_history_42", "z_rotator_variant_history_99"} {
+				if n := len(regexp.MustCompile(table+`\b`).FindAllString(text, -1)); n != 1 {
+					t.Errorf("%s: %s appears %d times", dialect, table, n)
+				}
+			}
+			if strings.Contains(text, "z_rotator_variant_history_100") {
+				t.Errorf("%s: renders a shard past the last one", dialect)
+			}
+		}
+	}
+}
+
+func TestRenderPostgres(t *testing.T) {
+	migrations, err := Load("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, migration := range migrations {
+		for _, stmt := range statements(migration.Up) {
+			// the MySQL only syntax must not leak into the postgres files
+			for _, mysql := range []string{"UNHEX(", "ENGINE=", "ON DUPLICATE KEY", "BINARY(32)", "`"} {
+				if strings.Contains(stmt, mysql) {
+					t.Errorf("%d_%s: %q in %s", migration.Version, migration.Name, mysql, stmt)
+				}
+			}
+		}
+	}
+
+	// the backfill sums every shard into the totals, one upsert per shard
+	backfill := migrations[7]
+	if backfill.Name != "backfill_stats" {
+		t.Fatalf("migration 8 is %s", backfill.Name)
+	}
+	stmts := statements(backfill.Up)
+	if len(stmts) != 1+HistoryShards {
+		t.Fatalf("the backfill has %d statements, want %d", len(stmts), 1+HistoryShards)
+	}
+	last := stmts[len(stmts)-1]
+	for _, want := range []string{"FROM z_rotator_variant_history_99", "ON CONFLICT (experiment_key, variant_key)", "s.impression + excluded.impression"} {
+		if !strings.Contains(last, want) {
+			t.Errorf("the last backfill statement lacks %q:\n%s", want, last)
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	text := `-- a comment
+CREATE TABLE a (
+    id INT NOT NULL -- trailing
+);
+
+-- another; with a semicolon
+INSERT INTO a VALUES (1);
+SELECT 1`
+
+	stmts := statements(text)
+	want := []string{
+		"CREATE TABLE a (\n    id INT NOT NULL -- trailing\n);",
+		"INSERT INTO a VALUES (1);",
+		"SELECT 1",
+	}
+	if len(stmts) != len(want) {
+		t.Fatalf("statements %q, want %q", stmts, want)
+	}
+	for i := range want {
+		if stmts[i] != want[i] {
+			t.Errorf("statement %d is %q, want %q", i, stmts[i], want[i])
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	query := "INSERT INTO schema_migrations (version, name) VALUES (?, ?)"
+	cases := map[string]string{
+		"postgres": "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+		"mysql":    query,
+		"sqlite":   query,
+	}
+
+	for dialect, want := range cases {
+		if got := (&Migrator{Dialect: dialect}).bind(query); got != want {
+			t.Errorf("%s: %s, want %s", dialect, got, want)
+		}
+	}
+}
+
+func TestMigratorSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "rotator.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m, err := New(db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := m.Migrations
+
+	if err := m.Check(); !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("check of an empty database: %v", err)
+	}
+
+	m.Migrations = all[:3]
+	if ran, err := m.Up(); err != nil || len(ran) != 3 {
+		t.Fatalf("first run applied %d migrations: %v", len(ran), err)
+	}
+	m.Migrations = all
+	if err := m.Check(); err == nil || !strings.Contains(err.Error(), "are pending") {
+		t.Errorf("check with pending migrations: %v", err)
+	}
+
+	if ran, err := m.Up(); err != nil || len(ran) != len(all)-3 {
+		t.Fatalf("second run applied %d migrations: %v", len(ran), err)
+	}
+	if err := m.Check(); err != nil {
+		t.Fatalf("check after every migration: %v", err)
+	}
+	if ran, err := m.Up(); err != nil || len(ran) != 0 {
+		t.Errorf("rerun applied %d migrations: %v", len(ran), err)
+	}
+
+	// a newer binary applied a migration this one doesn't know
+	if _, err := db.Exec("INSERT INTO "+VersionTable+" (version, name) VALUES (?, ?)", 99, "future"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(); !errors.Is(err, ErrSchemaMismatch) || !strings.Contains(err.Error(), "unknown to this binary") {
+		t.Errorf("check with an unknown migration: %v", err)
+	}
+	if _, err := m.Down(1); err == nil {
+		t.Error("reverted a migration unknown to this binary")
+	}
+	if _, err := db.Exec("DELETE FROM " + VersionTable + " WHERE version = 99"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ran, err := m.Down(len(all)); err != nil || len(ran) != len(all) {
+		t.Fatalf("reverted %d migrations: %v", len(ran), err)
+	}
+	if applied, err := m.Applied(); err != nil || len(applied) != 0 {
+		t.Errorf("applied %v after reverting everything: %v", applied, err)
+	}
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name LIKE 'z_rotator%'").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("%d rotator tables left after reverting everything", tables)
+	}
+}
@@ -0,0 +1,7 @@
+{{range shards}}
+DROP TABLE IF EXISTS z_rotator_variant_history_{{.}};
+{{end}}
+DROP TABLE IF EXISTS z_rotator_variant;
+DROP TABLE IF EXISTS z_rotator_experiment;
+DROP TABLE IF EXISTS z_rotator;
+DROP TABLE IF EXISTS page;
@@ -0,0 +1,63 @@
+-- Tables the service was first deployed with. IF NOT EXISTS lets a database
+-- created by hand adopt the migrations, so columns added since then belong
+-- in later migrations rather than here.
+
+CREATE TABLE IF NOT EXISTS page (
+    page_id VARCHAR(64) NOT NULL,
+    page_key BINARY(32) NOT NULL,
+    url_key BINARY(32) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    is_rotator TINYINT NOT NULL DEFAULT 0,
+    user_id INT NOT NULL,
+    site_id INT NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (page_id),
+    UNIQUE KEY page_url_key (url_key)
+) ENGINE=InnoDB;
+
+CREATE TABLE IF NOT EXISTS z_rotator (
+    page_id VARCHAR(64) NOT NULL,
+    page_key BINARY(32) NOT NULL,
+    rotator_id VARCHAR(64) NOT NULL,
+    rotator_key BINARY(32) NOT NULL,
+    PRIMARY KEY (rotator_key, page_key),
+    KEY z_rotator_page_id (page_id)
+) ENGINE=InnoDB;
+
+CREATE TABLE IF NOT EXISTS z_rotator_experiment (
+    experiment_id VARCHAR(255) NOT NULL,
+    experiment_key BINARY(32) NOT NULL,
+    ads_name VARCHAR(255) NOT NULL,
+    rotator_id VARCHAR(64) NOT NULL,
+    rotator_key BINARY(32) NOT NULL,
+    status TINYINT NOT NULL DEFAULT 1,
+    PRIMARY KEY (experiment_key),
+    KEY z_rotator_experiment_rotator_id (rotator_id),
+    KEY z_rotator_experiment_rotator_key (rotator_key)
+) ENGINE=InnoDB;
+
+CREATE TABLE IF NOT EXISTS z_rotator_variant (
+    variant_id VARCHAR(255) NOT NULL,
+    variant_key BINARY(32) NOT NULL,
+    experiment_id VARCHAR(255) NOT NULL,
+    experiment_key BINARY(32) NOT NULL,
+    page_id VARCHAR(64) NOT NULL,
+    page_key BINARY(32) NOT NULL,
+    PRIMARY KEY (experiment_key, variant_key)
+) ENGINE=InnoDB;
+{{range shards}}
+CREATE TABLE IF NOT EXISTS z_rotator_variant_history_{{.}} (
+    tanggal DATE NOT NULL,
+    experiment_id VARCHAR(255) NOT NULL,
+    experiment_key BINARY(32) NOT NULL,
+    variant_id VARCHAR(255) NOT NULL,
+    variant_key BINARY(32) NOT NULL,
+    impression INT UNSIGNED NOT NULL DEFAULT 0,
+    cta INT UNSIGNED NOT NULL DEFAULT 0,
+    `lead` INT UNSIGNED NOT NULL DEFAULT 0,
+    mql INT UNSIGNED NOT NULL DEFAULT 0,
+    prospek INT UNSIGNED NOT NULL DEFAULT 0,
+    purchase INT UNSIGNED NOT NULL DEFAULT 0,
+    PRIMARY KEY (experiment_key, variant_key, tanggal)
+) ENGINE=InnoDB;
+{{end}}
@@ -0,0 +1,16 @@
+-- Running totals of every variant, kept next to the daily history so the
+-- rotation reads one row per variant
+
+CREATE TABLE IF NOT EXISTS z_rotator_variant_stats (
+    experiment_id VARCHAR(255) NOT NULL,
+    experiment_key BINARY(32) NOT NULL,
+    variant_id VARCHAR(255) NOT NULL,
+    variant_key BINARY(32) NOT NULL,
+    impression INT UNSIGNED NOT NULL DEFAULT 0,
+    cta INT UNSIGNED NOT NULL DEFAULT 0,
+    `lead` INT UNSIGNED NOT NULL DEFAULT 0,
+    mql INT UNSIGNED NOT NULL DEFAULT 0,
+    prospek INT UNSIGNED NOT NULL DEFAULT 0,
+    purchase INT UNSIGNED NOT NULL DEFAULT 0,
+    PRIMARY KEY (experiment_key, variant_key)
+) ENGINE=InnoDB;
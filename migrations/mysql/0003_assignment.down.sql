@@ -0,0 +1 @@
+DROP TABLE IF EXISTS z_rotator_assignment;
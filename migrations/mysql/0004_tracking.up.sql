@@ -0,0 +1,15 @@
+-- Keys of the counted events and the secrets sites sign their postbacks with
+
+CREATE TABLE IF NOT EXISTS z_rotator_event_dedup (
+    dedup_key BINARY(32) NOT NULL,
+    experiment_key BINARY(32) NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (dedup_key),
+    KEY z_rotator_event_dedup_created (created)
+) ENGINE=InnoDB;
+
+CREATE TABLE IF NOT EXISTS site_secret (
+    site_id INT NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    PRIMARY KEY (site_id)
+) ENGINE=InnoDB;
@@ -0,0 +1,3 @@
+ALTER TABLE z_rotator_variant DROP COLUMN weight;
+ALTER TABLE z_rotator_experiment DROP COLUMN strategy_params;
+ALTER TABLE z_rotator_experiment DROP COLUMN strategy;
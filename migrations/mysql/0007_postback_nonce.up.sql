@@ -0,0 +1,11 @@
+-- Nonces of the accepted postbacks. The cache only speeds up the check, noop
+-- and lru caches can't reject a replay on their own. Rows older than twice
+-- the postback window can be pruned.
+
+CREATE TABLE IF NOT EXISTS z_rotator_postback_nonce (
+    site_id INT NOT NULL,
+    nonce_key BINARY(32) NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (site_id, nonce_key),
+    KEY z_rotator_postback_nonce_created (created)
+) ENGINE=InnoDB;
@@ -0,0 +1,17 @@
+-- Rebuilds the totals of every experiment from its variant history. Events
+-- recorded before an experiment's first rotation after 0002 created partial
+-- totals rows, so the totals are zeroed and summed over every shard, an
+-- experiment moved by a reshard may still have rows in two shards.
+
+UPDATE z_rotator_variant_stats SET impression = 0, cta = 0, `lead` = 0, mql = 0, prospek = 0, purchase = 0;
+{{range shards}}
+INSERT INTO z_rotator_variant_stats (experiment_id, experiment_key, variant_id, variant_key, impression, cta, `lead`, mql, prospek, purchase)
+SELECT * FROM (
+    SELECT MIN(experiment_id) AS experiment_id, experiment_key, MIN(variant_id) AS variant_id, variant_key,
+        SUM(impression) AS impression, SUM(cta) AS cta, SUM(`lead`) AS `lead`, SUM(mql) AS mql, SUM(prospek) AS prospek, SUM(purchase) AS purchase
+    FROM z_rotator_variant_history_{{.}} GROUP BY experiment_key, variant_key
+) AS totals
+ON DUPLICATE KEY UPDATE impression = z_rotator_variant_stats.impression + VALUES(impression), cta = z_rotator_variant_stats.cta + VALUES(cta),
+    `lead` = z_rotator_variant_stats.`lead` + VALUES(`lead`), mql = z_rotator_variant_stats.mql + VALUES(mql),
+    prospek = z_rotator_variant_stats.prospek + VALUES(prospek), purchase = z_rotator_variant_stats.purchase + VALUES(purchase);
+{{end}}
@@ -0,0 +1,65 @@
+-- Tables the service was first deployed with. IF NOT EXISTS lets a database
+-- created by hand adopt the migrations, so columns added since then belong
+-- in later migrations rather than here.
+
+CREATE TABLE IF NOT EXISTS page (
+    page_id VARCHAR(64) NOT NULL,
+    page_key BYTEA NOT NULL,
+    url_key BYTEA NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    is_rotator SMALLINT NOT NULL DEFAULT 0,
+    user_id INT NOT NULL,
+    site_id INT NOT NULL,
+    created TIMESTAMP NOT NULL,
+    PRIMARY KEY (page_id),
+    UNIQUE (url_key)
+);
+
+CREATE TABLE IF NOT EXISTS z_rotator (
+    page_id VARCHAR(64) NOT NULL,
+    page_key BYTEA NOT NULL,
+    rotator_id VARCHAR(64) NOT NULL,
+    rotator_key BYTEA NOT NULL,
+    PRIMARY KEY (rotator_key, page_key)
+);
+
+CREATE INDEX IF NOT EXISTS z_rotator_page_id ON z_rotator (page_id);
+
+CREATE TABLE IF NOT EXISTS z_rotator_experiment (
+    experiment_id VARCHAR(255) NOT NULL,
+    experiment_key BYTEA NOT NULL,
+    ads_name VARCHAR(255) NOT NULL,
+    rotator_id VARCHAR(64) NOT NULL,
+    rotator_key BYTEA NOT NULL,
+    status SMALLINT NOT NULL DEFAULT 1,
+    PRIMARY KEY (experiment_key)
+);
+
+CREATE INDEX IF NOT EXISTS z_rotator_experiment_rotator_id ON z_rotator_experiment (rotator_id);
+CREATE INDEX IF NOT EXISTS z_rotator_experiment_rotator_key ON z_rotator_experiment (rotator_key);
+
+CREATE TABLE IF NOT EXISTS z_rotator_variant (
+    variant_id VARCHAR(255) NOT NULL,
+    variant_key BYTEA NOT NULL,
+    experiment_id VARCHAR(255) NOT NULL,
+    experiment_key BYTEA NOT NULL,
+    page_id VARCHAR(64) NOT NULL,
+    page_key BYTEA NOT NULL,
+    PRIMARY KEY (experiment_key, variant_key)
+);
+{{range shards}}
+CREATE TABLE IF NOT EXISTS z_rotator_variant_history_{{.}} (
+    tanggal DATE NOT NULL,
+    experiment_id VARCHAR(255) NOT NULL,
+    experiment_key BYTEA NOT NULL,
+    variant_id VARCHAR(255) NOT NULL,
+    variant_key BYTEA NOT NULL,
+    impression INT NOT NULL DEFAULT 0,
+    cta INT NOT NULL DEFAULT 0,
+    lead INT NOT NULL DEFAULT 0,
+    mql INT NOT NULL DEFAULT 0,
+    prospek INT NOT NULL DEFAULT 0,
+    purchase INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (experiment_key, variant_key, tanggal)
+);
+{{end}}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS site_secret;
+DROP TABLE IF EXISTS z_rotator_event_dedup;
@@ -0,0 +1,16 @@
+-- Keys of the counted events and the secrets sites sign their postbacks with
+
+CREATE TABLE IF NOT EXISTS z_rotator_event_dedup (
+    dedup_key BYTEA NOT NULL,
+    experiment_key BYTEA NOT NULL,
+    created TIMESTAMP NOT NULL,
+    PRIMARY KEY (dedup_key)
+);
+
+CREATE INDEX IF NOT EXISTS z_rotator_event_dedup_created ON z_rotator_event_dedup (created);
+
+CREATE TABLE IF NOT EXISTS site_secret (
+    site_id INT NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    PRIMARY KEY (site_id)
+);
@@ -0,0 +1,7 @@
+-- Columns added to tables the base migration may have adopted from a
+-- database created by hand: the bandit strategy of an experiment and the
+-- traffic weight of a variant
+
+ALTER TABLE z_rotator_experiment ADD COLUMN strategy VARCHAR(32) NULL;
+ALTER TABLE z_rotator_experiment ADD COLUMN strategy_params TEXT NULL;
+ALTER TABLE z_rotator_variant ADD COLUMN weight INT NULL;
@@ -0,0 +1,16 @@
+-- Running totals of every variant, kept next to the daily history so the
+-- rotation reads one row per variant
+
+CREATE TABLE IF NOT EXISTS z_rotator_variant_stats (
+    experiment_id VARCHAR(255) NOT NULL,
+    experiment_key BLOB NOT NULL,
+    variant_id VARCHAR(255) NOT NULL,
+    variant_key BLOB NOT NULL,
+    impression INT NOT NULL DEFAULT 0,
+    cta INT NOT NULL DEFAULT 0,
+    lead INT NOT NULL DEFAULT 0,
+    mql INT NOT NULL DEFAULT 0,
+    prospek INT NOT NULL DEFAULT 0,
+    purchase INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (experiment_key, variant_key)
+);
@@ -0,0 +1,9 @@
+-- Variant each visitor is stuck to in an experiment
+
+CREATE TABLE IF NOT EXISTS z_rotator_assignment (
+    experiment_key BLOB NOT NULL,
+    visitor_key BLOB NOT NULL,
+    variant_id VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL,
+    PRIMARY KEY (experiment_key, visitor_key)
+);
@@ -0,0 +1,10 @@
+-- History table each experiment is pinned to. Experiments without a row were
+-- created before the map and live in their legacy shard.
+
+CREATE TABLE IF NOT EXISTS z_rotator_shard_map (
+    experiment_key BLOB NOT NULL,
+    experiment_id VARCHAR(255) NOT NULL,
+    history_table VARCHAR(64) NOT NULL,
+    updated DATETIME NOT NULL,
+    PRIMARY KEY (experiment_key)
+);
@@ -0,0 +1 @@
+-- The rebuilt totals are kept, they match the history the service writes
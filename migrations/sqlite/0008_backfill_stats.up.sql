@@ -0,0 +1,14 @@
+-- Rebuilds the totals of every experiment from its variant history. Events
+-- recorded before an experiment's first rotation after 0002 created partial
+-- totals rows, so the totals are zeroed and summed over every shard, an
+-- experiment moved by a reshard may still have rows in two shards.
+
+UPDATE z_rotator_variant_stats SET impression = 0, cta = 0, lead = 0, mql = 0, prospek = 0, purchase = 0;
+{{range shards}}
+INSERT INTO z_rotator_variant_stats (experiment_id, experiment_key, variant_id, variant_key, impression, cta, lead, mql, prospek, purchase)
+SELECT MIN(experiment_id), experiment_key, MIN(variant_id), variant_key,
+    SUM(impression), SUM(cta), SUM(lead), SUM(mql), SUM(prospek), SUM(purchase)
+FROM z_rotator_variant_history_{{.}} WHERE true GROUP BY experiment_key, variant_key
+ON CONFLICT (experiment_key, variant_key) DO UPDATE SET impression = impression + excluded.impression, cta = cta + excluded.cta,
+    lead = lead + excluded.lead, mql = mql + excluded.mql, prospek = prospek + excluded.prospek, purchase = purchase + excluded.purchase;
+{{end}}
@@ -4,6 +4,7 @@ import (
 	"database/sql" // VariantHistory represents a single row from the query
 	"fmt"
 	"strings"
+	"time"
 )
 
 type VariantHistory struct {
@@ -27,32 +28,6 @@ type Rotator struct {
 	RotatorKey []byte
 }
 
-// GetVariantHistoryByExperimentKey takes a database connection, table name, and experiment key in hex format and returns an array of results
-func GetVariantHistoryByExperimentKey(db *sql.DB, tableName string, experimentKeyHex string) ([]VariantHistory, error) {
-	query := `SELECT vh.variant_id,sum(vh.impression) as impression,sum(vh.cta) as cta,sum(vh.lead) as lead,sum(vh.mql) as mql,sum(vh.prospek) as prospek,sum(vh.purchase) as purchase  FROM ` + tableName + ` as vh WHERE experiment_key = UNHEX(?)  GROUP BY variant_key ;`
-	rows, err := db.Query(query, experimentKeyHex)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var results []VariantHistory
-	for rows.Next() {
-		var result VariantHistory
-		err := rows.Scan(&result.VariantID, &result.Impression, &result.CTA, &result.Lead, &result.Mql, &result.Prospek, &result.Purchase)
-		if err != nil {
-			return nil, err
-		}
-		results = append(results, result)
-	}
-	err = rows.Err()
-	if err != nil {
-		return nil, err
-	}
-
-	return results, nil
-}
-
 type Experiment struct {
 	ExperimentID  string
 	ExperimentKey string // Changed to string for hex representation
@@ -60,23 +35,56 @@ type Experiment struct {
 	RotatorID     string
 	RotatorKey    string // Changed to string for hex representation
 	Status        int
+	// Strategy names the bandit algorithm used to pick variants, an empty
+	// value means the default strategy
+	Strategy       string
+	StrategyParams string
 }
 
 func SelectFromZRotatorExperiment(db *sql.DB, experimentKey string) (Experiment, error) {
 	var row Experiment
+	var strategy, strategyParams sql.NullString
 
 	// Prepare the SQL query with HEX function on experiment_key and rotator_key columns
-	query := "SELECT experiment_id, HEX(experiment_key), ads_name, rotator_id, HEX(rotator_key), status FROM z_rotator_experiment WHERE experiment_key = UNHEX(?) LIMIT 1"
+	query := "SELECT experiment_id, HEX(experiment_key), ads_name, rotator_id, HEX(rotator_key), status, strategy, strategy_params FROM z_rotator_experiment WHERE experiment_key = UNHEX(?) LIMIT 1"
 
 	// Execute the query
-	err := db.QueryRow(query, experimentKey).Scan(&row.ExperimentID, &row.ExperimentKey, &row.AdsName, &row.RotatorID, &row.RotatorKey, &row.Status)
+	err := db.QueryRow(query, experimentKey).Scan(&row.ExperimentID, &row.ExperimentKey, &row.AdsName, &row.RotatorID, &row.RotatorKey, &row.Status, &strategy, &strategyParams)
 	if err != nil {
 		return Experiment{}, err
 	}
+	row.Strategy = strategy.String
+	row.StrategyParams = strategyParams.String
 
 	return row, nil
 }
 
+// GetExperimentKeysByPageID returns the hex keys of the experiments running
+// on the page, either as the rotator or as one of the rotator's pages
+func GetExperimentKeysByPageID(db *sql.DB, pageID string) ([]string, error) {
+	query := "SELECT HEX(experiment_key) FROM z_rotator_experiment WHERE rotator_id = ? " +
+		"OR rotator_key IN (SELECT rotator_key FROM z_rotator WHERE page_id = ?)"
+	rows, err := db.Query(query, pageID, pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
 func GetPagesByRotatorKey(db *sql.DB, rotatorKeyHex string) ([]Rotator, error) {
 	var rotators []Rotator
 	query := "SELECT * FROM z_rotator WHERE rotator_key = UNHEX(?)"
@@ -100,61 +108,257 @@ func GetPagesByRotatorKey(db *sql.DB, rotatorKeyHex string) ([]Rotator, error) {
 	return rotators, nil
 }
 
-func contains(slice []string, s string) bool {
-	for _, v := range slice {
-		if v == s {
-			return true
+// GetVariantWeights returns the traffic weight of every variant of an
+// experiment keyed by variant id
+func GetVariantWeights(db *sql.DB, experimentKeyHex string) (map[string]int, error) {
+	query := "SELECT variant_id, weight FROM z_rotator_variant WHERE experiment_key = UNHEX(?)"
+	rows, err := db.Query(query, experimentKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	weights := make(map[string]int)
+	for rows.Next() {
+		var variantID string
+		var weight sql.NullInt64
+		if err := rows.Scan(&variantID, &weight); err != nil {
+			return nil, err
 		}
+		weights[variantID] = int(weight.Int64)
 	}
-	return false
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return weights, nil
 }
 
-func InsertIntoTableUnhex(db *sql.DB, tableName string, data map[string]string, hexColumns []string) (bool, error) {
-	if len(data) == 0 {
-		return false, nil // No data to insert
+// GetAssignment returns the variant a visitor was assigned to in an experiment
+func GetAssignment(db *sql.DB, experimentKeyHex, visitorKeyHex string) (string, error) {
+	var variantID string
+	query := "SELECT variant_id FROM z_rotator_assignment WHERE experiment_key = UNHEX(?) AND visitor_key = UNHEX(?) LIMIT 1"
+	if err := db.QueryRow(query, experimentKeyHex, visitorKeyHex).Scan(&variantID); err != nil {
+		return "", err
 	}
 
-	// Construct the SQL query
-	var columns, placeholders []string
-	var values []interface{}
-	for key, value := range data {
-		columns = append(columns, key)
-		placeholders = append(placeholders, "?")
-		if contains(hexColumns, key) {
-			values = append(values, fmt.Sprintf("UNHEX('%s')", value))
-		} else {
-			values = append(values, value)
-		}
+	return variantID, nil
+}
+
+// InsertAssignment stores the variant a visitor was assigned to, it returns
+// false when the visitor already has an assignment in the experiment
+func InsertAssignment(db *sql.DB, experimentKeyHex, visitorKeyHex, variantID string) (bool, error) {
+	query := "INSERT IGNORE INTO z_rotator_assignment (experiment_key, visitor_key, variant_id, created) VALUES (UNHEX(?), UNHEX(?), ?, ?)"
+	result, err := db.Exec(query, experimentKeyHex, visitorKeyHex, variantID, time.Now())
+	if err != nil {
+		return false, err
 	}
-	query := fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES (%s)", tableName, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
 
-	// Prepare the SQL statement
-	stmt, err := db.Prepare(query)
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return false, err
 	}
-	defer stmt.Close()
 
-	// Execute the SQL statement with parameters
-	result, err := stmt.Exec(values...)
+	return rowsAffected > 0, nil
+}
+
+// DeleteAssignment removes the variant assignment of a visitor
+func DeleteAssignment(db *sql.DB, experimentKeyHex, visitorKeyHex string) error {
+	query := "DELETE FROM z_rotator_assignment WHERE experiment_key = UNHEX(?) AND visitor_key = UNHEX(?)"
+	_, err := db.Exec(query, experimentKeyHex, visitorKeyHex)
+	return err
+}
+
+// GetSiteSecret returns the shared secret a site signs its postbacks with
+func GetSiteSecret(db *sql.DB, siteID int) (string, error) {
+	var secret string
+	query := "SELECT secret FROM site_secret WHERE site_id = ? LIMIT 1"
+	if err := db.QueryRow(query, siteID).Scan(&secret); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// InsertPostbackNonce stores a postback nonce of a site, it returns false
+// when the nonce was already used
+func InsertPostbackNonce(db *sql.DB, siteID int, nonceKeyHex string) (bool, error) {
+	query := "INSERT IGNORE INTO z_rotator_postback_nonce (site_id, nonce_key, created) VALUES (?, UNHEX(?), ?)"
+	result, err := db.Exec(query, siteID, nonceKeyHex, time.Now())
 	if err != nil {
 		return false, err
 	}
 
-	// Check if any rows were affected
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return false, err
 	}
 
-	// If rows were affected, get the last inserted ID
-	if rowsAffected > 0 {
-		return true, nil
+	return rowsAffected > 0, nil
+}
+
+// DeletePostbackNonce deletes a postback nonce of a site
+func DeletePostbackNonce(db *sql.DB, siteID int, nonceKeyHex string) error {
+	query := "DELETE FROM z_rotator_postback_nonce WHERE site_id = ? AND nonce_key = UNHEX(?)"
+	_, err := db.Exec(query, siteID, nonceKeyHex)
+	return err
+}
+
+// DeleteExpiredPostbackNonces deletes the postback nonces stored before the
+// given time
+func DeleteExpiredPostbackNonces(db *sql.DB, before time.Time) (int64, error) {
+	query := "DELETE FROM z_rotator_postback_nonce WHERE created < ?"
+	result, err := db.Exec(query, before)
+	if err != nil {
+		return 0, err
 	}
 
-	// If no rows were affected, return false, indicating that the insertion was ignored due to a duplicate key error
-	return false, nil
+	return result.RowsAffected()
 }
+
+// GetExperimentSiteID returns the site of the rotator page an experiment runs on
+func GetExperimentSiteID(db *sql.DB, experimentKeyHex string) (int, error) {
+	var siteID int
+	query := "SELECT p.site_id FROM z_rotator_experiment e JOIN page p ON p.page_id = e.rotator_id WHERE e.experiment_key = UNHEX(?) LIMIT 1"
+	if err := db.QueryRow(query, experimentKeyHex).Scan(&siteID); err != nil {
+		return 0, err
+	}
+
+	return siteID, nil
+}
+
+// InsertEventDedup stores the dedup key of a counted event, it returns false
+// when the key was already stored
+func InsertEventDedup(db *sql.DB, dedupKeyHex, experimentKeyHex string) (bool, error) {
+	query := "INSERT IGNORE INTO z_rotator_event_dedup (dedup_key, experiment_key, created) VALUES (UNHEX(?), UNHEX(?), ?)"
+	result, err := db.Exec(query, dedupKeyHex, experimentKeyHex, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func DeleteEventDedup(db *sql.DB, dedupKeyHex string) error {
+	query := "DELETE FROM z_rotator_event_dedup WHERE dedup_key = UNHEX(?)"
+	_, err := db.Exec(query, dedupKeyHex)
+	return err
+}
+
+// historyCounters are the variant history columns that can be incremented
+var historyCounters = []string{"impression", "cta", "lead", "mql", "prospek", "purchase"}
+
+// VariantExists reports whether the variant belongs to the experiment
+func VariantExists(db *sql.DB, experimentKeyHex, variantKeyHex string) (bool, error) {
+	var found int
+	query := "SELECT 1 FROM z_rotator_variant WHERE experiment_key = UNHEX(?) AND variant_key = UNHEX(?) LIMIT 1"
+	err := db.QueryRow(query, experimentKeyHex, variantKeyHex).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// IncrementVariantHistory adds n to a counter column of the variant's daily
+// row in a variant history table and of its row in z_rotator_variant_stats,
+// creating the rows when they don't exist. Both writes share a transaction so
+// the summary never drifts from the history.
+func IncrementVariantHistory(db *sql.DB, tableName, column, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string, n int) error {
+	if !contains(historyCounters, column) {
+		return fmt.Errorf("unknown variant history counter: %s", column)
+	}
+
+	// lead is reserved since MySQL 8
+	column = "`" + column + "`"
+	historyQuery := "INSERT INTO " + tableName + " (tanggal, experiment_id, experiment_key, variant_id, variant_key, " + column + ") " +
+		"VALUES (?, ?, UNHEX(?), ?, UNHEX(?), ?) ON DUPLICATE KEY UPDATE " + column + " = " + column + " + VALUES(" + column + ")"
+	statsQuery := "INSERT INTO z_rotator_variant_stats (experiment_id, experiment_key, variant_id, variant_key, " + column + ") " +
+		"VALUES (?, UNHEX(?), ?, UNHEX(?), ?) ON DUPLICATE KEY UPDATE " + column + " = " + column + " + VALUES(" + column + ")"
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(historyQuery, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex, n); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(statsQuery, experimentID, experimentKeyHex, variantID, variantKeyHex, n); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertVariant adds a page to an experiment as one of its variants, an
+// existing variant is left untouched
+func InsertVariant(db *sql.DB, variantID, variantKeyHex, experimentID, experimentKeyHex, pageID, pageKeyHex string) error {
+	query := "INSERT IGNORE INTO z_rotator_variant (variant_id, variant_key, experiment_id, experiment_key, page_id, page_key) VALUES (?, UNHEX(?), ?, UNHEX(?), ?, UNHEX(?))"
+	_, err := db.Exec(query, variantID, variantKeyHex, experimentID, experimentKeyHex, pageID, pageKeyHex)
+	return err
+}
+
+// InsertVariantHistory creates the empty daily row of a variant in a variant
+// history table
+func InsertVariantHistory(db *sql.DB, tableName, tanggal, experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	query := "INSERT IGNORE INTO " + tableName + " (variant_id, variant_key, experiment_id, experiment_key, tanggal) VALUES (?, UNHEX(?), ?, UNHEX(?), ?)"
+	_, err := db.Exec(query, variantID, variantKeyHex, experimentID, experimentKeyHex, tanggal)
+	return err
+}
+
+// InsertVariantStats creates the empty stats row of a variant
+func InsertVariantStats(db *sql.DB, experimentID, experimentKeyHex, variantID, variantKeyHex string) error {
+	query := "INSERT IGNORE INTO z_rotator_variant_stats (experiment_id, experiment_key, variant_id, variant_key) VALUES (?, UNHEX(?), ?, UNHEX(?))"
+	_, err := db.Exec(query, experimentID, experimentKeyHex, variantID, variantKeyHex)
+	return err
+}
+
+// GetVariantStatsByExperimentKey reads the maintained per variant totals of an
+// experiment, one row per variant instead of aggregating the daily history
+func GetVariantStatsByExperimentKey(db *sql.DB, experimentKeyHex string) ([]VariantHistory, error) {
+	query := "SELECT variant_id, impression, cta, `lead`, mql, prospek, purchase FROM z_rotator_variant_stats WHERE experiment_key = UNHEX(?) ORDER BY variant_id"
+	rows, err := db.Query(query, experimentKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []VariantHistory
+	for rows.Next() {
+		var result VariantHistory
+		err := rows.Scan(&result.VariantID, &result.Impression, &result.CTA, &result.Lead, &result.Mql, &result.Prospek, &result.Purchase)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func contains(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func InsertIntoTable(db *sql.DB, tableName string, data map[string]string) (bool, error) {
 	if len(data) == 0 {
 		return false, nil // No data to insert
@@ -202,3 +406,115 @@ func InsertIntoTable(db *sql.DB, tableName string, data map[string]string) (bool
 	// If no rows were affected, return false, indicating that the insertion was ignored due to a duplicate key error
 	return false, nil
 }
+
+// ShardAssignment is an experiment with the variant history table it is
+// pinned to, HistoryTable is empty when it has no row in z_rotator_shard_map
+type ShardAssignment struct {
+	ExperimentID  string
+	ExperimentKey string // hex
+	HistoryTable  string
+}
+
+// GetShardTable returns the variant history table an experiment is pinned to
+func GetShardTable(db *sql.DB, experimentKeyHex string) (string, error) {
+	var table string
+	query := "SELECT history_table FROM z_rotator_shard_map WHERE experiment_key = UNHEX(?) LIMIT 1"
+	if err := db.QueryRow(query, experimentKeyHex).Scan(&table); err != nil {
+		return "", err
+	}
+
+	return table, nil
+}
+
+// PinShardTable pins an experiment without a table to one, it returns false
+// when the experiment is already pinned
+func PinShardTable(db *sql.DB, experimentKeyHex, experimentID, table string) (bool, error) {
+	query := "INSERT IGNORE INTO z_rotator_shard_map (experiment_key, experiment_id, history_table, updated) VALUES (UNHEX(?), ?, ?, ?)"
+	result, err := db.Exec(query, experimentKeyHex, experimentID, table, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// SetShardTable pins an experiment to a table, replacing its previous one
+func SetShardTable(db *sql.DB, experimentKeyHex, experimentID, table string) error {
+	query := "INSERT INTO z_rotator_shard_map (experiment_key, experiment_id, history_table, updated) VALUES (UNHEX(?), ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE history_table = VALUES(history_table), updated = VALUES(updated)"
+	_, err := db.Exec(query, experimentKeyHex, experimentID, table, time.Now())
+	return err
+}
+
+// GetShardAssignments returns every experiment with its pinned table, ordered
+// by experiment id
+func GetShardAssignments(db *sql.DB) ([]ShardAssignment, error) {
+	query := "SELECT e.experiment_id, HEX(e.experiment_key), COALESCE(m.history_table, '') FROM z_rotator_experiment e " +
+		"LEFT JOIN z_rotator_shard_map m ON m.experiment_key = e.experiment_key ORDER BY e.experiment_id"
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assignments []ShardAssignment
+	for rows.Next() {
+		var assignment ShardAssignment
+		if err := rows.Scan(&assignment.ExperimentID, &assignment.ExperimentKey, &assignment.HistoryTable); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, assignment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return assignments, nil
+}
+
+// MoveVariantHistory moves the daily rows of an experiment from one variant
+// history table to another in a transaction, rows of a day already in the
+// target have their counters added. It returns the number of moved rows.
+// InnoDB locks the rows the INSERT ... SELECT reads, so increments of servers
+// still writing to the old table wait for the DELETE to commit.
+func MoveVariantHistory(db *sql.DB, fromTable, toTable, experimentKeyHex string) (int64, error) {
+	if fromTable == toTable {
+		return 0, nil
+	}
+
+	columns := "tanggal, experiment_id, experiment_key, variant_id, variant_key, impression, cta, `lead`, mql, prospek, purchase"
+	var updates []string
+	for _, column := range historyCounters {
+		updates = append(updates, toTable+".`"+column+"` = "+toTable+".`"+column+"` + VALUES(`"+column+"`)")
+	}
+	insertQuery := "INSERT INTO " + toTable + " (" + columns + ") SELECT " + columns + " FROM " + fromTable + " WHERE experiment_key = UNHEX(?) " +
+		"ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	deleteQuery := "DELETE FROM " + fromTable + " WHERE experiment_key = UNHEX(?)"
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(insertQuery, experimentKeyHex); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	result, err := tx.Exec(deleteQuery, experimentKeyHex)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	moved, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return moved, tx.Commit()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/adapter/shard"
+	"github.com/dennyaris/html-rotate/config"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+// shardMove is an experiment whose history changes table
+type shardMove struct {
+	ExperimentID  string
+	ExperimentKey string
+	From, To      string
+}
+
+// runReshard moves the variant history of every experiment to the table the
+// configured sharding scheme places it in, while the service keeps running.
+// An experiment is repointed to its new table first, then its rows are moved
+// twice: right away, and after the grace period for the rows written by
+// servers that still had the old table cached.
+func runReshard(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("reshard", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the moves without running them")
+	grace := flags.Duration("grace", cfg.Cache.ShardTTL.Duration()+cfg.Cache.L1TTL.Duration()+2*cfg.Bandit.ImpressionFlushInterval.Duration(),
+		"wait before the last sweep of the old tables, longer than the shard cache TTL and the impression flush interval")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	only := make(map[string]bool)
+	for _, experimentID := range flags.Args() {
+		only[experimentID] = true
+	}
+
+	if cfg.Database.Driver == "memory" {
+		return errors.New("the memory driver has no history to reshard")
+	}
+
+	sharder, err := shard.New(cfg.Sharding.Scheme, cfg.Sharding.Params)
+	if err != nil {
+		return err
+	}
+
+	db, err := connectDatabase(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := checkSchema(db, cfg.Database.Driver); err != nil {
+		return err
+	}
+	repos, err := repository.New(cfg.Database.Driver, db)
+	if err != nil {
+		return err
+	}
+
+	moves, err := planMoves(repos.Shards, sharder, only, !*dryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, move := range moves {
+		fmt.Printf("%s %s -> %s\n", move.ExperimentID, move.From, move.To)
+	}
+	if len(moves) == 0 {
+		fmt.Println("every experiment is in its table")
+		return nil
+	}
+	if *dryRun {
+		return nil
+	}
+
+	// the servers sharing this cache see the new tables before the TTL
+	cache, err := util.NewCache(cfg.Cache.Backend, cfg.Cache.Addr, cfg.Cache.Size, cfg.Cache.L1TTL.Duration())
+	if err != nil {
+		return err
+	}
+
+	if err := applyMoves(repos.Shards, cache, moves); err != nil {
+		return err
+	}
+
+	fmt.Printf("waiting %s for the servers to pick up the new tables\n", *grace)
+	time.Sleep(*grace)
+
+	for _, move := range moves {
+		moved, err := repos.Shards.MoveHistory(move.From, move.To, move.ExperimentKey)
+		if err != nil {
+			return fmt.Errorf("%s: %v", move.ExperimentID, err)
+		}
+		if moved > 0 {
+			fmt.Printf("%s moved %d late rows\n", move.ExperimentID, moved)
+		}
+	}
+
+	return nil
+}
+
+// planMoves returns the experiments, all or only the given ones, the sharder
+// places in another table. Experiments without a table are on their legacy
+// shard; when that is already their table they are pinned to it if pin is
+// set.
+func planMoves(shards repository.ShardRepository, sharder shard.Sharder, only map[string]bool, pin bool) ([]shardMove, error) {
+	assignments, err := shards.Assignments()
+	if err != nil {
+		return nil, err
+	}
+
+	var moves []shardMove
+	for _, assignment := range assignments {
+		if len(only) > 0 && !only[assignment.ExperimentID] {
+			continue
+		}
+
+		from := assignment.HistoryTable
+		if from == "" {
+			from = shard.TableFor(shard.Legacy{}, assignment.ExperimentID)
+		}
+		to := shard.TableFor(sharder, assignment.ExperimentID)
+		if from == to {
+			if assignment.HistoryTable == "" && pin {
+				if _, err := shards.Pin(assignment.ExperimentKey, assignment.ExperimentID, from); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		moves = append(moves, shardMove{ExperimentID: assignment.ExperimentID, ExperimentKey: assignment.ExperimentKey, From: from, To: to})
+	}
+
+	return moves, nil
+}
+
+// applyMoves repoints every experiment to its new table and moves the rows
+// already written to the old one
+func applyMoves(shards repository.ShardRepository, cache util.Cache, moves []shardMove) error {
+	for _, move := range moves {
+		if err := shards.Set(move.ExperimentKey, move.ExperimentID, move.To); err != nil {
+			return fmt.Errorf("%s: %v", move.ExperimentID, err)
+		}
+		if err := cache.Delete(util.ShardCacheKey(move.ExperimentKey)); err != nil {
+			log.Printf("error delete cache : %v", err)
+		}
+
+		moved, err := shards.MoveHistory(move.From, move.To, move.ExperimentKey)
+		if err != nil {
+			return fmt.Errorf("%s: %v", move.ExperimentID, err)
+		}
+		fmt.Printf("%s moved %d rows\n", move.ExperimentID, moved)
+	}
+
+	return nil
+}
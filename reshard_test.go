@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dennyaris/html-rotate/adapter/repository"
+	"github.com/dennyaris/html-rotate/adapter/shard"
+	BuilderQuery "github.com/dennyaris/html-rotate/package"
+	"github.com/dennyaris/html-rotate/util"
+)
+
+func reshardRepos(t *testing.T) repository.Repositories {
+	t.Helper()
+
+	repos := repository.NewMemory().Repositories()
+	for _, experimentID := range []string{"e_home_fb", "e_landing_tiktok", "e_promo_ig"} {
+		_, err := repos.Experiments.Create(BuilderQuery.Experiment{ExperimentID: experimentID, ExperimentKey: util.EncodeString(experimentID)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repos.Shards.Pin(util.EncodeString("e_promo_ig"), "e_promo_ig", "z_rotator_variant_history_50"); err != nil {
+		t.Fatal(err)
+	}
+	return repos
+}
+
+// move is a planned move, with the experiment key upper case as the
+// repositories read it back through HEX
+func move(experimentID, from, to string) shardMove {
+	return shardMove{ExperimentID: experimentID, ExperimentKey: strings.ToUpper(util.EncodeString(experimentID)), From: from, To: to}
+}
+
+func TestPlanMoves(t *testing.T) {
+	cases := []struct {
+		name  string
+		only  map[string]bool
+		pin   bool
+		moves []shardMove
+		// the table of e_home_fb, already on its target shard, afterwards
+		homeTable string
+	}{
+		{
+			name: "every experiment",
+			pin:  true,
+			moves: []shardMove{
+				move("e_landing_tiktok", "z_rotator_variant_history_33", "z_rotator_variant_history_28"),
+				move("e_promo_ig", "z_rotator_variant_history_50", "z_rotator_variant_history_28"),
+			},
+			homeTable: "z_rotator_variant_history_28",
+		},
+		{
+			name: "dry run",
+			moves: []shardMove{
+				move("e_landing_tiktok", "z_rotator_variant_history_33", "z_rotator_variant_history_28"),
+				move("e_promo_ig", "z_rotator_variant_history_50", "z_rotator_variant_history_28"),
+			},
+		},
+		{
+			name: "only one experiment",
+			only: map[string]bool{"e_promo_ig": true},
+			pin:  true,
+			moves: []shardMove{
+				move("e_promo_ig", "z_rotator_variant_history_50", "z_rotator_variant_history_28"),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		repos := reshardRepos(t)
+		moves, err := planMoves(repos.Shards, shard.Single{Index: 28}, c.only, c.pin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(moves, c.moves) {
+			t.Errorf("%s: moves %+v, want %+v", c.name, moves, c.moves)
+		}
+
+		table, _ := repos.Shards.Table(util.EncodeString("e_home_fb"))
+		if table != c.homeTable {
+			t.Errorf("%s: e_home_fb pinned to %q, want %q", c.name, table, c.homeTable)
+		}
+	}
+}
+
+func TestApplyMoves(t *testing.T) {
+	repos := reshardRepos(t)
+	experimentKey, variantKey := util.EncodeString("e_promo_ig"), util.EncodeString("v_1")
+
+	history := []struct {
+		table string
+		n     int
+	}{
+		{"z_rotator_variant_history_50", 6},
+		{"z_rotator_variant_history_28", 4},
+	}
+	for _, row := range history {
+		if err := repos.History.Increment(row.table, "impression", "2024-01-01", "e_promo_ig", experimentKey, "v_1", variantKey, row.n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := util.NewLRU(16)
+	if err := cache.Set(util.ShardCacheKey(experimentKey), []byte("z_rotator_variant_history_50"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	moves, err := planMoves(repos.Shards, shard.Single{Index: 28}, map[string]bool{"e_promo_ig": true}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyMoves(repos.Shards, cache, moves); err != nil {
+		t.Fatal(err)
+	}
+
+	if table, _ := repos.Shards.Table(experimentKey); table != "z_rotator_variant_history_28" {
+		t.Errorf("e_promo_ig pinned to %s after the move", table)
+	}
+	if _, err := cache.Get(util.ShardCacheKey(experimentKey)); err == nil {
+		t.Error("the cached table survived the move")
+	}
+
+	// the late sweep finds nothing, the first one merged the day into the
+	// row already in the new table
+	if moved, err := repos.Shards.MoveHistory("z_rotator_variant_history_50", "z_rotator_variant_history_28", experimentKey); err != nil || moved != 0 {
+		t.Errorf("late sweep moved %d rows, %v", moved, err)
+	}
+	stats, err := repos.History.Stats(experimentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Impression != 10 {
+		t.Errorf("totals %+v changed by the move", stats)
+	}
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminGuard lets through the requests carrying the admin token as a bearer
+// token. Every request is refused when the token is empty, the admin routes
+// are disabled rather than left open.
+func AdminGuard(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				ResponseError(w, "admin api is disabled", http.StatusForbidden)
+				return
+			}
+
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				ResponseError(w, "invalid admin token", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminGuard(t *testing.T) {
+	cases := []struct {
+		name          string
+		token         string
+		authorization string
+		code          int
+	}{
+		{name: "valid token", token: "s3cret", authorization: "Bearer s3cret", code: http.StatusOK},
+		{name: "no header", token: "s3cret", code: http.StatusUnauthorized},
+		{name: "wrong token", token: "s3cret", authorization: "Bearer s3cre", code: http.StatusUnauthorized},
+		{name: "not a bearer token", token: "s3cret", authorization: "s3cret", code: http.StatusUnauthorized},
+		{name: "no token configured", authorization: "Bearer ", code: http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		called := false
+		guarded := AdminGuard(c.token)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+
+		r := httptest.NewRequest(http.MethodPost, "/api/cache/invalidate", nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		guarded.ServeHTTP(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("%s: answered %d, want %d", c.name, w.Code, c.code)
+		}
+		if called != (c.code == http.StatusOK) {
+			t.Errorf("%s: handler called %v", c.name, called)
+		}
+	}
+}
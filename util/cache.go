@@ -0,0 +1,43 @@
+package util
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCacheMiss is returned by Cache.Get when the key isn't cached
+var ErrCacheMiss = errors.New("cache miss")
+
+// Cache is a key value store with expiring entries. A zero ttl keeps the
+// entry until it is evicted.
+type Cache interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	// Add stores the value only when the key isn't cached yet and reports
+	// whether it was stored
+	Add(key string, value []byte, ttl time.Duration) (bool, error)
+	Delete(key string) error
+	Flush() error
+	// CompareAndSwap replaces the value only while it still equals old and
+	// reports whether it was replaced. A nil old value swaps a missing key.
+	CompareAndSwap(key string, old, new []byte, ttl time.Duration) (bool, error)
+}
+
+// NewCache returns the cache backend named by backend: "memcached" connects
+// to addr, "lru" keeps up to size entries in process, "tiered" puts such an
+// LRU with entries living l1TTL in front of memcached and "noop" caches
+// nothing
+func NewCache(backend, addr string, size int, l1TTL time.Duration) (Cache, error) {
+	switch backend {
+	case "memcached", "":
+		return NewMemcached(addr), nil
+	case "tiered":
+		return NewTiered(NewLRU(size), NewMemcached(addr), l1TTL), nil
+	case "lru":
+		return NewLRU(size), nil
+	case "noop":
+		return NewNoop(), nil
+	}
+
+	return nil, errors.New("unknown cache backend: " + backend)
+}
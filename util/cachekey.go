@@ -0,0 +1,35 @@
+package util
+
+import "strings"
+
+// PageCacheKey is the cache key of the page served for url
+func PageCacheKey(url string) string {
+	return PageCacheKeyHashed(EncodeString(url))
+}
+
+// PageCacheKeyHashed is the cache key of the page whose url_key is the
+// hex sha256 urlKeyHex
+func PageCacheKeyHashed(urlKeyHex string) string {
+	return "page_" + strings.ToLower(urlKeyHex)
+}
+
+// ExperimentCacheKey is the cache key of the variant stats of an experiment
+func ExperimentCacheKey(experimentKeyHex string) string {
+	return "exp_" + strings.ToLower(experimentKeyHex)
+}
+
+// ShardCacheKey is the cache key of the variant history table an experiment
+// is pinned to
+func ShardCacheKey(experimentKeyHex string) string {
+	return "shard_" + strings.ToLower(experimentKeyHex)
+}
+
+// StrategyCacheKey is the cache key of the strategy config of an experiment
+func StrategyCacheKey(experimentKeyHex string) string {
+	return "strategy_" + strings.ToLower(experimentKeyHex)
+}
+
+// WeightsCacheKey is the cache key of the variant weights of an experiment
+func WeightsCacheKey(experimentKeyHex string) string {
+	return "weights_" + strings.ToLower(experimentKeyHex)
+}
@@ -0,0 +1,156 @@
+package util
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultLRUSize is the capacity of an LRU created with a size below one
+const DefaultLRUSize = 10000
+
+// LRU is an in process Cache that keeps at most size entries, evicting the
+// least recently used one first. Expired entries are dropped when read.
+type LRU struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+
+	// now is the clock used for expiration
+	now func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func NewLRU(size int) *LRU {
+	if size < 1 {
+		size = DefaultLRUSize
+	}
+
+	return &LRU{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// get returns the live entry of key, the caller must hold the lock
+func (c *LRU) get(key string) *lruEntry {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if !entry.expires.IsZero() && !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+
+	c.order.MoveToFront(elem)
+	return entry
+}
+
+// set stores the value, the caller must hold the lock
+func (c *LRU) set(key string, value []byte, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+
+	// copy so later changes to the caller's slice don't leak into the cache
+	value = append([]byte(nil), value...)
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *LRU) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.get(key)
+	if entry == nil {
+		return nil, ErrCacheMiss
+	}
+
+	return append([]byte(nil), entry.value...), nil
+}
+
+func (c *LRU) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(key, value, ttl)
+	return nil
+}
+
+func (c *LRU) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.get(key) != nil {
+		return false, nil
+	}
+
+	c.set(key, value, ttl)
+	return true, nil
+}
+
+func (c *LRU) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+
+	return nil
+}
+
+func (c *LRU) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+
+	return nil
+}
+
+func (c *LRU) CompareAndSwap(key string, old, new []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.get(key)
+	switch {
+	case entry == nil && old != nil:
+		return false, nil
+	case entry != nil && (old == nil || !bytes.Equal(entry.value, old)):
+		return false, nil
+	}
+
+	c.set(key, new, ttl)
+	return true, nil
+}
@@ -1,35 +1,47 @@
 package util
 
 import (
+	"bytes"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
-var mc *memcache.Client
+// Memcached is a Cache backed by a memcached server
+type Memcached struct {
+	client *memcache.Client
+}
 
-func InitMemcached(addr string) {
-	mc = memcache.New(addr)
+func NewMemcached(addr string) *Memcached {
+	return &Memcached{client: memcache.New(addr)}
 }
 
-func SetMemcachedValue(key string, value []byte, expiration int) error {
-	// Create a time.Duration for expiration time in seconds
-	expirationTime := time.Duration(expiration) * time.Second
-	// Get the total seconds as int64
-	expirationInSeconds := int32(expirationTime.Seconds())
-	log.Printf("set expired time: %d seconds", expirationInSeconds)
+// maxRelativeExpiration is the longest expiration memcached reads as
+// seconds from now, a larger one is read as a unix time
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// expirationSeconds converts a ttl to the memcached expiration: seconds from
+// now up to 30 days, the unix time of the expiry past that
+func expirationSeconds(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl < time.Second {
+		return 1
+	}
+	if ttl > maxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
 
-	// Set the value in the cache with the specified key, value, and expiration time
-	return mc.Set(&memcache.Item{Key: key, Value: value, Expiration: expirationInSeconds})
+	return int32(ttl.Seconds())
 }
 
-func GetMemcachedValue(key string) ([]byte, error) {
-	item, err := mc.Get(key)
+func (m *Memcached) Get(key string) ([]byte, error) {
+	item, err := m.client.Get(key)
 	if err != nil {
 		if err == memcache.ErrCacheMiss {
-			return nil, fmt.Errorf("key not found in memcached: %s", key)
+			return nil, ErrCacheMiss
 		}
 		return nil, fmt.Errorf("error getting value from memcached: %v", err)
 	}
@@ -37,23 +49,64 @@ func GetMemcachedValue(key string) ([]byte, error) {
 	return item.Value, nil
 }
 
-func Flush() {
-	mc.FlushAll()
+func (m *Memcached) Set(key string, value []byte, ttl time.Duration) error {
+	return m.client.Set(&memcache.Item{Key: key, Value: value, Expiration: expirationSeconds(ttl)})
+}
+
+func (m *Memcached) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	err := m.client.Add(&memcache.Item{Key: key, Value: value, Expiration: expirationSeconds(ttl)})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (m *Memcached) Delete(key string) error {
+	err := m.client.Delete(key)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+
+	return nil
+}
+
+func (m *Memcached) Flush() error {
+	return m.client.FlushAll()
 }
 
-func UpdateValueMemcached(key string, value []byte, expiration int) (*memcache.Item, error) {
-	expirationTime := time.Duration(expiration) * time.Second
-	expirationInSeconds := int32(expirationTime.Seconds())
+// Close closes the idle connections to the memcached server
+func (m *Memcached) Close() error {
+	return m.client.Close()
+}
 
-	newItem := memcache.Item{
-		Key:        key,
-		Value:      value,
-		Expiration: expirationInSeconds,
+func (m *Memcached) CompareAndSwap(key string, old, new []byte, ttl time.Duration) (bool, error) {
+	item, err := m.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		if old != nil {
+			return false, nil
+		}
+		return m.Add(key, new, ttl)
+	}
+	if err != nil {
+		return false, err
+	}
+	if old == nil || !bytes.Equal(item.Value, old) {
+		return false, nil
 	}
 
-	if err := mc.Set(&newItem); err != nil {
-		return nil, err
+	item.Value = new
+	item.Expiration = expirationSeconds(ttl)
+	err = m.client.CompareAndSwap(item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored || err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
 
-	return &newItem, nil
+	return true, nil
 }
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpirationSeconds(t *testing.T) {
+	cases := []struct {
+		ttl  time.Duration
+		want int32
+	}{
+		{0, 0},
+		{-time.Second, 0},
+		{time.Millisecond, 1},
+		{90 * time.Second, 90},
+		{maxRelativeExpiration, 2592000},
+	}
+	for _, c := range cases {
+		if got := expirationSeconds(c.ttl); got != c.want {
+			t.Errorf("%s: expiration %d, want %d", c.ttl, got, c.want)
+		}
+	}
+
+	// past 30 days memcached reads the expiration as a unix time
+	ttl := maxRelativeExpiration + time.Second
+	before := time.Now().Add(ttl).Unix()
+	got := int64(expirationSeconds(ttl))
+	after := time.Now().Add(ttl).Unix()
+	if got < before || got > after {
+		t.Errorf("%s: expiration %d, want the unix time %d", ttl, got, before)
+	}
+}
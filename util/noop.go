@@ -0,0 +1,35 @@
+package util
+
+import "time"
+
+// Noop is a Cache that stores nothing, every read is a miss
+type Noop struct{}
+
+func NewNoop() Noop {
+	return Noop{}
+}
+
+func (Noop) Get(string) ([]byte, error) {
+	return nil, ErrCacheMiss
+}
+
+func (Noop) Set(string, []byte, time.Duration) error {
+	return nil
+}
+
+// Add always reports the value as stored since nothing is ever cached
+func (Noop) Add(string, []byte, time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (Noop) Delete(string) error {
+	return nil
+}
+
+func (Noop) Flush() error {
+	return nil
+}
+
+func (Noop) CompareAndSwap(string, []byte, []byte, time.Duration) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recover answers a request whose handler panics with a 500 JSON error
+// instead of dropping the connection, and logs the panic with its stack
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+
+				log.Printf("panic serving %s %s : %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+				ResponseError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,150 @@
+package util
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultL1TTL is the lifetime of L1 entries of a Tiered cache built
+// without one
+const DefaultL1TTL = 2 * time.Second
+
+// Tiered is a two level Cache: a small in process L1 in front of a shared L2
+// such as memcached. L1 entries live at most L1TTL so a write done by another
+// process is seen after that delay. Concurrent L2 reads of the same key are
+// coalesced into one.
+type Tiered struct {
+	L1    Cache
+	L2    Cache
+	L1TTL time.Duration
+
+	group singleflight.Group
+}
+
+func NewTiered(l1, l2 Cache, l1TTL time.Duration) *Tiered {
+	if l1TTL <= 0 {
+		l1TTL = DefaultL1TTL
+	}
+
+	return &Tiered{L1: l1, L2: l2, L1TTL: l1TTL}
+}
+
+// l1TTL caps ttl to the L1 lifetime
+func (t *Tiered) l1TTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || ttl > t.L1TTL {
+		return t.L1TTL
+	}
+
+	return ttl
+}
+
+func (t *Tiered) Get(key string) ([]byte, error) {
+	if value, err := t.L1.Get(key); err == nil {
+		return value, nil
+	}
+
+	value, err, _ := t.group.Do(key, func() (interface{}, error) {
+		value, err := t.L2.Get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := t.L1.Set(key, value, t.L1TTL); err != nil {
+			log.Printf("error set l1 cache : %v", err)
+		}
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value.([]byte), nil
+}
+
+func (t *Tiered) Set(key string, value []byte, ttl time.Duration) error {
+	if err := t.L2.Set(key, value, ttl); err != nil {
+		t.L1.Delete(key)
+		return err
+	}
+
+	return t.L1.Set(key, value, t.l1TTL(ttl))
+}
+
+// Add asks L2 only, L1 can't tell whether another process stored the key
+func (t *Tiered) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	stored, err := t.L2.Add(key, value, ttl)
+	if err != nil || !stored {
+		return stored, err
+	}
+
+	return true, t.L1.Set(key, value, t.l1TTL(ttl))
+}
+
+func (t *Tiered) Delete(key string) error {
+	t.L1.Delete(key)
+	return t.L2.Delete(key)
+}
+
+func (t *Tiered) Flush() error {
+	t.L1.Flush()
+	return t.L2.Flush()
+}
+
+// Close closes the L2 cache when it holds connections
+func (t *Tiered) Close() error {
+	if closer, ok := t.L2.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (t *Tiered) CompareAndSwap(key string, old, new []byte, ttl time.Duration) (bool, error) {
+	swapped, err := t.L2.CompareAndSwap(key, old, new, ttl)
+	if err != nil || !swapped {
+		t.L1.Delete(key)
+		return swapped, err
+	}
+
+	return true, t.L1.Set(key, new, t.l1TTL(ttl))
+}
+
+// Coalescer loads missing cache entries so that concurrent misses of the
+// same key run the load once and share its result. The zero value is ready
+// to use.
+type Coalescer struct {
+	group singleflight.Group
+}
+
+// GetOrLoad returns the cached value of key, or loads and caches it for ttl.
+// A load returning a nil value is passed through without being cached.
+func (c *Coalescer) GetOrLoad(cache Cache, key string, ttl time.Duration, load func() ([]byte, error)) ([]byte, error) {
+	if value, err := cache.Get(key); err == nil {
+		return value, nil
+	}
+
+	value, err, _ := c.group.Do(key, func() (interface{}, error) {
+		// another caller may have filled the entry while this one waited
+		if value, err := cache.Get(key); err == nil {
+			return value, nil
+		}
+
+		value, err := load()
+		if err != nil || value == nil {
+			return value, err
+		}
+
+		if err := cache.Set(key, value, ttl); err != nil {
+			log.Printf("error set cache : %v", err)
+		}
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value.([]byte), nil
+}
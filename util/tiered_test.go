@@ -0,0 +1,197 @@
+package util
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for the LRU expirations
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newClockedLRU(clock *fakeClock) *LRU {
+	lru := NewLRU(16)
+	lru.now = clock.Now
+	return lru
+}
+
+// countingCache counts the reads reaching a cache, every read waits delay
+type countingCache struct {
+	Cache
+	delay time.Duration
+	gets  atomic.Int32
+}
+
+func (c *countingCache) Get(key string) ([]byte, error) {
+	c.gets.Add(1)
+	time.Sleep(c.delay)
+	return c.Cache.Get(key)
+}
+
+func TestTieredL1(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l2 := &countingCache{Cache: newClockedLRU(clock)}
+	tiered := NewTiered(newClockedLRU(clock), l2, 2*time.Second)
+
+	if err := tiered.Set("page", []byte("v1"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		// write stores a value in L2 only, like another instance would
+		write   string
+		want    string
+		l2Reads int32
+	}{
+		{name: "L1 hit", want: "v1", l2Reads: 0},
+		{name: "another instance writes", write: "v2", want: "v1", l2Reads: 0},
+		{name: "L1 still fresh", advance: 1999 * time.Millisecond, want: "v1", l2Reads: 0},
+		{name: "L1 expired", advance: time.Millisecond, want: "v2", l2Reads: 1},
+		{name: "L1 refilled", want: "v2", l2Reads: 1},
+		{name: "refill expires after L1TTL", advance: 2 * time.Second, want: "v2", l2Reads: 2},
+	}
+
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		if step.write != "" {
+			if err := l2.Set("page", []byte(step.write), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		value, err := tiered.Get("page")
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if string(value) != step.want || l2.gets.Load() != step.l2Reads {
+			t.Errorf("%s: got %s after %d L2 reads, want %s after %d", step.name, value, l2.gets.Load(), step.want, step.l2Reads)
+		}
+	}
+}
+
+func TestTieredShortTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tiered := NewTiered(newClockedLRU(clock), newClockedLRU(clock), 2*time.Second)
+
+	// an entry shorter lived than L1TTL expires from both levels together
+	if err := tiered.Set("nonce", []byte("1"), 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if _, err := tiered.Get("nonce"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expired entry read back: %v", err)
+	}
+}
+
+func TestTieredCoalescesL2Reads(t *testing.T) {
+	l2 := &countingCache{Cache: NewLRU(16), delay: 50 * time.Millisecond}
+	if err := l2.Set("page", []byte("v1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	tiered := NewTiered(NewLRU(16), l2, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := tiered.Get("page"); err != nil || string(value) != "v1" {
+				t.Errorf("got %s: %v", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := l2.gets.Load(); n != 1 {
+		t.Errorf("%d L2 reads for one key", n)
+	}
+}
+
+func TestCoalescerLoadsOnce(t *testing.T) {
+	var coalescer Coalescer
+	cache := NewLRU(16)
+	var loads atomic.Int32
+	release := make(chan struct{})
+
+	load := func() ([]byte, error) {
+		loads.Add(1)
+		<-release
+		return []byte("loaded"), nil
+	}
+
+	const callers = 50
+	var started, done sync.WaitGroup
+	started.Add(callers)
+	done.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer done.Done()
+			started.Done()
+			value, err := coalescer.GetOrLoad(cache, "experiment", time.Minute, load)
+			if err != nil || string(value) != "loaded" {
+				t.Errorf("got %s: %v", value, err)
+			}
+		}()
+	}
+	started.Wait()
+	// let the callers reach the load before it returns
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	done.Wait()
+
+	if n := loads.Load(); n != 1 {
+		t.Errorf("%d loads for %d concurrent misses", n, callers)
+	}
+	if value, err := cache.Get("experiment"); err != nil || string(value) != "loaded" {
+		t.Errorf("cached %s: %v", value, err)
+	}
+}
+
+func TestCoalescerSkipsCachingNilAndErrors(t *testing.T) {
+	var coalescer Coalescer
+	cache := NewLRU(16)
+
+	cases := []struct {
+		name  string
+		value []byte
+		err   error
+	}{
+		{name: "nil value"},
+		{name: "error", err: errors.New("db unavailable")},
+	}
+
+	for _, c := range cases {
+		loads := 0
+		for i := 0; i < 2; i++ {
+			value, err := coalescer.GetOrLoad(cache, c.name, time.Minute, func() ([]byte, error) {
+				loads++
+				return c.value, c.err
+			})
+			if value != nil || !errors.Is(err, c.err) {
+				t.Errorf("%s: got %s, %v", c.name, value, err)
+			}
+		}
+		if loads != 2 {
+			t.Errorf("%s: %d loads, the result was cached", c.name, loads)
+		}
+	}
+}